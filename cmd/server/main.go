@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -71,7 +72,9 @@ func main() {
 	}
 
 	// 自动迁移数据库
-	if err := database.AutoMigrate(&db.Rule{}, &db.Certificate{}, &db.AuthRecord{}); err != nil {
+	if err := database.AutoMigrate(&db.Rule{}, &db.Certificate{}, &db.AuthRecord{},
+		&db.RouteTable{}, &db.RouteTableEntry{}, &db.Rollout{}, &db.IPSet{},
+		&db.CredentialStore{}, &db.Credential{}); err != nil {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
 
@@ -91,7 +94,8 @@ func main() {
 	}
 
 	// 初始化核心组件
-	generator := core.NewGenerator(config.Nginx.TemplateDir, config.Nginx.ConfigDir)
+	generator := core.NewGenerator(config.Nginx.TemplateDir, config.Nginx.ConfigDir, config.Routing.Mode,
+		config.CircuitBreaker.Enabled || config.Rollout.Enabled, config.Nginx.ACMEChallengeDir)
 	nginxManager := core.NewNginxManager(config.Nginx.Path)
 	// 初始化腾讯云SSL服务（如果配置了）
 	var tencentSSL *core.TencentSSLService
@@ -120,8 +124,37 @@ func main() {
 		log.Println("Certificate cleanup service started")
 	}
 
+	// 初始化上游健康检查服务（如果启用）
+	var healthChecker *core.HealthChecker
+	if config.HealthCheck.Enabled {
+		healthChecker = core.NewHealthChecker(database, config.HealthCheck)
+	}
+	// 初始化熔断器（如果启用），由 OpenResty 上报代理结果驱动
+	var circuitBreaker *core.CircuitBreaker
+	if config.CircuitBreaker.Enabled {
+		circuitBreaker = core.NewCircuitBreaker(config.CircuitBreaker)
+		log.Println("Upstream circuit breaker enabled")
+	}
+	// 初始化灰度发布控制器（如果启用）
+	var rolloutController *core.RolloutController
+	if config.Rollout.Enabled {
+		rolloutController = core.NewRolloutController(database, config.Rollout)
+	}
+
 	// 初始化API处理器
-	handler := api.NewHandler(database, generator, nginxManager, config.SSL.CertDir, tencentSSL)
+	handler := api.NewHandler(database, generator, nginxManager, config.SSL.CertDir, tencentSSL, healthChecker, circuitBreaker, rolloutController)
+	if healthChecker != nil {
+		healthChecker.Start()
+		log.Println("Upstream health checker started")
+	}
+	if rolloutController != nil {
+		rolloutController.Start()
+		log.Println("Rollout controller started")
+	}
+
+	// 监听绕过 API 的规则修改，及时重建路由索引
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	handler.WatchRules(watchCtx, 5*time.Second)
 
 	// 设置路由
 	router := gin.Default()
@@ -142,6 +175,50 @@ func main() {
 
 		// 路由查询（供OpenResty调用）
 		apiGroup.POST("/route", handler.Route)
+		apiGroup.GET("/route/snapshot", handler.GetRouteSnapshot)
+		apiGroup.POST("/route/explain", handler.ExplainRoute)
+		apiGroup.POST("/route/tests", handler.RunRouteTests)
+		apiGroup.POST("/route/outcomes", handler.ReportOutcomes)
+
+		// 路由表管理
+		apiGroup.GET("/route-tables", handler.GetRouteTables)
+		apiGroup.GET("/route-tables/:id", handler.GetRouteTable)
+		apiGroup.POST("/route-tables", handler.CreateRouteTable)
+		apiGroup.PUT("/route-tables/:id", handler.UpdateRouteTable)
+		apiGroup.DELETE("/route-tables/:id", handler.DeleteRouteTable)
+		apiGroup.GET("/route-tables/:id/entries", handler.GetRouteTableEntries)
+		apiGroup.PUT("/route-tables/:id/entries", handler.UpsertRouteTableEntries)
+		apiGroup.DELETE("/route-tables/:id/entries/:key", handler.DeleteRouteTableEntry)
+
+		// IP 集合管理
+		apiGroup.GET("/ip-sets", handler.GetIPSets)
+		apiGroup.GET("/ip-sets/:id", handler.GetIPSet)
+		apiGroup.POST("/ip-sets", handler.CreateIPSet)
+		apiGroup.PUT("/ip-sets/:id", handler.UpdateIPSet)
+		apiGroup.DELETE("/ip-sets/:id", handler.DeleteIPSet)
+		apiGroup.GET("/credential-stores", handler.GetCredentialStores)
+		apiGroup.GET("/credential-stores/:id", handler.GetCredentialStore)
+		apiGroup.POST("/credential-stores", handler.CreateCredentialStore)
+		apiGroup.PUT("/credential-stores/:id", handler.UpdateCredentialStore)
+		apiGroup.DELETE("/credential-stores/:id", handler.DeleteCredentialStore)
+		apiGroup.GET("/credential-stores/:id/users", handler.GetCredentials)
+		apiGroup.PUT("/credential-stores/:id/users", handler.UpsertCredentials)
+		apiGroup.DELETE("/credential-stores/:id/users/:username", handler.DeleteCredential)
+
+		// 灰度发布（如果启用）
+		if rolloutController != nil {
+			rolloutGroup := apiGroup.Group("/rollouts")
+			rolloutGroup.GET("", handler.GetRollouts)
+			rolloutGroup.GET("/:id", handler.GetRollout)
+			rolloutGroup.POST("", handler.StartRollout)
+			rolloutGroup.POST("/:id/pause", handler.PauseRollout)
+			rolloutGroup.POST("/:id/resume", handler.ResumeRollout)
+			rolloutGroup.POST("/:id/abort", handler.AbortRollout)
+		}
+
+		// 上游健康状态
+		apiGroup.GET("/health/upstreams", handler.GetUpstreamHealth)
+		apiGroup.GET("/health/circuits", handler.GetCircuits)
 
 		// 证书管理
 		apiGroup.GET("/certificates", handler.GetCertificates)
@@ -193,6 +270,13 @@ func main() {
 	if cleanupService != nil {
 		cleanupService.Stop()
 	}
+	if healthChecker != nil {
+		healthChecker.Stop()
+	}
+	if rolloutController != nil {
+		rolloutController.Stop()
+	}
+	stopWatch()
 
 	log.Println("Server stopped")
 }
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"fmt"
+	"net"
+
+	"nginx-proxy/internal/db"
+)
+
+// maxAccessEntries 单个 location 允许的 allow/deny 条目总数
+const maxAccessEntries = 1024
+
+// validateAccessList 验证 location 的访问控制列表，条目为 CIDR 或 "@名称" 引用的 IP 集合
+func (h *Handler) validateAccessList(location db.Location) error {
+	if len(location.Allow) == 0 && len(location.Deny) == 0 {
+		return nil
+	}
+	// return 指令在 rewrite 阶段执行，早于 allow/deny 所在的 access 阶段，访问控制不会生效
+	switch location.GetType() {
+	case db.LocationTypeRedirect, db.LocationTypeReturn:
+		return fmt.Errorf("allow and deny are not supported for type %s", location.GetType())
+	}
+	if len(location.Allow)+len(location.Deny) > maxAccessEntries {
+		return fmt.Errorf("at most %d allow and deny entries are allowed", maxAccessEntries)
+	}
+	for _, cidr := range location.Allow {
+		if err := h.validateAccessEntry(cidr); err != nil {
+			return fmt.Errorf("allow: %w", err)
+		}
+	}
+	for _, cidr := range location.Deny {
+		if err := h.validateAccessEntry(cidr); err != nil {
+			return fmt.Errorf("deny: %w", err)
+		}
+	}
+	return nil
+}
+
+// validateAccessEntry 验证访问控制列表中的一个条目
+func (h *Handler) validateAccessEntry(entry string) error {
+	if name, ok := db.IPSetRef(entry); ok {
+		return h.validateIPSetRef(name)
+	}
+	if _, _, err := net.ParseCIDR(entry); err != nil {
+		return fmt.Errorf("invalid CIDR '%s'", entry)
+	}
+	return nil
+}
@@ -0,0 +1,430 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"nginx-proxy/internal/db"
+)
+
+// credentialStoreNamePattern 凭据库名称格式，名称同时用作 htpasswd 文件名
+var credentialStoreNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// 用户名和密码的长度限制，bcrypt 只使用密码的前 72 字节
+const (
+	maxUsernameLength = 255
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+// maxBasicAuthRealm 基本认证提示域的最大长度
+const maxBasicAuthRealm = 128
+
+// CredentialStoreRequest 创建或更新凭据库请求
+type CredentialStoreRequest struct {
+	Name        string           `json:"name" binding:"required"`
+	Description string           `json:"description"`
+	Users       []CredentialItem `json:"users"` // 仅创建时使用
+}
+
+// CredentialItem 凭据库用户，密码为明文，保存前转换为 bcrypt 哈希
+type CredentialItem struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// UpsertCredentialsRequest 批量写入凭据库用户请求
+type UpsertCredentialsRequest struct {
+	Users   []CredentialItem `json:"users" binding:"required"`
+	Replace bool             `json:"replace"` // 为 true 时先清空原有用户
+}
+
+// CredentialStoreResponse 凭据库响应
+type CredentialStoreResponse struct {
+	db.CredentialStore
+	UserCount int64    `json:"user_count"`
+	Rules     []string `json:"rules"` // 引用了该凭据库的规则的 server_name
+}
+
+// GetCredentialStores 获取所有凭据库
+func (h *Handler) GetCredentialStores(c *gin.Context) {
+	var stores []db.CredentialStore
+	if err := h.db.Order("name").Find(&stores).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	responses := make([]CredentialStoreResponse, 0, len(stores))
+	for _, store := range stores {
+		resp, err := h.credentialStoreResponse(&store)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		responses = append(responses, *resp)
+	}
+	c.JSON(http.StatusOK, gin.H{"credential_stores": responses})
+}
+
+// GetCredentialStore 获取单个凭据库
+func (h *Handler) GetCredentialStore(c *gin.Context) {
+	store, ok := h.findCredentialStore(c)
+	if !ok {
+		return
+	}
+	resp, err := h.credentialStoreResponse(store)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// CreateCredentialStore 创建凭据库
+func (h *Handler) CreateCredentialStore(c *gin.Context) {
+	var req CredentialStoreRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateCredentials(req.Users); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.validateCredentialStoreName(req.Name, ""); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	store := db.CredentialStore{
+		ID:          uuid.New().String(),
+		Name:        req.Name,
+		Description: req.Description,
+	}
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&store).Error; err != nil {
+			return err
+		}
+		return upsertCredentials(tx, store.ID, req.Users)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// 新凭据库还没有被引用，只需更新索引
+	if err := h.credentials.Reload(); err != nil {
+		log.Printf("Warning: Failed to reload credential stores: %v", err)
+	}
+	c.JSON(http.StatusCreated, CredentialStoreResponse{CredentialStore: store, UserCount: int64(len(req.Users)), Rules: []string{}})
+}
+
+// UpdateCredentialStore 更新凭据库名称和描述
+func (h *Handler) UpdateCredentialStore(c *gin.Context) {
+	store, ok := h.findCredentialStore(c)
+	if !ok {
+		return
+	}
+	var req CredentialStoreRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	oldName := store.Name
+	if req.Name != oldName {
+		if err := h.validateCredentialStoreName(req.Name, store.ID); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		// 被规则引用的凭据库不允许改名，否则引用会失效
+		rules, err := h.rulesReferencingCredentialStore(oldName)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(rules) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Credential store is being used by rules: %v", ruleServerNames(rules))})
+			return
+		}
+	}
+	store.Name = req.Name
+	store.Description = req.Description
+	if err := h.db.Save(store).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.credentials.Reload(); err != nil {
+		log.Printf("Warning: Failed to reload credential stores: %v", err)
+	}
+	if req.Name != oldName {
+		if err := h.generator.DeleteHtpasswd(oldName); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	c.JSON(http.StatusOK, store)
+}
+
+// DeleteCredentialStore 删除凭据库及其所有用户，被规则引用时不允许删除
+func (h *Handler) DeleteCredentialStore(c *gin.Context) {
+	store, ok := h.findCredentialStore(c)
+	if !ok {
+		return
+	}
+	rules, err := h.rulesReferencingCredentialStore(store.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(rules) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Credential store is being used by rules: %v", ruleServerNames(rules))})
+		return
+	}
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("store_id = ?", store.ID).Delete(&db.Credential{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(store).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.credentials.Reload(); err != nil {
+		log.Printf("Warning: Failed to reload credential stores: %v", err)
+	}
+	if err := h.generator.DeleteHtpasswd(store.Name); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Credential store deleted successfully"})
+}
+
+// GetCredentials 获取凭据库的所有用户，不返回密码哈希
+func (h *Handler) GetCredentials(c *gin.Context) {
+	store, ok := h.findCredentialStore(c)
+	if !ok {
+		return
+	}
+	var users []db.Credential
+	if err := h.db.Where("store_id = ?", store.ID).Order("username").Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"users": users})
+}
+
+// UpsertCredentials 批量新增用户或修改已有用户的密码
+func (h *Handler) UpsertCredentials(c *gin.Context) {
+	store, ok := h.findCredentialStore(c)
+	if !ok {
+		return
+	}
+	var req UpsertCredentialsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateCredentials(req.Users); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if req.Replace {
+			if err := tx.Where("store_id = ?", store.ID).Delete(&db.Credential{}).Error; err != nil {
+				return err
+			}
+		}
+		return upsertCredentials(tx, store.ID, req.Users)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.applyCredentialChange(store.Name); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Users saved but failed to apply: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Credential store users updated successfully", "count": len(req.Users)})
+}
+
+// DeleteCredential 删除凭据库中的一个用户
+func (h *Handler) DeleteCredential(c *gin.Context) {
+	store, ok := h.findCredentialStore(c)
+	if !ok {
+		return
+	}
+	result := h.db.Where("store_id = ? AND username = ?", store.ID, c.Param("username")).Delete(&db.Credential{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Credential store user not found"})
+		return
+	}
+	if err := h.applyCredentialChange(store.Name); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User deleted but failed to apply: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Credential store user deleted successfully"})
+}
+
+// findCredentialStore 按路径参数 id 查找凭据库，找不到时直接写入错误响应
+func (h *Handler) findCredentialStore(c *gin.Context) (*db.CredentialStore, bool) {
+	var store db.CredentialStore
+	if err := h.db.First(&store, "id = ?", c.Param("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Credential store not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return &store, true
+}
+
+// credentialStoreResponse 组装凭据库响应
+func (h *Handler) credentialStoreResponse(store *db.CredentialStore) (*CredentialStoreResponse, error) {
+	var count int64
+	if err := h.db.Model(&db.Credential{}).Where("store_id = ?", store.ID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	rules, err := h.rulesReferencingCredentialStore(store.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &CredentialStoreResponse{CredentialStore: *store, UserCount: count, Rules: ruleServerNames(rules)}, nil
+}
+
+// upsertCredentials 计算密码哈希并写入用户，用户名已存在时更新密码
+func upsertCredentials(tx *gorm.DB, storeID string, items []CredentialItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	credentials := make([]db.Credential, 0, len(items))
+	for _, item := range items {
+		hash, err := bcrypt.GenerateFromPassword([]byte(item.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("failed to hash password for '%s': %w", item.Username, err)
+		}
+		credentials = append(credentials, db.Credential{StoreID: storeID, Username: item.Username, PasswordHash: string(hash)})
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "store_id"}, {Name: "username"}},
+		DoUpdates: clause.AssignmentColumns([]string{"password_hash", "updated_at"}),
+	}).CreateInBatches(&credentials, 500).Error
+}
+
+// applyCredentialChange 重新加载凭据库索引，凭据库被引用时重写 htpasswd 文件
+// nginx 在每次认证时读取文件，不需要重新生成配置或重新加载
+func (h *Handler) applyCredentialChange(name string) error {
+	if err := h.credentials.Reload(); err != nil {
+		return fmt.Errorf("failed to reload credential stores: %w", err)
+	}
+	rules, err := h.rulesReferencingCredentialStore(name)
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return h.generator.WriteHtpasswd(name)
+}
+
+// validateCredentialStoreName 验证凭据库名称格式和唯一性
+func (h *Handler) validateCredentialStoreName(name, excludeID string) error {
+	if !credentialStoreNamePattern.MatchString(name) {
+		return fmt.Errorf("credential store name may only contain letters, digits, '_' and '-'")
+	}
+	var count int64
+	query := h.db.Model(&db.CredentialStore{}).Where("name = ?", name)
+	if excludeID != "" {
+		query = query.Where("id != ?", excludeID)
+	}
+	if err := query.Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to check existing credential stores: %w", err)
+	}
+	if count > 0 {
+		return fmt.Errorf("credential store '%s' already exists", name)
+	}
+	return nil
+}
+
+// validateCredentials 验证用户名和密码，用户名写入 htpasswd 文件，不能包含 ':'、空白或控制字符
+func validateCredentials(items []CredentialItem) error {
+	seen := make(map[string]bool, len(items))
+	for _, item := range items {
+		if len(item.Username) > maxUsernameLength {
+			return fmt.Errorf("username must not exceed %d bytes", maxUsernameLength)
+		}
+		if strings.ContainsRune(item.Username, ':') || strings.IndexFunc(item.Username, func(r rune) bool {
+			return unicode.IsSpace(r) || unicode.IsControl(r)
+		}) >= 0 {
+			return fmt.Errorf("username '%s' must not contain ':', whitespace or control characters", item.Username)
+		}
+		if seen[item.Username] {
+			return fmt.Errorf("duplicate username '%s'", item.Username)
+		}
+		seen[item.Username] = true
+		if len(item.Password) < minPasswordLength || len(item.Password) > maxPasswordLength {
+			return fmt.Errorf("password for '%s' must be between %d and %d bytes", item.Username, minPasswordLength, maxPasswordLength)
+		}
+	}
+	return nil
+}
+
+// validateBasicAuth 验证 location 的基本认证配置
+func (h *Handler) validateBasicAuth(location db.Location) error {
+	auth := location.BasicAuth
+	if auth == nil {
+		return nil
+	}
+	// return 指令在 rewrite 阶段执行，早于认证所在的 access 阶段，认证不会生效
+	switch location.GetType() {
+	case db.LocationTypeRedirect, db.LocationTypeReturn:
+		return fmt.Errorf("basic_auth is not supported for type %s", location.GetType())
+	}
+	if len(auth.Realm) > maxBasicAuthRealm {
+		return fmt.Errorf("basic_auth realm must not exceed %d bytes", maxBasicAuthRealm)
+	}
+	// $ 会被 nginx 当作变量展开，auth_basic 的值为 off 时会关闭认证
+	if auth.Realm == "off" || strings.IndexFunc(auth.Realm, func(r rune) bool {
+		return r == '$' || unicode.IsControl(r)
+	}) >= 0 {
+		return fmt.Errorf("invalid basic_auth realm '%s'", auth.Realm)
+	}
+	var count int64
+	if err := h.db.Model(&db.CredentialStore{}).Where("name = ?", auth.Store).Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to check credential store: %w", err)
+	}
+	if count == 0 {
+		return fmt.Errorf("credential store '%s' does not exist", auth.Store)
+	}
+	return nil
+}
+
+// rulesReferencingCredentialStore 返回引用了指定凭据库的规则
+func (h *Handler) rulesReferencingCredentialStore(name string) ([]db.Rule, error) {
+	var rules []db.Rule
+	if err := h.db.Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	var referencing []db.Rule
+	for _, rule := range rules {
+		locations, err := rule.GetLocations()
+		if err != nil {
+			continue
+		}
+		if db.ReferencesCredentialStore(locations, name) {
+			referencing = append(referencing, rule)
+		}
+	}
+	return referencing, nil
+}
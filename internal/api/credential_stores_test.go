@@ -0,0 +1,110 @@
+package api
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"nginx-proxy/internal/db"
+)
+
+// htpasswdUsers 读取凭据库的 htpasswd 文件，返回用户名到密码哈希的映射（按文件中的顺序返回用户名）
+func htpasswdUsers(t *testing.T, h *Handler, store string) ([]string, map[string]string) {
+	t.Helper()
+	data, err := os.ReadFile(h.generator.HtpasswdPath(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	hashes := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		name, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			t.Fatalf("invalid htpasswd line %q", line)
+		}
+		names = append(names, name)
+		hashes[name] = hash
+	}
+	return names, hashes
+}
+
+func TestCredentialStoreHtpasswd(t *testing.T) {
+	h, r := newAPITestHandler(t, "/bin/true")
+	w := serveJSON(r, http.MethodPost, "/api/credential-stores",
+		`{"name":"staff","users":[{"username":"bob","password":"bob-secret"},{"username":"alice","password":"alice-secret"}]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create credential store: %d %s", w.Code, w.Body)
+	}
+	var store db.CredentialStore
+	if err := h.db.First(&store, "name = ?", "staff").Error; err != nil {
+		t.Fatal(err)
+	}
+	// 未被引用的凭据库不写入 htpasswd 文件
+	if _, err := os.Stat(h.generator.HtpasswdPath("staff")); !os.IsNotExist(err) {
+		t.Fatalf("htpasswd written before the store is referenced: %v", err)
+	}
+	w = serveJSON(r, http.MethodPost, "/api/rules", `{"server_name":"a.example.com","listen_ports":[80],
+		"locations":[{"path":"/admin","basic_auth":{"store":"staff"},"upstreams":[{"target":"http://a:80"}]}]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create rule: %d %s", w.Code, w.Body)
+	}
+	var rule db.Rule
+	if err := h.db.First(&rule).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// 生成配置时写入 htpasswd 文件，保存 bcrypt 哈希而不是明文密码
+	names, hashes := htpasswdUsers(t, h, "staff")
+	if strings.Join(names, ",") != "alice,bob" {
+		t.Fatalf("users = %v, want [alice bob]", names)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hashes["alice"]), []byte("alice-secret")); err != nil {
+		t.Errorf("alice: %v", err)
+	}
+
+	// 修改用户后立即重写文件
+	w = serveJSON(r, http.MethodPut, "/api/credential-stores/"+store.ID+"/users",
+		`{"users":[{"username":"carol","password":"carol-secret"},{"username":"alice","password":"alice-new"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upsert users: %d %s", w.Code, w.Body)
+	}
+	names, hashes = htpasswdUsers(t, h, "staff")
+	if strings.Join(names, ",") != "alice,bob,carol" {
+		t.Fatalf("users = %v, want [alice bob carol]", names)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hashes["alice"]), []byte("alice-new")); err != nil {
+		t.Errorf("alice after password change: %v", err)
+	}
+	if w := serveJSON(r, http.MethodDelete, "/api/credential-stores/"+store.ID+"/users/bob", ""); w.Code != http.StatusOK {
+		t.Fatalf("delete user: %d %s", w.Code, w.Body)
+	}
+	w = serveJSON(r, http.MethodPut, "/api/credential-stores/"+store.ID+"/users",
+		`{"users":[{"username":"dave","password":"dave-secret"}],"replace":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("replace users: %d %s", w.Code, w.Body)
+	}
+	if names, _ = htpasswdUsers(t, h, "staff"); strings.Join(names, ",") != "dave" {
+		t.Fatalf("users = %v, want [dave]", names)
+	}
+
+	// 被引用的凭据库不能删除，删除后移除 htpasswd 文件
+	w = serveJSON(r, http.MethodDelete, "/api/credential-stores/"+store.ID, "")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "a.example.com") {
+		t.Fatalf("delete referenced store: %d %s", w.Code, w.Body)
+	}
+	if w := serveJSON(r, http.MethodDelete, "/api/rules/"+rule.ID, ""); w.Code != http.StatusOK {
+		t.Fatalf("delete rule: %d %s", w.Code, w.Body)
+	}
+	if w := serveJSON(r, http.MethodDelete, "/api/credential-stores/"+store.ID, ""); w.Code != http.StatusOK {
+		t.Fatalf("delete store: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(h.generator.HtpasswdPath("staff")); !os.IsNotExist(err) {
+		t.Fatalf("htpasswd file not removed: %v", err)
+	}
+}
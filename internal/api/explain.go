@@ -0,0 +1,334 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"nginx-proxy/internal/db"
+)
+
+// ExplainResponse 路由解释响应，包含与 /api/route 相同的路由结果及完整的匹配过程
+type ExplainResponse struct {
+	Result RouteResponse `json:"result"`
+	Trace  RouteTrace    `json:"trace"`
+}
+
+// RouteTrace 路由匹配过程
+type RouteTrace struct {
+	Rule      *RuleTrace      `json:"rule"`                // 为空表示没有匹配的规则
+	Error     string          `json:"error,omitempty"`     // 规则配置错误
+	Locations []LocationTrace `json:"locations,omitempty"` // 规则中的每个 location
+	Lookup    *LookupTrace    `json:"lookup,omitempty"`    // 选中 location 的路由表查找
+	Upstreams []UpstreamTrace `json:"upstreams,omitempty"` // 选中 location 的每个上游
+	Selection string          `json:"selection,omitempty"` // 上游的选择方式
+}
+
+// RuleTrace 规则匹配结果
+type RuleTrace struct {
+	ID         string            `json:"id"`
+	ServerName string            `json:"server_name"`
+	MatchedBy  string            `json:"matched_by"` // server_name（nginx 选中的 server_name）或主机名的匹配类型
+	Captures   map[string]string `json:"captures,omitempty"`
+}
+
+// LocationTrace 单个 location 的匹配结果
+type LocationTrace struct {
+	Index    int               `json:"index"`
+	Modifier string            `json:"modifier,omitempty"`
+	Path     string            `json:"path"`
+	Type     string            `json:"type"`
+	Matched  bool              `json:"matched"`
+	Selected bool              `json:"selected"`
+	Reason   string            `json:"reason"`
+	Captures map[string]string `json:"captures,omitempty"`
+}
+
+// LookupTrace 路由表查找结果
+type LookupTrace struct {
+	Table  string `json:"table"`
+	Source string `json:"source"`
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Hit    bool   `json:"hit"`
+	Target string `json:"target,omitempty"`
+}
+
+// UpstreamTrace 单个上游的条件匹配结果
+type UpstreamTrace struct {
+	Index      int              `json:"index"`
+	Target     string           `json:"target"`
+	Weight     int              `json:"weight"`
+	Group      int              `json:"group"` // 条件组编号，权重和会话保持只在组内生效
+	Matched    bool             `json:"matched"`
+	Candidate  bool             `json:"candidate"`         // 是否参与最终选择
+	Healthy    bool             `json:"healthy"`           // 未启用健康检查时始终为 true
+	Circuit    string           `json:"circuit,omitempty"` // 熔断状态，未启用熔断时为空
+	Conditions []ConditionTrace `json:"conditions"`
+}
+
+// ConditionTrace 单个条件的匹配结果
+type ConditionTrace struct {
+	Kind     string `json:"kind"` // ip、method、header、cookie、query
+	Name     string `json:"name,omitempty"`
+	Operator string `json:"operator,omitempty"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	Present  bool   `json:"present"`
+	Matched  bool   `json:"matched"`
+}
+
+// 上游的选择方式
+const (
+	selectionLookup     = "lookup"      // 路由表命中
+	selectionFirstMatch = "first_match" // 均未设置权重，使用第一个匹配的上游
+	selectionWeighted   = "weighted"    // 按权重随机
+	selectionSticky     = "sticky"      // 会话保持一致性哈希
+	selectionNone       = "none"        // 没有匹配的上游
+	selectionNotProxied = "not_proxied" // 选中的 location 由 nginx 直接处理，不转发到上游
+)
+
+// ExplainRoute 解释路由过程（不影响实际流量，用于排查路由问题）
+// 请求格式与 /api/route 相同，按权重随机选择时 result 只是一次抽样
+func (h *Handler) ExplainRoute(c *gin.Context) {
+	var req RouteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if req.Path == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Path is required"})
+		return
+	}
+	idx := h.routes.Load()
+	resp := ExplainResponse{Trace: h.explain(idx, &req)}
+	result, err := h.route(idx, &req)
+	if err != nil {
+		resp.Trace.Error = err.Error()
+	}
+	resp.Result = result
+	c.JSON(http.StatusOK, resp)
+}
+
+// explain 记录请求在路由索引中的匹配过程
+func (h *Handler) explain(idx *routeIndex, req *RouteRequest) RouteTrace {
+	var trace RouteTrace
+	rule, captures := idx.findRule(req.ServerName, req.Host)
+	if rule == nil {
+		return trace
+	}
+	trace.Rule = &RuleTrace{
+		ID:         rule.rule.ID,
+		ServerName: rule.rule.ServerName,
+		MatchedBy:  "server_name",
+		Captures:   captures,
+	}
+	if _, ok := idx.byName[req.ServerName]; !ok {
+		trace.Rule.MatchedBy = serverNameType(rule.rule.ServerName)
+	}
+	if rule.err != nil {
+		trace.Error = rule.err.Error()
+		return trace
+	}
+	selected, _, found := rule.findLocation(req.Path)
+	trace.Locations = explainLocations(rule, req.Path, selected, found)
+	if !found {
+		return trace
+	}
+	location := &rule.locations[selected]
+	if !location.location.IsProxy() {
+		trace.Selection = selectionNotProxied
+		return trace
+	}
+	if lookup := location.location.Lookup; lookup != nil {
+		trace.Lookup = h.explainLookup(req, lookup)
+		if trace.Lookup.Hit {
+			trace.Selection = selectionLookup
+			return trace
+		}
+	}
+	for i := range location.upstreams {
+		upstream := explainUpstream(req, &location.upstreams[i])
+		upstream.Index = i
+		upstream.Target = location.location.Upstreams[i].Target
+		upstream.Weight = location.location.Upstreams[i].Weight
+		upstream.Group = location.upstreams[i].group
+		upstream.Healthy = h.health == nil || h.health.IsHealthy(upstream.Target)
+		if h.breaker != nil {
+			upstream.Circuit = h.breaker.State(upstream.Target)
+		}
+		trace.Upstreams = append(trace.Upstreams, upstream)
+	}
+	matched, weighted, _, skipped := h.matchUpstreams(req, location, true, nil, nil)
+	if len(matched) == 0 && skipped {
+		matched, weighted, _, _ = h.matchUpstreams(req, location, false, nil, nil)
+	}
+	candidates := weighted
+	if len(candidates) == 0 {
+		candidates = matched
+	}
+	for _, i := range candidates {
+		trace.Upstreams[i].Candidate = true
+	}
+	switch {
+	case len(matched) == 0:
+		trace.Selection = selectionNone
+	case location.location.Sticky != nil:
+		trace.Selection = selectionSticky
+	case len(weighted) > 0:
+		trace.Selection = selectionWeighted
+	default:
+		trace.Selection = selectionFirstMatch
+	}
+	return trace
+}
+
+// explainLocations 按 nginx 的匹配顺序说明每个 location 是否命中以及是否被选中
+func explainLocations(rule *compiledRule, requestPath string, selected int, found bool) []LocationTrace {
+	traces := make([]LocationTrace, len(rule.locations))
+	exactHit := false
+	longest := -1
+	for i := range rule.locations {
+		location := &rule.locations[i].location
+		trace := &traces[i]
+		trace.Index, trace.Modifier, trace.Path, trace.Type = i, location.Modifier, location.Path, location.GetType()
+		switch {
+		case location.Modifier == db.LocationModifierExact:
+			trace.Matched = requestPath == location.Path
+			if trace.Matched {
+				trace.Reason = "exact match"
+				exactHit = true
+			} else {
+				trace.Reason = "path is not equal"
+			}
+		case location.IsPrefix():
+			trace.Matched = strings.HasPrefix(requestPath, location.Path)
+			if trace.Matched {
+				trace.Reason = "prefix match"
+				if longest < 0 || len(location.Path) > len(rule.locations[longest].location.Path) {
+					longest = i
+				}
+			} else {
+				trace.Reason = "path does not start with prefix"
+			}
+		}
+	}
+	if longest >= 0 {
+		traces[longest].Reason = "longest prefix match"
+	}
+	stopped := ""
+	switch {
+	case exactHit:
+		stopped = "not evaluated: exact location matched"
+	case longest >= 0 && rule.locations[longest].location.Modifier == db.LocationModifierPrefixPriority:
+		stopped = "not evaluated: longest prefix is '^~'"
+	}
+	for i := range rule.locations {
+		location := &rule.locations[i]
+		if !location.location.IsRegex() {
+			continue
+		}
+		trace := &traces[i]
+		switch {
+		case location.regex == nil:
+			trace.Reason = "invalid regex"
+		case stopped != "":
+			trace.Reason = stopped
+		default:
+			captures, ok := regexCaptures(location.regex, requestPath)
+			trace.Matched = ok
+			if ok {
+				trace.Reason = "regex match"
+				trace.Captures = captures
+				stopped = "not evaluated: earlier regex matched"
+			} else {
+				trace.Reason = "regex does not match"
+			}
+		}
+	}
+	if found {
+		traces[selected].Selected = true
+	}
+	return traces
+}
+
+// explainLookup 说明路由表查找的过程
+func (h *Handler) explainLookup(req *RouteRequest, lookup *db.LookupConfig) *LookupTrace {
+	trace := &LookupTrace{Table: lookup.Table, Source: lookup.Source, Key: lookup.Key}
+	switch lookup.Source {
+	case db.LookupSourceHeader:
+		trace.Value, _ = lookupHeader(req.Headers, strings.ToLower(lookup.Key))
+	case db.LookupSourceCookie:
+		trace.Value = req.Cookies[lookup.Key]
+	case db.LookupSourceQuery:
+		trace.Value = req.Query[lookup.Key]
+	}
+	trace.Target, trace.Hit = h.lookupTarget(req, lookup)
+	return trace
+}
+
+// explainUpstream 逐个检查上游的条件（不短路），说明每个条件的结果
+func explainUpstream(req *RouteRequest, upstream *compiledUpstream) UpstreamTrace {
+	trace := UpstreamTrace{Matched: true, Conditions: []ConditionTrace{}}
+	add := func(condition ConditionTrace) {
+		trace.Conditions = append(trace.Conditions, condition)
+		trace.Matched = trace.Matched && condition.Matched
+	}
+	if upstream.hasIP {
+		expected := "invalid"
+		if len(upstream.prefixes) > 0 {
+			prefixes := make([]string, 0, len(upstream.prefixes))
+			for _, prefix := range upstream.prefixes {
+				prefixes = append(prefixes, prefix.String())
+			}
+			expected = strings.Join(prefixes, ",")
+		}
+		add(ConditionTrace{
+			Kind:     "ip",
+			Expected: expected,
+			Actual:   req.RemoteAddr,
+			Present:  req.RemoteAddr != "",
+			Matched:  upstream.matchIP(req.RemoteAddr),
+		})
+	}
+	if len(upstream.methods) > 0 {
+		add(ConditionTrace{
+			Kind:     "method",
+			Expected: strings.Join(upstream.methods, ","),
+			Actual:   req.Method,
+			Present:  req.Method != "",
+			Matched:  matchMethod(req.Method, upstream.methods),
+		})
+	}
+	for i := range upstream.headers {
+		value, exists := lookupHeader(req.Headers, upstream.headers[i].Name)
+		add(explainCondition("header", &upstream.headers[i], value, exists))
+	}
+	for i := range upstream.cookies {
+		value, exists := req.Cookies[upstream.cookies[i].Name]
+		add(explainCondition("cookie", &upstream.cookies[i], value, exists))
+	}
+	for i := range upstream.query {
+		value, exists := req.Query[upstream.query[i].Name]
+		add(explainCondition("query", &upstream.query[i], value, exists))
+	}
+	return trace
+}
+
+// explainCondition 说明单个头部、Cookie 或查询参数条件的结果
+func explainCondition(kind string, condition *compiledCondition, value string, exists bool) ConditionTrace {
+	operator := condition.Operator
+	if operator == "" {
+		operator = db.MatchOperatorEquals
+	}
+	return ConditionTrace{
+		Kind:     kind,
+		Name:     condition.Name,
+		Operator: operator,
+		Expected: condition.Value,
+		Actual:   value,
+		Present:  exists,
+		Matched:  matchCondition(condition, value, exists),
+	}
+}
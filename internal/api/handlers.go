@@ -4,15 +4,16 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
-	"time"
+	"sync"
+	"sync/atomic"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"github.com/patrickmn/go-cache"
 
 	"gorm.io/gorm"
 
@@ -26,30 +27,72 @@ type Handler struct {
 	generator    *core.Generator
 	nginxManager *core.NginxManager
 	certDir      string
-	cache        *cache.Cache
 	tencentSSL   *core.TencentSSLService
+	routeTables  *core.RouteTableIndex
+	ipSets       *core.IPSetIndex
+	credentials  *core.CredentialIndex
+	snapshots    *core.SnapshotStore
+	health       *core.HealthChecker        // 为空表示未启用健康检查
+	breaker      *core.CircuitBreaker       // 为空表示未启用熔断
+	rollouts     *core.RolloutController    // 为空表示未启用灰度发布
+	routes       atomic.Pointer[routeIndex] // 预编译的路由索引
+	routesMu     sync.Mutex                 // 串行化路由索引的重建
 }
 
 // NewHandler 创建新的 API 处理器
-func NewHandler(database *gorm.DB, generator *core.Generator, nginxManager *core.NginxManager, certDir string, tencentSSL *core.TencentSSLService) *Handler {
+func NewHandler(database *gorm.DB, generator *core.Generator, nginxManager *core.NginxManager, certDir string, tencentSSL *core.TencentSSLService, health *core.HealthChecker, breaker *core.CircuitBreaker, rollouts *core.RolloutController) *Handler {
 	h := &Handler{
 		db:           database,
 		generator:    generator,
 		nginxManager: nginxManager,
 		certDir:      certDir,
-		cache:        cache.New(5*time.Minute, 10*time.Minute), // 5分钟过期，10分钟清理
 		tencentSSL:   tencentSSL,
+		routeTables:  core.NewRouteTableIndex(database),
+		ipSets:       core.NewIPSetIndex(database),
+		credentials:  core.NewCredentialIndex(database),
+		snapshots:    core.NewSnapshotStore(database),
+		health:       health,
+		breaker:      breaker,
+		rollouts:     rollouts,
+	}
+	if health != nil {
+		h.snapshots.WatchHealth(health)
+	}
+	if breaker != nil {
+		h.snapshots.WatchCircuits(breaker)
+	}
+	if rollouts != nil {
+		rollouts.SetRuleUpdater(h.UpdateRuleLocations)
+	}
+	if err := h.routeTables.Reload(); err != nil {
+		log.Printf("Warning: Failed to load route tables: %v", err)
+	}
+	if err := h.ipSets.Reload(); err != nil {
+		log.Printf("Warning: Failed to load ip sets: %v", err)
+	}
+	generator.SetIPSets(h.ipSets)
+	if err := h.credentials.Reload(); err != nil {
+		log.Printf("Warning: Failed to load credential stores: %v", err)
+	}
+	generator.SetCredentials(h.credentials)
+	h.routes.Store(buildRouteIndex(nil, "", nil))
+	if err := h.rebuildRoutes(); err != nil {
+		log.Printf("Warning: Failed to build route index: %v", err)
 	}
 	return h
 }
 
 // CreateRuleRequest 创建规则请求
 type CreateRuleRequest struct {
-	ServerName  string        `json:"server_name" binding:"required"`
-	ListenPorts []int         `json:"listen_ports" binding:"required"`
-	SSLCert     string        `json:"ssl_cert"`
-	SSLKey      string        `json:"ssl_key"`
-	Locations   []db.Location `json:"locations" binding:"required"`
+	ServerName  string             `json:"server_name" binding:"required"`
+	ListenPorts []db.ListenEntry   `json:"listen_ports" binding:"required"` // 端口及协议，兼容纯端口号
+	SSLCert     string             `json:"ssl_cert"`
+	SSLKey      string             `json:"ssl_key"`
+	ForceHTTPS  bool               `json:"force_https"` // 明文端口（没有时为 80）只做 HTTPS 重定向
+	Locations   []db.Location      `json:"locations" binding:"required"`
+	FailMode    string             `json:"fail_mode"`  // closed 或 stale，为空时等同于 closed
+	StaleTTL    int                `json:"stale_ttl"`  // stale 模式下缓存路由结果的有效期（秒）
+	TestCases   []db.RouteTestCase `json:"test_cases"` // 路由测试用例，规则变更前用新的 locations 验证；更新时未提供则保留原有用例
 }
 
 // validateSSLConfig 验证 SSL 配置
@@ -67,27 +110,53 @@ func (h *Handler) validateSSLConfig(req *CreateRuleRequest) error {
 			return fmt.Errorf("ssl key file does not exist: %s", req.SSLKey)
 		}
 	}
-	return nil
-}
-
-// clearRuleCache 清除指定 server_name 的缓存
-func (h *Handler) clearRuleCache(serverName string) {
-	cacheKey := fmt.Sprintf("rule:%s", serverName)
-	h.cache.Delete(cacheKey)
-	log.Printf("Cleared cache for server_name: %s", serverName)
+	return validateListens(req)
 }
 
-// clearAllRuleCache 清除所有规则缓存
-func (h *Handler) clearAllRuleCache() {
-	h.cache.Flush()
-	log.Printf("Cleared all rule cache")
+// validateListens 验证监听端口及协议，HTTPS 协议和强制 HTTPS 都需要证书
+func validateListens(req *CreateRuleRequest) error {
+	hasCert := req.SSLCert != "" && req.SSLKey != ""
+	seen := make(map[int]bool)
+	for _, entry := range req.ListenPorts {
+		if entry.Port < 1 || entry.Port > 65535 {
+			return fmt.Errorf("invalid listen port %d", entry.Port)
+		}
+		if seen[entry.Port] {
+			return fmt.Errorf("duplicate listen port %d", entry.Port)
+		}
+		seen[entry.Port] = true
+		switch entry.Protocol {
+		case "", db.ListenProtocolPlain:
+		case db.ListenProtocolSSL, db.ListenProtocolHTTP2:
+			if !hasCert {
+				return fmt.Errorf("listen port %d: protocol %s requires ssl_cert and ssl_key", entry.Port, entry.Protocol)
+			}
+		default:
+			return fmt.Errorf("listen port %d: unsupported protocol '%s'", entry.Port, entry.Protocol)
+		}
+	}
+	if !req.ForceHTTPS {
+		return nil
+	}
+	plan := db.PlanListens(req.ListenPorts, hasCert, true)
+	if plan.HTTPSPort == 0 {
+		return fmt.Errorf("force_https requires an ssl or http2 listen port")
+	}
+	// 没有明文端口时重定向服务器使用默认端口，不能与 HTTPS 端口冲突
+	if len(plan.Listens) == len(req.ListenPorts) && seen[db.DefaultHTTPPort] {
+		return fmt.Errorf("force_https: port %d is used for https, add a plain listen port for the redirect", db.DefaultHTTPPort)
+	}
+	return nil
 }
 
 // Upstream 上游服务器结构
 type Upstream struct {
-	Target      string            `json:"target"`
-	ConditionIP string            `json:"condition_ip"`
-	Headers     map[string]string `json:"headers"`
+	Target      string             `json:"target"`
+	ConditionIP string             `json:"condition_ip"`
+	Headers     db.MatchConditions `json:"headers"`
+	Cookies     db.MatchConditions `json:"cookies"`
+	Query       db.MatchConditions `json:"query"`
+	Methods     []string           `json:"methods"`
 }
 
 // RouteRequest 路由请求结构（简化版，配置从数据库查询）
@@ -95,13 +164,21 @@ type RouteRequest struct {
 	Path       string            `json:"path"`
 	RemoteAddr string            `json:"remote_addr"`
 	Headers    map[string]string `json:"headers"`
-	ServerName string            `json:"server_name"`
+	Cookies    map[string]string `json:"cookies"`
+	Query      map[string]string `json:"query"`
+	Method     string            `json:"method"`
+	ServerName string            `json:"server_name"` // nginx 选中的 server 块的 server_name
+	Host       string            `json:"host"`        // 请求的主机名
 }
 
 // RouteResponse 路由响应结构
 type RouteResponse struct {
-	Target string `json:"target"`
-	Match  bool   `json:"match"`
+	Target     string `json:"target"`
+	Match      bool   `json:"match"`
+	SetCookie  string `json:"set_cookie,omitempty"`  // 需要下发给客户端的会话保持 Cookie
+	URI        string `json:"uri,omitempty"`         // 重写后的 URI，为空时保持原始 URI
+	StaleScope string `json:"stale_scope,omitempty"` // 路由服务不可用时 OpenResty 复用该结果的范围，为空时不可复用
+	Error      string `json:"error,omitempty"`       // 未能生成路由结果的原因
 }
 
 // Route 统一路由接口（供 OpenResty 调用）
@@ -117,150 +194,277 @@ func (h *Handler) Route(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Path is required"})
 		return
 	}
-	log.Printf("Route request: path=%s, remote_addr=%s, server_name=%s, headers=%v",
-		req.Path, req.RemoteAddr, req.ServerName, req.Headers)
-	// 从缓存或数据库查询匹配的规则
-	var rule db.Rule
-	cacheKey := fmt.Sprintf("rule:%s", req.ServerName)
-	// 先尝试从缓存获取
-	if cached, found := h.cache.Get(cacheKey); found {
-		rule = cached.(db.Rule)
-		log.Printf("Cache hit for server_name: %s", req.ServerName)
-	} else {
-		// 缓存未命中，从数据库查询
-		result := h.db.Where("server_name = ?", req.ServerName).First(&rule)
-		if result.Error != nil {
-			log.Printf("No rule found for server_name: %s", req.ServerName)
-			c.JSON(http.StatusOK, RouteResponse{Target: "", Match: false})
-			return
-		}
-		// 存入缓存
-		h.cache.Set(cacheKey, rule, cache.DefaultExpiration)
-		log.Printf("Cache miss, loaded from DB for server_name: %s", req.ServerName)
-	}
-	// 解析 locations 配置
-	locations, err := rule.GetLocations()
+	resp, err := h.route(h.routes.Load(), &req)
 	if err != nil {
 		log.Printf("Error parsing locations: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Configuration error"})
 		return
 	}
-	// 查找匹配的 location 和 upstream
-	for _, location := range locations {
-		if h.matchPath(req.Path, location.Path) {
-			for i, upstream := range location.Upstreams {
-				if h.matchUpstream(req, upstream) {
-					log.Printf("Route matched location=%s, upstream %d: %s",
-						location.Path, i, upstream.Target)
-					c.JSON(http.StatusOK, RouteResponse{
-						Target: upstream.Target,
-						Match:  true,
-					})
-					return
+	c.JSON(http.StatusOK, resp)
+}
+
+// route 使用指定的路由索引计算请求的路由结果，规则配置无法解析时返回错误
+func (h *Handler) route(idx *routeIndex, req *RouteRequest) (RouteResponse, error) {
+	// 从路由索引查找匹配的规则
+	rule, captures := idx.findRule(req.ServerName, req.Host)
+	if rule == nil {
+		log.Printf("No rule found for server_name: %s, host: %s", req.ServerName, req.Host)
+		return RouteResponse{Target: "", Match: false}, nil
+	}
+	if rule.err != nil {
+		return RouteResponse{}, rule.err
+	}
+	// 按 nginx 规则查找匹配的 location，再选择 upstream
+	if index, locationCaptures, ok := rule.findLocation(req.Path); ok {
+		location := &rule.locations[index]
+		// 路由表命中时直接使用表中的目标地址
+		if lookup := location.location.Lookup; lookup != nil {
+			if target, ok := h.lookupTarget(req, lookup); ok {
+				return RouteResponse{Target: target, Match: true}, nil
+			}
+		}
+		if i, cookie, ok := h.selectUpstream(req, location); ok {
+			upstream := location.location.Upstreams[i]
+			target := upstream.Target
+			// 展开 Target 中的占位符，location 的捕获优先于 server_name 的捕获
+			if hasPlaceholders(target) {
+				var err error
+				target, err = expandTarget(target, mergeCaptures(captures, locationCaptures), req.Headers)
+				if err != nil {
+					log.Printf("Route target rejected for location=%s%s, upstream %d: %v",
+						location.location.Modifier, location.location.Path, i, err)
+					return RouteResponse{Target: "", Match: false, Error: err.Error()}, nil
 				}
 			}
+			resp := RouteResponse{
+				Target: target,
+				Match:  true,
+				URI:    rewritePath(req.Path, location.upstreams[i].rewrite),
+			}
+			resp.StaleScope = staleScope(upstream, locationCaptures, resp.URI)
+			if cookie != nil {
+				resp.SetCookie = cookie.String()
+			}
+			return resp, nil
 		}
 	}
 	// 如果没有匹配，返回空（使用默认）
 	log.Printf("No route matched for path=%s, server_name=%s", req.Path, req.ServerName)
-	c.JSON(http.StatusOK, RouteResponse{Target: "", Match: false})
+	return RouteResponse{Target: "", Match: false}, nil
+}
+
+// mergeCaptures 合并多组命名捕获，后面的优先
+func mergeCaptures(groups ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for _, group := range groups {
+		for name, value := range group {
+			merged[name] = value
+		}
+	}
+	return merged
 }
 
-// matchPath 检查路径是否匹配
-func (h *Handler) matchPath(requestPath, locationPath string) bool {
-	// 简单的路径匹配，可以扩展为更复杂的匹配规则
-	if locationPath == "/" {
-		return true // 根路径匹配所有
+// validateLocations 验证 location 配置
+func (h *Handler) validateLocations(serverName string, locations []db.Location) error {
+	if err := validateLocationPaths(locations); err != nil {
+		return err
+	}
+	for _, location := range locations {
+		if err := validateLocationType(location); err != nil {
+			return fmt.Errorf("location '%s': %w", location.Path, err)
+		}
+		if err := h.validateAccessList(location); err != nil {
+			return fmt.Errorf("location '%s': %w", location.Path, err)
+		}
+		if err := h.validateBasicAuth(location); err != nil {
+			return fmt.Errorf("location '%s': %w", location.Path, err)
+		}
+		if !location.IsProxy() {
+			continue
+		}
+		if err := validateUpstreamWeights(location); err != nil {
+			return err
+		}
+		if err := validateSticky(location.Sticky); err != nil {
+			return fmt.Errorf("location '%s': %w", location.Path, err)
+		}
+		if err := h.validateLookup(location.Lookup); err != nil {
+			return fmt.Errorf("location '%s': %w", location.Path, err)
+		}
+		if err := validateMirror(location.Mirror); err != nil {
+			return fmt.Errorf("location '%s': %w", location.Path, err)
+		}
+		for i, upstream := range location.Upstreams {
+			if upstream.Pool != nil {
+				if err := validatePool(upstream); err != nil {
+					return fmt.Errorf("location '%s' upstream %d: %w", location.Path, i, err)
+				}
+			} else if err := validateTarget(upstream.Target, serverName, location); err != nil {
+				return fmt.Errorf("location '%s' upstream %d: %w", location.Path, i, err)
+			}
+			if name, ok := db.IPSetRef(upstream.ConditionIP); ok {
+				if err := h.validateIPSetRef(name); err != nil {
+					return fmt.Errorf("location '%s' upstream %d condition_ip: %w", location.Path, i, err)
+				}
+			}
+			if err := validateConditions(upstream.Headers); err != nil {
+				return fmt.Errorf("location '%s' upstream %d headers: %w", location.Path, i, err)
+			}
+			if err := validateConditions(upstream.Cookies); err != nil {
+				return fmt.Errorf("location '%s' upstream %d cookies: %w", location.Path, i, err)
+			}
+			if err := validateConditions(upstream.Query); err != nil {
+				return fmt.Errorf("location '%s' upstream %d query: %w", location.Path, i, err)
+			}
+			if err := validateMethods(upstream.Methods); err != nil {
+				return fmt.Errorf("location '%s' upstream %d methods: %w", location.Path, i, err)
+			}
+			if err := validateRewrite(location, upstream.Rewrite); err != nil {
+				return fmt.Errorf("location '%s' upstream %d: %w", location.Path, i, err)
+			}
+		}
 	}
-	return strings.HasPrefix(requestPath, locationPath)
+	return nil
 }
 
-// matchUpstream 检查上游服务器是否匹配
-func (h *Handler) matchUpstream(req RouteRequest, upstream db.Upstream) bool {
-	// 检查 IP 条件
-	if upstream.ConditionIP != "" && !h.matchIP(req.RemoteAddr, upstream.ConditionIP) {
-		log.Printf("IP condition not matched: %s not in %s", req.RemoteAddr, upstream.ConditionIP)
-		return false
+// validateMethods 验证请求方法条件
+func validateMethods(methods []string) error {
+	for _, method := range methods {
+		if !slices.Contains(httpMethods, strings.ToUpper(method)) {
+			return fmt.Errorf("unsupported method '%s'", method)
+		}
 	}
-	// 检查头部条件（且关系）
-	if len(upstream.Headers) > 0 && !h.matchHeaders(req.Headers, upstream.Headers) {
-		log.Printf("Header conditions not matched: expected=%v, actual=%v", upstream.Headers, req.Headers)
-		return false
+	return nil
+}
+
+// httpMethods 支持作为路由条件的请求方法
+var httpMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+}
+
+// validateConditions 验证匹配条件的名称、操作符和值
+func validateConditions(conditions db.MatchConditions) error {
+	for _, condition := range conditions {
+		if condition.Name == "" {
+			return fmt.Errorf("condition name is required")
+		}
+		switch condition.Operator {
+		case db.MatchOperatorExists, db.MatchOperatorNotExists:
+		case "", db.MatchOperatorEquals, db.MatchOperatorNotEquals,
+			db.MatchOperatorPrefix, db.MatchOperatorNotPrefix:
+		case db.MatchOperatorRegex, db.MatchOperatorNotRegex:
+			if _, err := regexp.Compile(condition.Value); err != nil {
+				return fmt.Errorf("condition '%s': invalid regex: %w", condition.Name, err)
+			}
+		default:
+			return fmt.Errorf("condition '%s': unsupported operator '%s'", condition.Name, condition.Operator)
+		}
 	}
-	return true
+	return nil
 }
 
-// matchIP 检查 IP 是否匹配
-func (h *Handler) matchIP(remoteAddr, conditionIP string) bool {
-	// 空条件或默认路由，匹配所有
-	if conditionIP == "" || conditionIP == "0.0.0.0/0" {
-		return true
-	}
-	// 解析客户端 IP
-	clientIP := net.ParseIP(remoteAddr)
-	if clientIP == nil {
-		log.Printf("Warning: Invalid client IP: %s", remoteAddr)
-		return false
-	}
-	// 检查是否为 CIDR 格式
-	if strings.Contains(conditionIP, "/") {
-		_, ipNet, err := net.ParseCIDR(conditionIP)
-		if err != nil {
-			log.Printf("Warning: Invalid CIDR format: %s", conditionIP)
-			return false
+// validateLocationPaths 验证 location 修饰符和路径，规则与 nginx 保持一致
+func validateLocationPaths(locations []db.Location) error {
+	exact := make(map[string]bool)
+	prefix := make(map[string]bool)
+	for _, location := range locations {
+		if location.Path == "" {
+			return fmt.Errorf("location path is required")
+		}
+		if strings.ContainsAny(location.Path, " \t\r\n;{}") && !location.IsRegex() {
+			return fmt.Errorf("location '%s': path must not contain whitespace, ';' or braces", location.Path)
+		}
+		switch location.Modifier {
+		case db.LocationModifierExact:
+			if exact[location.Path] {
+				return fmt.Errorf("duplicate location '= %s'", location.Path)
+			}
+			exact[location.Path] = true
+		case db.LocationModifierPrefix, db.LocationModifierPrefixPriority:
+			// nginx 不允许同一路径同时声明为普通前缀和 ^~
+			if prefix[location.Path] {
+				return fmt.Errorf("duplicate location '%s'", location.Path)
+			}
+			prefix[location.Path] = true
+		case db.LocationModifierRegex, db.LocationModifierRegexCaseless:
+			if strings.ContainsAny(location.Path, "\r\n") {
+				return fmt.Errorf("location '%s': regex must not contain line breaks", location.Path)
+			}
+			if _, err := location.CompileRegex(); err != nil {
+				return fmt.Errorf("location '%s %s': invalid regex: %w", location.Modifier, location.Path, err)
+			}
+		default:
+			return fmt.Errorf("location '%s': unsupported modifier '%s'", location.Path, location.Modifier)
 		}
-		return ipNet.Contains(clientIP)
 	}
-	// 单个 IP 匹配
-	targetIP := net.ParseIP(conditionIP)
-	if targetIP == nil {
-		log.Printf("Warning: Invalid target IP: %s", conditionIP)
-		return false
+	return nil
+}
+
+// validateUpstreamWeights 验证上游权重配置
+func validateUpstreamWeights(location db.Location) error {
+	for i, upstream := range location.Upstreams {
+		if upstream.Weight < 0 {
+			return fmt.Errorf("location '%s' upstream %d: weight must not be negative", location.Path, i)
+		}
+		if upstream.Weight > db.MaxUpstreamWeight {
+			return fmt.Errorf("location '%s' upstream %d: weight must not exceed %d", location.Path, i, db.MaxUpstreamWeight)
+		}
 	}
-	return clientIP.Equal(targetIP)
+	return nil
 }
 
-// matchHeaders 检查头部是否匹配（且关系）
-func (h *Handler) matchHeaders(requestHeaders, expectedHeaders map[string]string) bool {
-	// 如果没有期望的头部条件，直接匹配
-	if len(expectedHeaders) == 0 {
-		return true
-	}
-	// 创建大小写不敏感的请求头部映射
-	normalizedRequestHeaders := make(map[string]string)
-	for key, value := range requestHeaders {
-		normalizedRequestHeaders[strings.ToLower(key)] = value
-	}
-	// 检查所有期望的头部条件是否都匹配
-	for expectedKey, expectedValue := range expectedHeaders {
-		normalizedKey := strings.ToLower(expectedKey)
-		actualValue, exists := normalizedRequestHeaders[normalizedKey]
-		if !exists {
-			log.Printf("Header not found: %s", expectedKey)
-			return false
-		}
-		if actualValue != expectedValue {
-			log.Printf("Header value mismatch: %s expected=%s actual=%s",
-				expectedKey, expectedValue, actualValue)
-			return false
-		}
-		log.Printf("Header matched: %s=%s", expectedKey, expectedValue)
-	}
-	return true
+// validateConditionGroupWeights 验证条件组内的权重配置：权重只在条件相同的上游之间生效，
+// 组内只有一个上游时设置权重没有意义；组内部分上游设置权重时，权重为 0 的上游不会得到流量，
+// 因此要求组内的上游要么都设置权重，要么都不设置
+// 灰度发布完成时组内其他上游的权重为 0，previous 中未修改的 location 不再验证
+func validateConditionGroupWeights(locations []db.Location, previous []db.Location) error {
+	for i, location := range locations {
+		if !location.IsProxy() || (i < len(previous) && sameRolloutLocation(previous[i], location)) {
+			continue
+		}
+		groups := db.ConditionGroups(location.Upstreams)
+		members := make(map[int]int, len(groups))
+		weighted := make(map[int]int, len(groups))
+		for j, group := range groups {
+			members[group]++
+			if location.Upstreams[j].Weight > 0 {
+				weighted[group]++
+			}
+		}
+		for j, group := range groups {
+			if weighted[group] == 0 {
+				continue
+			}
+			if members[group] == 1 {
+				return fmt.Errorf("location '%s' upstream %d: weight has no effect, no other upstream has the same conditions", location.Path, j)
+			}
+			if location.Upstreams[j].Weight == 0 {
+				return fmt.Errorf("location '%s' upstream %d: weight is required, other upstreams with the same conditions have weights", location.Path, j)
+			}
+		}
+	}
+	return nil
 }
 
 // validateUniqueServerName 验证域名的唯一性（一个域名只能创建一条记录）
+// 名称不区分大小写，.example.com 与 example.com、*.example.com 视为冲突
 func (h *Handler) validateUniqueServerName(serverName string, excludeID string) error {
-	var count int64
-	query := h.db.Model(&db.Rule{}).Where("server_name = ?", serverName)
+	var rules []db.Rule
+	query := h.db.Select("id", "server_name")
 	if excludeID != "" {
 		query = query.Where("id != ?", excludeID)
 	}
-	if err := query.Count(&count).Error; err != nil {
+	if err := query.Find(&rules).Error; err != nil {
 		return fmt.Errorf("failed to check existing rules: %w", err)
 	}
-	if count > 0 {
-		return fmt.Errorf("server_name '%s' already exists, one domain can only have one record", serverName)
+	aliases := serverNameAliases(serverName)
+	for _, rule := range rules {
+		for _, existing := range serverNameAliases(rule.ServerName) {
+			if slices.Contains(aliases, existing) {
+				return fmt.Errorf("server_name '%s' conflicts with existing '%s', one domain can only have one record", serverName, rule.ServerName)
+			}
+		}
 	}
 	return nil
 }
@@ -316,17 +520,46 @@ func (h *Handler) CreateRule(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// 验证 server_name 和 location 配置
+	if err := validateServerName(req.ServerName); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.validateLocations(req.ServerName, req.Locations); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateConditionGroupWeights(req.Locations, nil); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateFailMode(req.FailMode, req.StaleTTL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateTestCases(req.TestCases); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	// 验证域名唯一性
 	if err := h.validateUniqueServerName(req.ServerName, ""); err != nil {
 		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 		return
 	}
+	// 验证服务器池名称唯一性
+	if err := h.validatePoolNames("", req.Locations); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
 	// 创建新规则
 	rule := db.Rule{
 		ID:         uuid.New().String(),
 		ServerName: req.ServerName,
 		SSLCert:    req.SSLCert,
 		SSLKey:     req.SSLKey,
+		ForceHTTPS: req.ForceHTTPS,
+		FailMode:   req.FailMode,
+		StaleTTL:   req.StaleTTL,
 	}
 	// 设置端口和位置
 	if err := rule.SetListenPorts(req.ListenPorts); err != nil {
@@ -337,6 +570,15 @@ func (h *Handler) CreateRule(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set locations"})
 		return
 	}
+	if err := rule.SetTestCases(req.TestCases); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set test cases"})
+		return
+	}
+	// 执行路由测试用例
+	if failures := h.runTestCases(compileRule(rule, h.ipSets.All()), req.TestCases); len(failures) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Routing test cases failed", "failures": failures})
+		return
+	}
 	// 生成配置文件
 	if err := h.generator.GenerateConfig(&rule); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate config: " + err.Error()})
@@ -360,8 +602,8 @@ func (h *Handler) CreateRule(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	// 清除缓存
-	h.clearRuleCache(rule.ServerName)
+	// 重建路由索引并使路由快照失效
+	h.reloadRoutes()
 	// 重新加载 Nginx
 	if err := h.nginxManager.Reload(); err != nil {
 		log.Printf("Warning: Failed to reload nginx: %v", err)
@@ -398,17 +640,55 @@ func (h *Handler) UpdateRule(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// 验证 server_name 和 location 配置
+	if err := validateServerName(req.ServerName); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.validateLocations(req.ServerName, req.Locations); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateFailMode(req.FailMode, req.StaleTTL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateTestCases(req.TestCases); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	// 验证域名和端口组合的唯一性（排除当前规则）
 	if err := h.validateUniqueServerName(req.ServerName, id); err != nil {
 		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 		return
 	}
-	// 保存旧的 server_name 用于清除缓存
-	oldServerName := rule.ServerName
+	// 验证服务器池名称唯一性
+	if err := h.validatePoolNames(id, req.Locations); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	// 灰度发布期间不能修改对应 location 的上游
+	if err := h.validateRolloutLocations(&rule, req.Locations); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	// 验证条件组的权重，未修改的 location 不再验证
+	current, err := rule.GetLocations()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse locations"})
+		return
+	}
+	if err := validateConditionGroupWeights(req.Locations, current); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	// 更新规则字段
 	rule.ServerName = req.ServerName
 	rule.SSLCert = req.SSLCert
 	rule.SSLKey = req.SSLKey
+	rule.ForceHTTPS = req.ForceHTTPS
+	rule.FailMode = req.FailMode
+	rule.StaleTTL = req.StaleTTL
 
 	if err := rule.SetListenPorts(req.ListenPorts); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set listen ports"})
@@ -418,38 +698,126 @@ func (h *Handler) UpdateRule(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set locations"})
 		return
 	}
-	// 重新生成配置文件
-	if err := h.generator.GenerateConfig(&rule); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate config: " + err.Error()})
+	testCases := req.TestCases
+	if testCases == nil {
+		var err error
+		if testCases, err = rule.GetTestCases(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse test cases"})
+			return
+		}
+	} else if err := rule.SetTestCases(testCases); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set test cases"})
 		return
 	}
-	// 测试 Nginx 配置
-	if err := h.nginxManager.TestConfig(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Nginx config test failed: " + err.Error()})
+	if err := h.applyRuleUpdate(&rule, testCases); err != nil {
+		var updateErr *ruleUpdateError
+		if !errors.As(err, &updateErr) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(updateErr.failures) > 0 {
+			c.JSON(updateErr.status, gin.H{"error": updateErr.message, "failures": updateErr.failures})
+			return
+		}
+		c.JSON(updateErr.status, gin.H{"error": updateErr.message})
 		return
 	}
-	// 更新数据库
-	if err := h.db.Save(&rule).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	resp, err := rule.ToResponse()
+	if err != nil {
+		log.Printf("Warning: Failed to convert rule to response: %v", err)
+		// 仍然返回成功，因为规则已经更新成功
+		c.JSON(http.StatusOK, gin.H{"message": "Rule updated successfully", "id": rule.ID})
 		return
 	}
-	// 清除缓存（清除新旧两个 server_name 的缓存）
-	h.clearRuleCache(oldServerName)
-	if oldServerName != rule.ServerName {
-		h.clearRuleCache(rule.ServerName)
+	c.JSON(http.StatusOK, resp)
+}
+
+// ruleUpdateError 规则更新失败的原因及对应的 HTTP 状态码
+type ruleUpdateError struct {
+	status   int
+	message  string
+	failures []RouteTestFailure
+}
+
+func (e *ruleUpdateError) Error() string {
+	return e.message
+}
+
+// applyRuleUpdate 使规则的修改生效：执行路由测试用例、生成并测试 Nginx 配置、更新数据库、
+// 重建路由索引并重新加载 Nginx，规则更新接口和灰度发布控制器共用此流程
+func (h *Handler) applyRuleUpdate(rule *db.Rule, testCases []db.RouteTestCase) error {
+	// 使用新的 locations 执行路由测试用例
+	if failures := h.runTestCases(compileRule(*rule, h.ipSets.All()), testCases); len(failures) > 0 {
+		return &ruleUpdateError{status: http.StatusBadRequest, message: "Routing test cases failed", failures: failures}
+	}
+	// 备份当前配置文件，新配置未通过测试或未能保存时恢复，避免错误的配置留在磁盘上被之后的重新加载使用
+	backup, err := h.generator.BackupConfig(rule.ID)
+	if err != nil {
+		return err
+	}
+	restore := func() {
+		if err := backup.Restore(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
 	}
+	// 重新生成配置文件
+	if err := h.generator.GenerateConfig(rule); err != nil {
+		restore()
+		return &ruleUpdateError{status: http.StatusInternalServerError, message: "Failed to generate config: " + err.Error()}
+	}
+	// 测试 Nginx 配置
+	if err := h.nginxManager.TestConfig(); err != nil {
+		restore()
+		return &ruleUpdateError{status: http.StatusBadRequest, message: "Nginx config test failed: " + err.Error()}
+	}
+	// 更新数据库
+	if err := h.db.Save(rule).Error; err != nil {
+		restore()
+		return err
+	}
+	// 重建路由索引并使路由快照失效
+	h.reloadRoutes()
 	// 重新加载 Nginx
 	if err := h.nginxManager.Reload(); err != nil {
 		log.Printf("Warning: Failed to reload nginx: %v", err)
 	}
-	resp, err := rule.ToResponse()
+	return nil
+}
+
+// UpdateRuleLocations 修改规则的 locations 并按规则更新的流程生效（供灰度发布控制器调整权重）
+func (h *Handler) UpdateRuleLocations(ruleID string, mutate func(locations []db.Location) error) error {
+	var rule db.Rule
+	if err := h.db.First(&rule, "id = ?", ruleID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("rule not found")
+		}
+		return err
+	}
+	locations, err := rule.GetLocations()
 	if err != nil {
-		log.Printf("Warning: Failed to convert rule to response: %v", err)
-		// 仍然返回成功，因为规则已经更新成功
-		c.JSON(http.StatusOK, gin.H{"message": "Rule updated successfully", "id": rule.ID})
-		return
+		return err
 	}
-	c.JSON(http.StatusOK, resp)
+	if err := mutate(locations); err != nil {
+		return err
+	}
+	if err := h.validateLocations(rule.ServerName, locations); err != nil {
+		return err
+	}
+	if err := rule.SetLocations(locations); err != nil {
+		return err
+	}
+	testCases, err := rule.GetTestCases()
+	if err != nil {
+		return err
+	}
+	if err := h.applyRuleUpdate(&rule, testCases); err != nil {
+		var updateErr *ruleUpdateError
+		if errors.As(err, &updateErr) && len(updateErr.failures) > 0 {
+			return fmt.Errorf("%s: %d case(s), first: %s", updateErr.message, len(updateErr.failures), updateErr.failures[0].Reason)
+		}
+		return err
+	}
+	return nil
 }
 
 // DeleteRule 删除规则
@@ -464,6 +832,19 @@ func (h *Handler) DeleteRule(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	// 灰度发布进行中时不能删除规则，否则发布无法再恢复权重
+	if h.rollouts != nil {
+		rollouts, err := h.rollouts.Active(rule.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(rollouts) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("location '%s' has an active rollout %s, finish or abort it before deleting the rule",
+				rollouts[0].LocationPath, rollouts[0].ID)})
+			return
+		}
+	}
 	// 删除配置文件
 	if err := h.generator.DeleteConfig(rule.ID); err != nil {
 		log.Printf("Warning: Failed to delete config file: %v", err)
@@ -474,6 +855,8 @@ func (h *Handler) DeleteRule(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	// 重建路由索引并使路由快照失效
+	h.reloadRoutes()
 	// 重新加载 Nginx
 	if err := h.nginxManager.Reload(); err != nil {
 		log.Printf("Warning: Failed to reload nginx: %v", err)
@@ -516,7 +899,7 @@ func (h *Handler) RegenerateAllConfigs() error {
 	}
 
 	if len(errorMessages) != 0 {
-		return fmt.Errorf(errorMessages)
+		return errors.New(errorMessages)
 	}
 	return nil
 }
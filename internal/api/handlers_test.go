@@ -0,0 +1,63 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"nginx-proxy/internal/db"
+)
+
+func TestValidateConditionGroupWeights(t *testing.T) {
+	beta := db.MatchConditions{{Name: "X-Beta", Value: "1"}, {Name: "X-Env", Value: "prod"}}
+	// 条件与 beta 相同，只是顺序和名称大小写不同
+	betaReordered := db.MatchConditions{{Name: "x-env", Operator: db.MatchOperatorEquals, Value: "prod"}, {Name: "x-beta", Value: "1"}}
+	tests := []struct {
+		name      string
+		upstreams []db.Upstream
+		err       string // 为空时表示验证通过
+	}{
+		{"no weights", []db.Upstream{
+			{Target: "http://a:80"},
+			{Target: "http://b:80"},
+		}, ""},
+		{"weighted group", []db.Upstream{
+			{Target: "http://a:80", Weight: 3},
+			{Target: "http://b:80", Weight: 1},
+		}, ""},
+		{"weighted group with reordered conditions", []db.Upstream{
+			{Target: "http://beta:80", Headers: beta, Weight: 1},
+			{Target: "http://beta2:80", Headers: betaReordered, Weight: 1},
+			{Target: "http://a:80"},
+		}, ""},
+		{"weight on the only member of a group", []db.Upstream{
+			{Target: "http://beta:80", Headers: beta},
+			{Target: "http://a:80", Weight: 1},
+		}, "location '/' upstream 1: weight has no effect"},
+		{"weighted and zero-weight upstreams in one group", []db.Upstream{
+			{Target: "http://beta:80", Headers: beta},
+			{Target: "http://a:80", Weight: 1},
+			{Target: "http://b:80"},
+		}, "location '/' upstream 2: weight is required"},
+		{"zero weight before weighted upstream", []db.Upstream{
+			{Target: "http://a:80"},
+			{Target: "http://b:80", Weight: 1},
+		}, "location '/' upstream 0: weight is required"},
+	}
+	for _, tt := range tests {
+		locations := []db.Location{{Path: "/", Upstreams: tt.upstreams}}
+		err := validateConditionGroupWeights(locations, nil)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+		}
+		// 未修改的 location（如灰度发布完成后的权重）不再验证
+		if err := validateConditionGroupWeights(locations, locations); err != nil {
+			t.Errorf("%s: unchanged location: unexpected error: %v", tt.name, err)
+		}
+	}
+}
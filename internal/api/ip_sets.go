@@ -0,0 +1,361 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"nginx-proxy/internal/core"
+	"nginx-proxy/internal/db"
+)
+
+// ipSetNamePattern IP 集合名称格式
+var ipSetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// maxIPSetCIDRs 单个 IP 集合允许的最大网段数
+const maxIPSetCIDRs = 4096
+
+// IPSetRequest 创建或更新 IP 集合请求
+type IPSetRequest struct {
+	Name        string   `json:"name" binding:"required"`
+	Description string   `json:"description"`
+	CIDRs       []string `json:"cidrs" binding:"required"`
+}
+
+// IPSetResponse IP 集合响应
+type IPSetResponse struct {
+	db.IPSet
+	CIDRs []string `json:"cidrs"`
+	Rules []string `json:"rules"` // 引用了该集合的规则的 server_name
+}
+
+// GetIPSets 获取所有 IP 集合
+func (h *Handler) GetIPSets(c *gin.Context) {
+	var sets []db.IPSet
+	if err := h.db.Order("name").Find(&sets).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	responses := make([]IPSetResponse, 0, len(sets))
+	for _, set := range sets {
+		resp, err := h.ipSetResponse(&set)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		responses = append(responses, *resp)
+	}
+	c.JSON(http.StatusOK, gin.H{"ip_sets": responses})
+}
+
+// GetIPSet 获取单个 IP 集合
+func (h *Handler) GetIPSet(c *gin.Context) {
+	set, ok := h.findIPSet(c)
+	if !ok {
+		return
+	}
+	resp, err := h.ipSetResponse(set)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// CreateIPSet 创建 IP 集合
+func (h *Handler) CreateIPSet(c *gin.Context) {
+	var req IPSetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateIPSetCIDRs(req.CIDRs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.validateIPSetName(req.Name, ""); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	set := db.IPSet{
+		ID:          uuid.New().String(),
+		Name:        req.Name,
+		Description: req.Description,
+	}
+	if err := set.SetCIDRs(req.CIDRs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set cidrs"})
+		return
+	}
+	if err := h.db.Create(&set).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// 新集合还没有被引用，只需更新索引
+	if err := h.ipSets.Reload(); err != nil {
+		log.Printf("Warning: Failed to reload ip sets: %v", err)
+	}
+	c.JSON(http.StatusCreated, IPSetResponse{IPSet: set, CIDRs: req.CIDRs, Rules: []string{}})
+}
+
+// UpdateIPSet 更新 IP 集合，并重新生成引用了该集合的规则的配置
+// 与规则更新的流程一致：先用新的网段执行引用规则的路由测试用例、生成并测试 Nginx 配置，
+// 全部通过后才保存到数据库并生效，配置测试失败时恢复原有的配置文件
+func (h *Handler) UpdateIPSet(c *gin.Context) {
+	set, ok := h.findIPSet(c)
+	if !ok {
+		return
+	}
+	var req IPSetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateIPSetCIDRs(req.CIDRs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rules, err := h.rulesReferencingIPSet(set.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name != set.Name {
+		if err := h.validateIPSetName(req.Name, set.ID); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		// 被规则引用的集合不允许改名，否则引用会失效
+		if len(rules) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("IP set is being used by rules: %v", ruleServerNames(rules))})
+			return
+		}
+	}
+	set.Name = req.Name
+	set.Description = req.Description
+	if err := set.SetCIDRs(req.CIDRs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set cidrs"})
+		return
+	}
+	if err := h.applyIPSetUpdate(set, req.CIDRs, rules); err != nil {
+		var updateErr *ruleUpdateError
+		if !errors.As(err, &updateErr) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(updateErr.failures) > 0 {
+			c.JSON(updateErr.status, gin.H{"error": updateErr.message, "failures": updateErr.failures})
+			return
+		}
+		c.JSON(updateErr.status, gin.H{"error": updateErr.message})
+		return
+	}
+	c.JSON(http.StatusOK, IPSetResponse{IPSet: *set, CIDRs: req.CIDRs, Rules: ruleServerNames(rules)})
+}
+
+// DeleteIPSet 删除 IP 集合，被规则引用时不允许删除
+func (h *Handler) DeleteIPSet(c *gin.Context) {
+	set, ok := h.findIPSet(c)
+	if !ok {
+		return
+	}
+	rules, err := h.rulesReferencingIPSet(set.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(rules) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("IP set is being used by rules: %v", ruleServerNames(rules))})
+		return
+	}
+	if err := h.db.Delete(set).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.ipSets.Reload(); err != nil {
+		log.Printf("Warning: Failed to reload ip sets: %v", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "IP set deleted successfully"})
+}
+
+// findIPSet 按路径参数 id 查找 IP 集合，找不到时直接写入错误响应
+func (h *Handler) findIPSet(c *gin.Context) (*db.IPSet, bool) {
+	var set db.IPSet
+	if err := h.db.First(&set, "id = ?", c.Param("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "IP set not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return &set, true
+}
+
+// ipSetResponse 组装 IP 集合响应
+func (h *Handler) ipSetResponse(set *db.IPSet) (*IPSetResponse, error) {
+	cidrs, err := set.GetCIDRs()
+	if err != nil {
+		return nil, err
+	}
+	rules, err := h.rulesReferencingIPSet(set.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &IPSetResponse{IPSet: *set, CIDRs: cidrs, Rules: ruleServerNames(rules)}, nil
+}
+
+// applyIPSetUpdate 使 IP 集合的修改生效：用新的网段执行引用规则的路由测试用例、生成并测试 Nginx 配置、
+// 更新数据库、重新加载 IP 集合索引和路由索引并重新加载 Nginx
+// rules 为引用了该集合的规则，改名时集合不会被引用
+func (h *Handler) applyIPSetUpdate(set *db.IPSet, cidrs []string, rules []db.Rule) error {
+	sets := make(db.IPSets, len(h.ipSets.All())+1)
+	for name, existing := range h.ipSets.All() {
+		sets[name] = existing
+	}
+	sets[set.Name] = cidrs
+	// 使用新的网段执行引用规则的路由测试用例
+	for _, rule := range rules {
+		testCases, err := rule.GetTestCases()
+		if err != nil {
+			return err
+		}
+		if failures := h.runTestCases(compileRule(rule, sets), testCases); len(failures) > 0 {
+			return &ruleUpdateError{
+				status:   http.StatusBadRequest,
+				message:  fmt.Sprintf("Routing test cases failed for %s", rule.ServerName),
+				failures: failures,
+			}
+		}
+	}
+	// 重新生成配置文件，失败时恢复已经改写的文件
+	backups := make([]*core.ConfigBackup, 0, len(rules))
+	restore := func() {
+		for _, backup := range backups {
+			if err := backup.Restore(); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+	}
+	for _, rule := range rules {
+		backup, err := h.generator.BackupConfig(rule.ID)
+		if err != nil {
+			restore()
+			return err
+		}
+		backups = append(backups, backup)
+		if err := h.generator.GenerateConfigWithIPSets(&rule, sets); err != nil {
+			restore()
+			return &ruleUpdateError{status: http.StatusInternalServerError, message: fmt.Sprintf("Failed to generate config for %s: %v", rule.ServerName, err)}
+		}
+	}
+	if len(rules) > 0 {
+		if err := h.nginxManager.TestConfig(); err != nil {
+			restore()
+			return &ruleUpdateError{status: http.StatusBadRequest, message: "Nginx config test failed: " + err.Error()}
+		}
+	}
+	// 更新数据库
+	if err := h.db.Save(set).Error; err != nil {
+		restore()
+		return err
+	}
+	if err := h.ipSets.Reload(); err != nil {
+		log.Printf("Warning: Failed to reload ip sets: %v", err)
+	}
+	// 重建路由索引并使路由快照失效
+	h.reloadRoutes()
+	if len(rules) == 0 {
+		return nil
+	}
+	if err := h.nginxManager.Reload(); err != nil {
+		log.Printf("Warning: Failed to reload nginx: %v", err)
+	}
+	return nil
+}
+
+// validateIPSetName 验证 IP 集合名称格式和唯一性
+func (h *Handler) validateIPSetName(name, excludeID string) error {
+	if !ipSetNamePattern.MatchString(name) {
+		return fmt.Errorf("ip set name may only contain letters, digits, '_' and '-'")
+	}
+	var count int64
+	query := h.db.Model(&db.IPSet{}).Where("name = ?", name)
+	if excludeID != "" {
+		query = query.Where("id != ?", excludeID)
+	}
+	if err := query.Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to check existing ip sets: %w", err)
+	}
+	if count > 0 {
+		return fmt.Errorf("ip set '%s' already exists", name)
+	}
+	return nil
+}
+
+// validateIPSetCIDRs 验证 IP 集合的网段，集合不能为空，否则引用它的 allow 会拒绝所有地址
+func validateIPSetCIDRs(cidrs []string) error {
+	if len(cidrs) == 0 {
+		return fmt.Errorf("at least one cidr is required")
+	}
+	if len(cidrs) > maxIPSetCIDRs {
+		return fmt.Errorf("at most %d cidrs are allowed", maxIPSetCIDRs)
+	}
+	seen := make(map[string]bool, len(cidrs))
+	for _, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR '%s'", cidr)
+		}
+		if seen[cidr] {
+			return fmt.Errorf("duplicate CIDR '%s'", cidr)
+		}
+		seen[cidr] = true
+	}
+	return nil
+}
+
+// validateIPSetRef 验证引用的 IP 集合存在
+func (h *Handler) validateIPSetRef(name string) error {
+	var count int64
+	if err := h.db.Model(&db.IPSet{}).Where("name = ?", name).Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to check ip set: %w", err)
+	}
+	if count == 0 {
+		return fmt.Errorf("ip set '%s' does not exist", name)
+	}
+	return nil
+}
+
+// rulesReferencingIPSet 返回引用了指定 IP 集合的规则
+func (h *Handler) rulesReferencingIPSet(name string) ([]db.Rule, error) {
+	var rules []db.Rule
+	if err := h.db.Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	var referencing []db.Rule
+	for _, rule := range rules {
+		locations, err := rule.GetLocations()
+		if err != nil {
+			continue
+		}
+		if db.ReferencesIPSet(locations, name) {
+			referencing = append(referencing, rule)
+		}
+	}
+	return referencing, nil
+}
+
+// ruleServerNames 返回规则的 server_name 列表
+func ruleServerNames(rules []db.Rule) []string {
+	names := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		names = append(names, rule.ServerName)
+	}
+	return names
+}
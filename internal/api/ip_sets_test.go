@@ -0,0 +1,132 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	_ "modernc.org/sqlite"
+
+	"nginx-proxy/internal/core"
+	"nginx-proxy/internal/db"
+)
+
+// newAPITestHandler 创建使用内存数据库的 Handler，nginx 为配置测试和重新加载使用的可执行文件
+// 返回的 gin.Engine 注册了规则、IP 集合和凭据库的接口
+func newAPITestHandler(t *testing.T, nginx string) (*Handler, *gin.Engine) {
+	t.Helper()
+	database, err := gorm.Open(sqlite.Dialector{DriverName: "sqlite", DSN: ":memory:"},
+		&gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 每个连接是独立的内存数据库
+	sqlDB, err := database.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	if err := database.AutoMigrate(&db.Rule{}, &db.RouteTable{}, &db.RouteTableEntry{}, &db.IPSet{},
+		&db.CredentialStore{}, &db.Credential{}); err != nil {
+		t.Fatal(err)
+	}
+	generator := core.NewGenerator(filepath.Join("..", "..", "template"), t.TempDir(), core.RoutingModeRemote, false, "")
+	h := NewHandler(database, generator, core.NewNginxManager(nginx), t.TempDir(), nil, nil, nil, nil)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	api := r.Group("/api")
+	api.POST("/rules", h.CreateRule)
+	api.PUT("/rules/:id", h.UpdateRule)
+	api.DELETE("/rules/:id", h.DeleteRule)
+	api.POST("/ip-sets", h.CreateIPSet)
+	api.PUT("/ip-sets/:id", h.UpdateIPSet)
+	api.DELETE("/ip-sets/:id", h.DeleteIPSet)
+	api.POST("/credential-stores", h.CreateCredentialStore)
+	api.DELETE("/credential-stores/:id", h.DeleteCredentialStore)
+	api.PUT("/credential-stores/:id/users", h.UpsertCredentials)
+	api.DELETE("/credential-stores/:id/users/:username", h.DeleteCredential)
+	return h, r
+}
+
+// serveJSON 发送 JSON 请求并返回响应
+func serveJSON(r *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestIPSetDependentRules(t *testing.T) {
+	h, r := newAPITestHandler(t, "/bin/true")
+	if w := serveJSON(r, http.MethodPost, "/api/ip-sets", `{"name":"office","cidrs":["10.0.0.0/8"]}`); w.Code != http.StatusCreated {
+		t.Fatalf("create ip set: %d %s", w.Code, w.Body)
+	}
+	var set db.IPSet
+	if err := h.db.First(&set, "name = ?", "office").Error; err != nil {
+		t.Fatal(err)
+	}
+	// 引用不存在的集合
+	w := serveJSON(r, http.MethodPost, "/api/rules", `{"server_name":"b.example.com","listen_ports":[80],
+		"locations":[{"path":"/","allow":["@missing"],"upstreams":[{"target":"http://a:80"}]}]}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "ip set 'missing' does not exist") {
+		t.Fatalf("rule with missing ip set: %d %s", w.Code, w.Body)
+	}
+	// 办公网通过 @office 条件转发到 internal，测试用例依赖集合中的网段
+	w = serveJSON(r, http.MethodPost, "/api/rules", `{"server_name":"a.example.com","listen_ports":[80],
+		"locations":[{"path":"/","upstreams":[
+			{"condition_ip":"@office","target":"http://internal:80"},
+			{"condition_ip":"","target":"http://public:80"}]}],
+		"test_cases":[{"request":{"path":"/","remote_addr":"10.1.2.3"},"expect":{"target":"http://internal:80"}}]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create rule: %d %s", w.Code, w.Body)
+	}
+	var rule db.Rule
+	if err := h.db.First(&rule).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// 新的网段使引用规则的测试用例失败，不保存
+	w = serveJSON(r, http.MethodPut, "/api/ip-sets/"+set.ID, `{"name":"office","cidrs":["192.168.0.0/16"]}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Routing test cases failed for a.example.com") {
+		t.Fatalf("update breaking test cases: %d %s", w.Code, w.Body)
+	}
+	if cidrs := h.ipSets.All()["office"]; len(cidrs) != 1 || cidrs[0] != "10.0.0.0/8" {
+		t.Fatalf("ip set changed to %v", cidrs)
+	}
+	// 被引用的集合不能改名
+	w = serveJSON(r, http.MethodPut, "/api/ip-sets/"+set.ID, `{"name":"office2","cidrs":["10.0.0.0/8"]}`)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "a.example.com") {
+		t.Fatalf("rename referenced ip set: %d %s", w.Code, w.Body)
+	}
+	w = serveJSON(r, http.MethodPut, "/api/ip-sets/"+set.ID, `{"name":"office","cidrs":["10.0.0.0/8","172.16.0.0/12"]}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"rules":["a.example.com"]`) {
+		t.Fatalf("update ip set: %d %s", w.Code, w.Body)
+	}
+	if cidrs := h.ipSets.All()["office"]; len(cidrs) != 2 {
+		t.Fatalf("ip set index not reloaded: %v", cidrs)
+	}
+
+	// 被引用的集合不能删除，删除规则后可以删除
+	w = serveJSON(r, http.MethodDelete, "/api/ip-sets/"+set.ID, "")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "a.example.com") {
+		t.Fatalf("delete referenced ip set: %d %s", w.Code, w.Body)
+	}
+	if w := serveJSON(r, http.MethodDelete, "/api/rules/"+rule.ID, ""); w.Code != http.StatusOK {
+		t.Fatalf("delete rule: %d %s", w.Code, w.Body)
+	}
+	if w := serveJSON(r, http.MethodDelete, "/api/ip-sets/"+set.ID, ""); w.Code != http.StatusOK {
+		t.Fatalf("delete ip set: %d %s", w.Code, w.Body)
+	}
+	if _, ok := h.ipSets.All()["office"]; ok {
+		t.Fatal("deleted ip set still in the index")
+	}
+}
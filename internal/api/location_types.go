@@ -0,0 +1,149 @@
+package api
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"nginx-proxy/internal/db"
+)
+
+// maxReturnBody 固定响应内容的最大长度
+const maxReturnBody = 64 * 1024
+
+// staticRootPattern 静态文件根目录，必须为绝对路径
+var staticRootPattern = regexp.MustCompile(`^/[^\s;{}"'$\\]*$`)
+
+// staticIndexPattern 目录索引文件名
+var staticIndexPattern = regexp.MustCompile(`^[^\s;{}"'$\\/]+$`)
+
+// tryFilesCodePattern try_files 最后一项可以是 =状态码
+var tryFilesCodePattern = regexp.MustCompile(`^=[1-5][0-9]{2}$`)
+
+// tryFilesPathPattern try_files 中的固定路径，不能包含变量和 ".." 路径段
+var tryFilesPathPattern = regexp.MustCompile(`^/[^\s;{}"'$\\]*$`)
+
+// validateLocationType 验证 location 类型及对应的配置
+// 非 proxy 类型的 location 由 nginx 直接处理，不能设置上游相关的配置
+func validateLocationType(location db.Location) error {
+	locationType := location.GetType()
+	switch locationType {
+	case db.LocationTypeProxy, db.LocationTypeRedirect, db.LocationTypeReturn, db.LocationTypeStatic:
+	default:
+		return fmt.Errorf("unsupported location type '%s'", location.Type)
+	}
+	if locationType != db.LocationTypeRedirect && location.Redirect != nil {
+		return fmt.Errorf("redirect is only allowed for type redirect")
+	}
+	if locationType != db.LocationTypeReturn && location.Return != nil {
+		return fmt.Errorf("return is only allowed for type return")
+	}
+	if locationType != db.LocationTypeStatic && location.Static != nil {
+		return fmt.Errorf("static is only allowed for type static")
+	}
+	if locationType == db.LocationTypeProxy {
+		return nil
+	}
+	if len(location.Upstreams) > 0 || location.Sticky != nil || location.Lookup != nil || location.Mirror != nil {
+		return fmt.Errorf("upstreams, sticky, lookup and mirror are only allowed for type proxy")
+	}
+	switch locationType {
+	case db.LocationTypeRedirect:
+		return validateRedirect(location.Redirect)
+	case db.LocationTypeReturn:
+		return validateReturn(location.Return)
+	default:
+		return validateStatic(location.Static)
+	}
+}
+
+// validateRedirect 验证重定向配置
+func validateRedirect(redirect *db.RedirectConfig) error {
+	if redirect == nil {
+		return fmt.Errorf("redirect is required for type redirect")
+	}
+	switch redirect.Code {
+	case 0, 301, 302, 303, 307, 308:
+	default:
+		return fmt.Errorf("redirect code must be 301, 302, 303, 307 or 308")
+	}
+	if redirect.Target == "" {
+		return fmt.Errorf("redirect target is required")
+	}
+	// $ 会被 nginx 当作变量展开
+	if strings.ContainsAny(redirect.Target, " \t\r\n\"'$\\") {
+		return fmt.Errorf("redirect target '%s' must not contain whitespace, quotes, '$' or '\\'", redirect.Target)
+	}
+	if strings.HasPrefix(redirect.Target, "/") && !strings.HasPrefix(redirect.Target, "//") {
+		return nil
+	}
+	u, err := url.Parse(redirect.Target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("redirect target '%s' must be an http(s) URL or a path starting with '/'", redirect.Target)
+	}
+	return nil
+}
+
+// validateReturn 验证固定响应配置
+func validateReturn(ret *db.ReturnConfig) error {
+	if ret == nil {
+		return fmt.Errorf("return is required for type return")
+	}
+	if ret.Status != 0 && (ret.Status < 200 || ret.Status > 599) {
+		return fmt.Errorf("return status must be between 200 and 599")
+	}
+	switch ret.Status {
+	case 301, 302, 303, 307, 308:
+		return fmt.Errorf("return status %d is a redirect, use type redirect", ret.Status)
+	}
+	if len(ret.Body) > maxReturnBody {
+		return fmt.Errorf("return body must not exceed %d bytes", maxReturnBody)
+	}
+	// $ 会被 nginx 当作变量展开
+	if strings.Contains(ret.Body, "$") {
+		return fmt.Errorf("return body must not contain '$'")
+	}
+	if ret.ContentType != "" {
+		if strings.ContainsAny(ret.ContentType, "\r\n") {
+			return fmt.Errorf("invalid return content type '%s'", ret.ContentType)
+		}
+		if _, _, err := mime.ParseMediaType(ret.ContentType); err != nil {
+			return fmt.Errorf("invalid return content type '%s': %w", ret.ContentType, err)
+		}
+	}
+	return nil
+}
+
+// validateStatic 验证静态文件配置
+func validateStatic(static *db.StaticConfig) error {
+	if static == nil {
+		return fmt.Errorf("static is required for type static")
+	}
+	if !staticRootPattern.MatchString(static.Root) {
+		return fmt.Errorf("static root '%s' must be an absolute path without whitespace, quotes, ';', braces or '$'", static.Root)
+	}
+	for _, index := range static.Index {
+		if !staticIndexPattern.MatchString(index) {
+			return fmt.Errorf("invalid static index '%s'", index)
+		}
+	}
+	if len(static.TryFiles) == 1 {
+		return fmt.Errorf("static try_files requires at least two entries")
+	}
+	// 只允许 $uri、$uri/ 和固定路径，其他变量可能引用请求头等客户端可控的值
+	for i, file := range static.TryFiles {
+		if i == len(static.TryFiles)-1 && tryFilesCodePattern.MatchString(file) {
+			continue
+		}
+		if file == "$uri" || file == "$uri/" {
+			continue
+		}
+		if !tryFilesPathPattern.MatchString(file) || slices.Contains(strings.Split(file, "/"), "..") {
+			return fmt.Errorf("static try_files entry '%s' must be $uri, $uri/, an absolute path without variables or '..', or a final =code", file)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"testing"
+
+	"nginx-proxy/internal/db"
+)
+
+func TestValidateStaticTryFiles(t *testing.T) {
+	tests := []struct {
+		files []string
+		ok    bool
+	}{
+		{[]string{"$uri", "$uri/", "/index.html"}, true},
+		{[]string{"$uri", "=404"}, true},
+		{[]string{"$uri", "/app/index.html", "=404"}, true},
+		{[]string{"$uri"}, false},                        // 至少两项
+		{[]string{"$http_x_file", "/index.html"}, false}, // 客户端可控的变量
+		{[]string{"$uri", "$request_uri"}, false},        // 只允许 $uri 和 $uri/
+		{[]string{"/files/$uri", "=404"}, false},         // 固定路径中不能有变量
+		{[]string{"$uri", "/../etc/passwd"}, false},      // 不能跳出根目录
+		{[]string{"=404", "$uri"}, false},                // 状态码只能是最后一项
+		{[]string{"$uri", "index.html"}, false},          // 必须为绝对路径
+		{[]string{"$uri", "/index.html;return"}, false},  // 不能注入指令
+	}
+	for _, tt := range tests {
+		err := validateStatic(&db.StaticConfig{Root: "/srv/www", TryFiles: tt.files})
+		if (err == nil) != tt.ok {
+			t.Errorf("validateStatic(try_files %v) error = %v, want ok %v", tt.files, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+
+	"nginx-proxy/internal/db"
+)
+
+// validateMirror 验证流量镜像配置
+func validateMirror(mirror *db.MirrorConfig) error {
+	if mirror == nil {
+		return nil
+	}
+	if mirror.Target == "" {
+		return fmt.Errorf("mirror target is required")
+	}
+	if hasPlaceholders(mirror.Target) {
+		return fmt.Errorf("mirror target '%s': placeholders are not allowed", mirror.Target)
+	}
+	if err := validateTargetURL(mirror.Target); err != nil {
+		return fmt.Errorf("mirror %w", err)
+	}
+	// 镜像请求总是使用原始 URI，目标只能包含 scheme 和主机
+	if u, _ := url.Parse(mirror.Target); u.Path != "" && u.Path != "/" {
+		return fmt.Errorf("mirror target '%s': path is not allowed", mirror.Target)
+	}
+	if mirror.Percent <= 0 || mirror.Percent > 100 {
+		return fmt.Errorf("mirror percent must be greater than 0 and at most 100")
+	}
+	// nginx split_clients 的百分比最多两位小数
+	if scaled := mirror.Percent * 100; math.Abs(scaled-math.Round(scaled)) > 1e-9 {
+		return fmt.Errorf("mirror percent allows at most two decimal places")
+	}
+	return nil
+}
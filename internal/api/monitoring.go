@@ -5,6 +5,8 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+
+	"nginx-proxy/internal/core"
 )
 
 // HealthCheck 健康检查
@@ -38,3 +40,58 @@ func (h *Handler) HealthCheck(c *gin.Context) {
 		"timestamp": time.Now(),
 	})
 }
+
+// GetUpstreamHealth 获取上游健康检查状态
+func (h *Handler) GetUpstreamHealth(c *gin.Context) {
+	if h.health == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"enabled": false,
+			"targets": []core.TargetHealth{},
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"enabled": true,
+		"targets": h.health.Status(),
+	})
+}
+
+// ReportOutcomesRequest OpenResty 批量上报的代理结果
+type ReportOutcomesRequest struct {
+	Outcomes []core.ProxyOutcome `json:"outcomes"`
+}
+
+// ReportOutcomes 接收 OpenResty 上报的代理结果（供 log 阶段的定时器批量调用），用于熔断和灰度发布的错误率统计
+func (h *Handler) ReportOutcomes(c *gin.Context) {
+	var req ReportOutcomesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if h.breaker == nil && h.rollouts == nil {
+		c.JSON(http.StatusOK, gin.H{"accepted": 0})
+		return
+	}
+	if h.breaker != nil {
+		h.breaker.Report(req.Outcomes)
+	}
+	if h.rollouts != nil {
+		h.rollouts.Observe(req.Outcomes)
+	}
+	c.JSON(http.StatusOK, gin.H{"accepted": len(req.Outcomes)})
+}
+
+// GetCircuits 获取上游熔断状态（只包含出现过失败的上游）
+func (h *Handler) GetCircuits(c *gin.Context) {
+	if h.breaker == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"enabled":  false,
+			"circuits": []core.CircuitState{},
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":  true,
+		"circuits": h.breaker.Status(),
+	})
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+
+	"nginx-proxy/internal/db"
+)
+
+// poolNamePattern 服务器池名称，同时用于 nginx upstream 名称
+var poolNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// poolHostPattern 服务器地址中的主机名
+var poolHostPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?$`)
+
+// maxPoolServers 单个服务器池允许的最大服务器数量
+const maxPoolServers = 256
+
+// maxPoolKeepalive 服务器池允许的最大空闲长连接数
+const maxPoolKeepalive = 1024
+
+// validatePool 验证上游的服务器池配置
+func validatePool(upstream db.Upstream) error {
+	pool := upstream.Pool
+	if upstream.Target != "" {
+		return fmt.Errorf("target must be empty when pool is set")
+	}
+	if !poolNamePattern.MatchString(pool.Name) {
+		return fmt.Errorf("invalid pool name '%s': use lowercase letters, digits, '-' and '_'", pool.Name)
+	}
+	switch pool.Scheme {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("pool '%s': scheme must be http or https", pool.Name)
+	}
+	switch pool.Balance {
+	case "", db.BalanceRoundRobin, db.BalanceLeastConn, db.BalanceRandomTwo, db.BalanceIPHash:
+	default:
+		return fmt.Errorf("pool '%s': unsupported balance '%s'", pool.Name, pool.Balance)
+	}
+	if pool.Keepalive < 0 || pool.Keepalive > maxPoolKeepalive {
+		return fmt.Errorf("pool '%s': keepalive must be between 0 and %d", pool.Name, maxPoolKeepalive)
+	}
+	if len(pool.Servers) == 0 {
+		return fmt.Errorf("pool '%s': at least one server is required", pool.Name)
+	}
+	if len(pool.Servers) > maxPoolServers {
+		return fmt.Errorf("pool '%s': at most %d servers are allowed", pool.Name, maxPoolServers)
+	}
+	seen := make(map[string]bool)
+	for _, server := range pool.Servers {
+		if err := validatePoolAddress(server.Address); err != nil {
+			return fmt.Errorf("pool '%s': %w", pool.Name, err)
+		}
+		if seen[server.Address] {
+			return fmt.Errorf("pool '%s': duplicate server '%s'", pool.Name, server.Address)
+		}
+		seen[server.Address] = true
+		if server.Weight < 0 || server.Weight > db.MaxUpstreamWeight {
+			return fmt.Errorf("pool '%s': server weight must be between 0 and %d", pool.Name, db.MaxUpstreamWeight)
+		}
+	}
+	return nil
+}
+
+// validatePoolAddress 验证服务器地址为 host:port 格式（IPv6 需要方括号）
+func validatePoolAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid server address '%s': must be host:port", address)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid server address '%s': invalid port", address)
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil
+	}
+	if !poolHostPattern.MatchString(host) {
+		return fmt.Errorf("invalid server address '%s': invalid host", address)
+	}
+	return nil
+}
+
+// validatePoolNames 验证服务器池名称在所有规则中唯一（排除 ruleID 对应的规则）
+func (h *Handler) validatePoolNames(ruleID string, locations []db.Location) error {
+	names := make(map[string]bool)
+	for _, location := range locations {
+		for _, upstream := range location.Upstreams {
+			if upstream.Pool == nil {
+				continue
+			}
+			if names[upstream.Pool.Name] {
+				return fmt.Errorf("duplicate pool name '%s'", upstream.Pool.Name)
+			}
+			names[upstream.Pool.Name] = true
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	var rules []db.Rule
+	if err := h.db.Where("id != ?", ruleID).Find(&rules).Error; err != nil {
+		return fmt.Errorf("failed to check pool names: %w", err)
+	}
+	for _, rule := range rules {
+		others, err := rule.GetLocations()
+		if err != nil {
+			continue
+		}
+		for _, location := range others {
+			for _, upstream := range location.Upstreams {
+				if upstream.Pool != nil && names[upstream.Pool.Name] {
+					return fmt.Errorf("pool name '%s' is already used by rule '%s'", upstream.Pool.Name, rule.ServerName)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"nginx-proxy/internal/db"
+)
+
+// compiledRewrite 预编译的路径重写配置
+type compiledRewrite struct {
+	config *db.RewriteConfig
+	prefix string         // strip_prefix/replace_prefix 实际使用的前缀
+	regex  *regexp.Regexp // regex 模式下的正则，配置错误时为空
+}
+
+// compileRewrite 编译上游的路径重写配置，未配置时返回 nil
+func compileRewrite(location db.Location, rewrite *db.RewriteConfig) *compiledRewrite {
+	if rewrite == nil {
+		return nil
+	}
+	compiled := &compiledRewrite{config: rewrite}
+	switch rewrite.Type {
+	case db.RewriteStripPrefix, db.RewriteReplacePrefix:
+		compiled.prefix = rewritePrefix(location, rewrite)
+	case db.RewriteRegex:
+		re, err := regexp.Compile(rewrite.Pattern)
+		if err != nil {
+			log.Printf("Warning: Invalid rewrite regex %s: %v", rewrite.Pattern, err)
+		}
+		compiled.regex = re
+	}
+	return compiled
+}
+
+// rewritePath 按上游的重写配置计算转发给后端的 URI，不需要重写时返回空字符串
+func rewritePath(requestPath string, rewrite *compiledRewrite) string {
+	if rewrite == nil {
+		return ""
+	}
+	var uri string
+	switch rewrite.config.Type {
+	case db.RewriteStripPrefix, db.RewriteReplacePrefix:
+		if !strings.HasPrefix(requestPath, rewrite.prefix) {
+			return ""
+		}
+		uri = requestPath[len(rewrite.prefix):]
+		if rewrite.config.Type == db.RewriteReplacePrefix {
+			uri = rewrite.config.Replacement + uri
+		}
+	case db.RewriteRegex:
+		if rewrite.regex == nil || !rewrite.regex.MatchString(requestPath) {
+			return ""
+		}
+		uri = rewrite.regex.ReplaceAllString(requestPath, rewrite.config.Replacement)
+	default:
+		return ""
+	}
+	if !strings.HasPrefix(uri, "/") {
+		uri = "/" + uri
+	}
+	return uri
+}
+
+// rewritePrefix 返回重写使用的前缀，未指定时使用前缀 location 的路径
+func rewritePrefix(location db.Location, rewrite *db.RewriteConfig) string {
+	if rewrite.Prefix != "" {
+		return rewrite.Prefix
+	}
+	if location.IsRegex() {
+		return ""
+	}
+	return location.Path
+}
+
+// validateRewrite 验证路径重写配置
+func validateRewrite(location db.Location, rewrite *db.RewriteConfig) error {
+	if rewrite == nil {
+		return nil
+	}
+	switch rewrite.Type {
+	case db.RewriteStripPrefix, db.RewriteReplacePrefix:
+		if rewritePrefix(location, rewrite) == "" {
+			return fmt.Errorf("rewrite '%s' requires a prefix for regex locations", rewrite.Type)
+		}
+		if rewrite.Type == db.RewriteReplacePrefix && !strings.HasPrefix(rewrite.Replacement, "/") {
+			return fmt.Errorf("rewrite replacement must start with '/'")
+		}
+	case db.RewriteRegex:
+		if rewrite.Pattern == "" {
+			return fmt.Errorf("rewrite regex requires a pattern")
+		}
+		if _, err := regexp.Compile(rewrite.Pattern); err != nil {
+			return fmt.Errorf("invalid rewrite regex: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported rewrite type '%s'", rewrite.Type)
+	}
+	return nil
+}
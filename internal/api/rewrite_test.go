@@ -0,0 +1,35 @@
+package api
+
+import (
+	"testing"
+
+	"nginx-proxy/internal/db"
+)
+
+func TestRewritePath(t *testing.T) {
+	prefix := db.Location{Path: "/api/"}
+	regex := db.Location{Modifier: db.LocationModifierRegex, Path: `^/v[0-9]+/`}
+	tests := []struct {
+		name     string
+		location db.Location
+		rewrite  *db.RewriteConfig
+		path     string
+		want     string
+	}{
+		{"no rewrite", prefix, nil, "/api/users", ""},
+		{"strip location prefix", prefix, &db.RewriteConfig{Type: db.RewriteStripPrefix}, "/api/users", "/users"},
+		{"strip to root", prefix, &db.RewriteConfig{Type: db.RewriteStripPrefix}, "/api/", "/"},
+		{"strip explicit prefix", regex, &db.RewriteConfig{Type: db.RewriteStripPrefix, Prefix: "/v1"}, "/v1/users", "/users"},
+		{"strip prefix not matched", regex, &db.RewriteConfig{Type: db.RewriteStripPrefix, Prefix: "/v1"}, "/v2/users", ""},
+		{"replace prefix", prefix, &db.RewriteConfig{Type: db.RewriteReplacePrefix, Replacement: "/internal/"}, "/api/users", "/internal/users"},
+		{"regex numbered group", prefix, &db.RewriteConfig{Type: db.RewriteRegex, Pattern: `^/api/(.*)$`, Replacement: "/$1/index"}, "/api/docs", "/docs/index"},
+		{"regex named group", prefix, &db.RewriteConfig{Type: db.RewriteRegex, Pattern: `^/api/(?P<rest>.*)$`, Replacement: "/v2/${rest}"}, "/api/a/b", "/v2/a/b"},
+		{"regex adds leading slash", prefix, &db.RewriteConfig{Type: db.RewriteRegex, Pattern: `^/api/`, Replacement: ""}, "/api/users", "/users"},
+		{"regex not matched", prefix, &db.RewriteConfig{Type: db.RewriteRegex, Pattern: `^/other/`, Replacement: "/"}, "/api/users", ""},
+	}
+	for _, tt := range tests {
+		if got := rewritePath(tt.path, compileRewrite(tt.location, tt.rewrite)); got != tt.want {
+			t.Errorf("%s: rewritePath(%q) = %q, want %q", tt.name, tt.path, got, tt.want)
+		}
+	}
+}
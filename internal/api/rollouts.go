@@ -0,0 +1,131 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"nginx-proxy/internal/core"
+	"nginx-proxy/internal/db"
+)
+
+// GetRollouts 获取灰度发布列表，可按 rule_id 过滤
+func (h *Handler) GetRollouts(c *gin.Context) {
+	rollouts, err := h.rollouts.List(c.Query("rule_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rollouts)
+}
+
+// GetRollout 获取单个灰度发布
+func (h *Handler) GetRollout(c *gin.Context) {
+	rollout, err := h.rollouts.Get(c.Param("id"))
+	if err != nil {
+		respondRolloutError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rollout)
+}
+
+// StartRollout 创建并开始灰度发布
+func (h *Handler) StartRollout(c *gin.Context) {
+	var spec core.RolloutSpec
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	rollout, err := h.rollouts.Create(spec)
+	if err != nil {
+		respondRolloutError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, rollout)
+}
+
+// PauseRollout 暂停灰度发布
+func (h *Handler) PauseRollout(c *gin.Context) {
+	h.changeRollout(c, h.rollouts.Pause)
+}
+
+// ResumeRollout 继续暂停的灰度发布
+func (h *Handler) ResumeRollout(c *gin.Context) {
+	h.changeRollout(c, h.rollouts.Resume)
+}
+
+// AbortRollout 中止灰度发布并恢复发布前的权重
+func (h *Handler) AbortRollout(c *gin.Context) {
+	h.changeRollout(c, h.rollouts.Abort)
+}
+
+// changeRollout 执行灰度发布的状态变更并返回变更后的灰度发布
+func (h *Handler) changeRollout(c *gin.Context, change func(id string) (*db.Rollout, error)) {
+	rollout, err := change(c.Param("id"))
+	if err != nil {
+		respondRolloutError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rollout)
+}
+
+// respondRolloutError 按错误类型返回对应的状态码
+func respondRolloutError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, core.ErrRolloutNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, core.ErrRolloutConflict), errors.Is(err, core.ErrRolloutState):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, core.ErrInvalidRollout), errors.Is(err, core.ErrRolloutApply):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// validateRolloutLocations 检查规则的修改是否与进行中的灰度发布冲突
+// 灰度发布的每一步都按发布前的权重重新计算整个 location 的权重，发布期间修改该 location 的路径、
+// 上游的目标、条件或权重会被下一步覆盖，因此需要先完成或中止灰度发布
+func (h *Handler) validateRolloutLocations(rule *db.Rule, updated []db.Location) error {
+	if h.rollouts == nil {
+		return nil
+	}
+	rollouts, err := h.rollouts.Active(rule.ID)
+	if err != nil {
+		return fmt.Errorf("failed to check rollouts: %w", err)
+	}
+	if len(rollouts) == 0 {
+		return nil
+	}
+	current, err := rule.GetLocations()
+	if err != nil {
+		return err
+	}
+	for _, rollout := range rollouts {
+		i := rollout.LocationIndex
+		if i >= len(current) || i >= len(updated) || !sameRolloutLocation(current[i], updated[i]) {
+			return fmt.Errorf("location '%s' has an active rollout %s, finish or abort it before changing its upstreams",
+				rollout.LocationPath, rollout.ID)
+		}
+	}
+	return nil
+}
+
+// sameRolloutLocation 两个 location 的路径以及上游的目标、条件和权重是否相同
+func sameRolloutLocation(a, b db.Location) bool {
+	if a.Modifier != b.Modifier || a.Path != b.Path || len(a.Upstreams) != len(b.Upstreams) {
+		return false
+	}
+	for i := range a.Upstreams {
+		x, y := &a.Upstreams[i], &b.Upstreams[i]
+		if x.Target != y.Target || x.Weight != y.Weight || x.ConditionKey() != y.ConditionKey() {
+			return false
+		}
+		if (x.Pool == nil) != (y.Pool == nil) || (x.Pool != nil && x.Pool.Name != y.Pool.Name) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,376 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"nginx-proxy/internal/db"
+)
+
+// routeTableNamePattern 路由表名称格式
+var routeTableNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// RouteTableRequest 创建或更新路由表请求
+type RouteTableRequest struct {
+	Name        string                `json:"name" binding:"required"`
+	Description string                `json:"description"`
+	Entries     []RouteTableEntryItem `json:"entries"` // 仅创建时使用
+}
+
+// RouteTableEntryItem 路由表映射
+type RouteTableEntryItem struct {
+	Key    string `json:"key" binding:"required"`
+	Target string `json:"target" binding:"required"`
+}
+
+// UpsertRouteTableEntriesRequest 批量写入路由表映射请求
+type UpsertRouteTableEntriesRequest struct {
+	Entries []RouteTableEntryItem `json:"entries" binding:"required"`
+	Replace bool                  `json:"replace"` // 为 true 时先清空原有映射
+}
+
+// RouteTableResponse 路由表响应
+type RouteTableResponse struct {
+	db.RouteTable
+	EntryCount int64 `json:"entry_count"`
+}
+
+// GetRouteTables 获取所有路由表
+func (h *Handler) GetRouteTables(c *gin.Context) {
+	var tables []db.RouteTable
+	if err := h.db.Order("name").Find(&tables).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	responses := make([]RouteTableResponse, 0, len(tables))
+	for _, table := range tables {
+		var count int64
+		if err := h.db.Model(&db.RouteTableEntry{}).Where("table_id = ?", table.ID).Count(&count).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		responses = append(responses, RouteTableResponse{RouteTable: table, EntryCount: count})
+	}
+	c.JSON(http.StatusOK, gin.H{"route_tables": responses})
+}
+
+// GetRouteTable 获取单个路由表
+func (h *Handler) GetRouteTable(c *gin.Context) {
+	table, ok := h.findRouteTable(c)
+	if !ok {
+		return
+	}
+	var count int64
+	if err := h.db.Model(&db.RouteTableEntry{}).Where("table_id = ?", table.ID).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, RouteTableResponse{RouteTable: *table, EntryCount: count})
+}
+
+// CreateRouteTable 创建路由表
+func (h *Handler) CreateRouteTable(c *gin.Context) {
+	var req RouteTableRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateRouteTableEntries(req.Entries); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.validateRouteTableName(req.Name, ""); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	table := db.RouteTable{
+		ID:          uuid.New().String(),
+		Name:        req.Name,
+		Description: req.Description,
+	}
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&table).Error; err != nil {
+			return err
+		}
+		return upsertRouteTableEntries(tx, table.ID, req.Entries)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.reloadRouteTables()
+	c.JSON(http.StatusCreated, RouteTableResponse{RouteTable: table, EntryCount: int64(len(req.Entries))})
+}
+
+// UpdateRouteTable 更新路由表名称和描述
+func (h *Handler) UpdateRouteTable(c *gin.Context) {
+	table, ok := h.findRouteTable(c)
+	if !ok {
+		return
+	}
+	var req RouteTableRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name != table.Name {
+		if err := h.validateRouteTableName(req.Name, table.ID); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		// 被规则引用的路由表不允许改名，否则引用会失效
+		if rules, err := h.rulesReferencingTable(table.Name); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		} else if len(rules) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Route table is being used by rules: %v", rules)})
+			return
+		}
+	}
+	table.Name = req.Name
+	table.Description = req.Description
+	if err := h.db.Save(table).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.reloadRouteTables()
+	c.JSON(http.StatusOK, table)
+}
+
+// DeleteRouteTable 删除路由表及其所有映射
+func (h *Handler) DeleteRouteTable(c *gin.Context) {
+	table, ok := h.findRouteTable(c)
+	if !ok {
+		return
+	}
+	rules, err := h.rulesReferencingTable(table.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(rules) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Route table is being used by rules: %v", rules)})
+		return
+	}
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("table_id = ?", table.ID).Delete(&db.RouteTableEntry{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(table).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.reloadRouteTables()
+	c.JSON(http.StatusOK, gin.H{"message": "Route table deleted successfully"})
+}
+
+// GetRouteTableEntries 获取路由表的所有映射
+func (h *Handler) GetRouteTableEntries(c *gin.Context) {
+	table, ok := h.findRouteTable(c)
+	if !ok {
+		return
+	}
+	var entries []db.RouteTableEntry
+	if err := h.db.Where("table_id = ?", table.ID).Order("key").Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
+
+// UpsertRouteTableEntries 批量新增或更新路由表映射
+func (h *Handler) UpsertRouteTableEntries(c *gin.Context) {
+	table, ok := h.findRouteTable(c)
+	if !ok {
+		return
+	}
+	var req UpsertRouteTableEntriesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateRouteTableEntries(req.Entries); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if req.Replace {
+			if err := tx.Where("table_id = ?", table.ID).Delete(&db.RouteTableEntry{}).Error; err != nil {
+				return err
+			}
+		}
+		return upsertRouteTableEntries(tx, table.ID, req.Entries)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.reloadRouteTables()
+	c.JSON(http.StatusOK, gin.H{"message": "Route table entries updated successfully", "count": len(req.Entries)})
+}
+
+// DeleteRouteTableEntry 删除路由表中的一条映射
+func (h *Handler) DeleteRouteTableEntry(c *gin.Context) {
+	table, ok := h.findRouteTable(c)
+	if !ok {
+		return
+	}
+	result := h.db.Where("table_id = ? AND key = ?", table.ID, c.Param("key")).Delete(&db.RouteTableEntry{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route table entry not found"})
+		return
+	}
+	h.reloadRouteTables()
+	c.JSON(http.StatusOK, gin.H{"message": "Route table entry deleted successfully"})
+}
+
+// findRouteTable 按路径参数 id 查找路由表，找不到时直接写入错误响应
+func (h *Handler) findRouteTable(c *gin.Context) (*db.RouteTable, bool) {
+	var table db.RouteTable
+	if err := h.db.First(&table, "id = ?", c.Param("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Route table not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return &table, true
+}
+
+// upsertRouteTableEntries 写入映射，键已存在时更新目标地址
+func upsertRouteTableEntries(tx *gorm.DB, tableID string, items []RouteTableEntryItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	entries := make([]db.RouteTableEntry, 0, len(items))
+	for _, item := range items {
+		entries = append(entries, db.RouteTableEntry{TableID: tableID, Key: item.Key, Target: item.Target})
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "table_id"}, {Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"target", "updated_at"}),
+	}).CreateInBatches(&entries, 500).Error
+}
+
+// reloadRouteTables 重新加载路由表索引，并使路由快照失效
+func (h *Handler) reloadRouteTables() {
+	if err := h.routeTables.Reload(); err != nil {
+		log.Printf("Warning: Failed to reload route tables: %v", err)
+	}
+	h.snapshots.Invalidate()
+}
+
+// validateRouteTableName 验证路由表名称格式和唯一性
+func (h *Handler) validateRouteTableName(name, excludeID string) error {
+	if !routeTableNamePattern.MatchString(name) {
+		return fmt.Errorf("route table name may only contain letters, digits, '_' and '-'")
+	}
+	var count int64
+	query := h.db.Model(&db.RouteTable{}).Where("name = ?", name)
+	if excludeID != "" {
+		query = query.Where("id != ?", excludeID)
+	}
+	if err := query.Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to check existing route tables: %w", err)
+	}
+	if count > 0 {
+		return fmt.Errorf("route table '%s' already exists", name)
+	}
+	return nil
+}
+
+// validateRouteTableEntries 验证映射的键和目标地址
+func validateRouteTableEntries(items []RouteTableEntryItem) error {
+	seen := make(map[string]bool, len(items))
+	for _, item := range items {
+		if item.Key == "" {
+			return fmt.Errorf("route table entry key is required")
+		}
+		if seen[item.Key] {
+			return fmt.Errorf("duplicate route table entry key '%s'", item.Key)
+		}
+		seen[item.Key] = true
+		if err := validateTargetURL(item.Target); err != nil {
+			return fmt.Errorf("route table entry '%s': %w", item.Key, err)
+		}
+	}
+	return nil
+}
+
+// rulesReferencingTable 返回引用了指定路由表的规则的 server_name
+func (h *Handler) rulesReferencingTable(name string) ([]string, error) {
+	var rules []db.Rule
+	if err := h.db.Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	var serverNames []string
+	for _, rule := range rules {
+		locations, err := rule.GetLocations()
+		if err != nil {
+			continue
+		}
+		for _, location := range locations {
+			if location.Lookup != nil && location.Lookup.Table == name {
+				serverNames = append(serverNames, rule.ServerName)
+				break
+			}
+		}
+	}
+	return serverNames, nil
+}
+
+// lookupTarget 按 location 的路由表配置查找目标地址
+func (h *Handler) lookupTarget(req *RouteRequest, lookup *db.LookupConfig) (string, bool) {
+	var value string
+	switch lookup.Source {
+	case db.LookupSourceHeader:
+		value, _ = lookupHeader(req.Headers, strings.ToLower(lookup.Key))
+	case db.LookupSourceCookie:
+		value = req.Cookies[lookup.Key]
+	case db.LookupSourceQuery:
+		value = req.Query[lookup.Key]
+	}
+	if value == "" {
+		return "", false
+	}
+	return h.routeTables.Lookup(lookup.Table, value)
+}
+
+// validateLookup 验证路由表查找配置
+func (h *Handler) validateLookup(lookup *db.LookupConfig) error {
+	if lookup == nil {
+		return nil
+	}
+	switch lookup.Source {
+	case db.LookupSourceHeader, db.LookupSourceCookie, db.LookupSourceQuery:
+	default:
+		return fmt.Errorf("unsupported lookup source '%s'", lookup.Source)
+	}
+	if lookup.Key == "" {
+		return fmt.Errorf("lookup key is required")
+	}
+	var count int64
+	if err := h.db.Model(&db.RouteTable{}).Where("name = ?", lookup.Table).Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to check route table: %w", err)
+	}
+	if count == 0 {
+		return fmt.Errorf("route table '%s' does not exist", lookup.Table)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"nginx-proxy/internal/db"
+)
+
+// RouteTestFailure 未通过的路由测试用例
+type RouteTestFailure struct {
+	RuleID     string             `json:"rule_id,omitempty"`
+	ServerName string             `json:"server_name,omitempty"`
+	Index      int                `json:"index"`
+	Name       string             `json:"name,omitempty"`
+	Expect     db.RouteTestExpect `json:"expect"`
+	Actual     []RouteTestResult  `json:"actual"` // 请求可能得到的路由结果
+	Reason     string             `json:"reason"`
+}
+
+// RouteTestResult 测试请求可能得到的一个路由结果
+type RouteTestResult struct {
+	Target string `json:"target"`
+	URI    string `json:"uri"` // 转发给后端的 URI（未重写时为原始路径）
+}
+
+// RouteTestReport 所有规则测试用例的执行结果
+type RouteTestReport struct {
+	Total    int                `json:"total"`
+	Passed   int                `json:"passed"`
+	Failed   int                `json:"failed"`
+	Failures []RouteTestFailure `json:"failures"`
+}
+
+// RunRouteTests 对当前生效的所有规则执行其路由测试用例
+func (h *Handler) RunRouteTests(c *gin.Context) {
+	report := RouteTestReport{Failures: []RouteTestFailure{}}
+	for _, rule := range h.routes.Load().rules {
+		cases, err := rule.rule.GetTestCases()
+		if err != nil {
+			report.Failed++
+			report.Failures = append(report.Failures, RouteTestFailure{
+				RuleID:     rule.rule.ID,
+				ServerName: rule.rule.ServerName,
+				Index:      -1,
+				Reason:     "invalid test cases: " + err.Error(),
+			})
+			continue
+		}
+		failures := h.runTestCases(rule, cases)
+		for i := range failures {
+			failures[i].RuleID = rule.rule.ID
+			failures[i].ServerName = rule.rule.ServerName
+		}
+		report.Total += len(cases)
+		report.Failed += len(failures)
+		report.Passed += len(cases) - len(failures)
+		report.Failures = append(report.Failures, failures...)
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// runTestCases 在规则上执行测试用例，返回未通过的用例
+func (h *Handler) runTestCases(rule *compiledRule, cases []db.RouteTestCase) []RouteTestFailure {
+	var failures []RouteTestFailure
+	for i, tc := range cases {
+		failure := RouteTestFailure{Index: i, Name: tc.Name, Expect: tc.Expect}
+		if rule.err != nil {
+			failure.Reason = "invalid locations: " + rule.err.Error()
+			failures = append(failures, failure)
+			continue
+		}
+		results, reason := h.evaluateTestCase(rule, tc)
+		if reason == "" {
+			continue
+		}
+		failure.Actual = results
+		failure.Reason = reason
+		failures = append(failures, failure)
+	}
+	return failures
+}
+
+// evaluateTestCase 计算测试请求可能得到的路由结果，未通过时返回原因
+func (h *Handler) evaluateTestCase(rule *compiledRule, tc db.RouteTestCase) ([]RouteTestResult, string) {
+	host := tc.Request.Host
+	if host == "" {
+		host = rule.rule.ServerName
+	}
+	req := &RouteRequest{
+		Path:       tc.Request.Path,
+		RemoteAddr: tc.Request.RemoteAddr,
+		Headers:    tc.Request.Headers,
+		Cookies:    tc.Request.Cookies,
+		Query:      tc.Request.Query,
+		Method:     tc.Request.Method,
+		ServerName: rule.rule.ServerName,
+		Host:       host,
+	}
+	var captures map[string]string
+	if rule.serverRegex != nil {
+		captures, _ = regexCaptures(rule.serverRegex, strings.ToLower(host))
+	}
+	results := []RouteTestResult{}
+	index, locationCaptures, ok := rule.findLocation(req.Path)
+	if ok {
+		location := &rule.locations[index]
+		target, hit := "", false
+		if lookup := location.location.Lookup; lookup != nil {
+			target, hit = h.lookupTarget(req, lookup)
+		}
+		if hit {
+			results = append(results, RouteTestResult{Target: target, URI: req.Path})
+		} else {
+			for _, i := range h.upstreamCandidates(req, location) {
+				target, err := expandTarget(location.location.Upstreams[i].Target,
+					mergeCaptures(captures, locationCaptures), req.Headers)
+				if err != nil {
+					continue
+				}
+				uri := rewritePath(req.Path, location.upstreams[i].rewrite)
+				if uri == "" {
+					uri = req.Path
+				}
+				results = append(results, RouteTestResult{Target: target, URI: uri})
+			}
+		}
+	}
+	if tc.Expect.Target == "" {
+		if len(results) > 0 {
+			return results, "expected no match"
+		}
+		return results, ""
+	}
+	if len(results) == 0 {
+		return results, "no upstream matched"
+	}
+	for _, result := range results {
+		if result.Target == tc.Expect.Target && (tc.Expect.URI == "" || result.URI == tc.Expect.URI) {
+			return results, ""
+		}
+	}
+	return results, "expected target is not among possible results"
+}
+
+// upstreamCandidates 返回请求可能选中的上游下标，规则与 selectUpstream 一致
+// 按权重随机时返回所有参与分流的上游，issued_cookie 会话保持在请求未携带 Cookie 时同样无法确定；
+// 测试用例验证的是规则配置，不考虑上游的健康状态
+func (h *Handler) upstreamCandidates(req *RouteRequest, location *compiledLocation) []int {
+	upstreams := location.location.Upstreams
+	matched, weighted, _, _ := h.matchUpstreams(req, location, false, nil, nil)
+	if len(matched) == 0 {
+		return nil
+	}
+	candidates := weighted
+	if len(candidates) == 0 {
+		candidates = matched
+	}
+	if sticky := location.location.Sticky; sticky != nil {
+		if sticky.Mode == db.StickyModeIssuedCookie && req.Cookies[sticky.CookieName()] == "" {
+			return candidates
+		}
+		key, _ := h.stickyKey(req, sticky)
+		return []int{selectSticky(key, upstreams, candidates)}
+	}
+	if len(weighted) > 0 {
+		return weighted
+	}
+	return matched[:1]
+}
+
+// validateTestCases 验证路由测试用例
+func validateTestCases(cases []db.RouteTestCase) error {
+	for i, tc := range cases {
+		if !strings.HasPrefix(tc.Request.Path, "/") {
+			return fmt.Errorf("test case %d: request path must start with '/'", i)
+		}
+		if tc.Request.Method != "" && !slices.Contains(httpMethods, strings.ToUpper(tc.Request.Method)) {
+			return fmt.Errorf("test case %d: unsupported method '%s'", i, tc.Request.Method)
+		}
+		if tc.Request.RemoteAddr != "" {
+			if _, err := netip.ParseAddr(tc.Request.RemoteAddr); err != nil {
+				return fmt.Errorf("test case %d: invalid remote_addr '%s'", i, tc.Request.RemoteAddr)
+			}
+		}
+		if tc.Expect.Target != "" {
+			if err := validateTargetURL(tc.Expect.Target); err != nil {
+				return fmt.Errorf("test case %d: %w", i, err)
+			}
+		}
+		if tc.Expect.URI != "" && !strings.HasPrefix(tc.Expect.URI, "/") {
+			return fmt.Errorf("test case %d: expected uri must start with '/'", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,600 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"nginx-proxy/internal/db"
+)
+
+// routeIndex 预编译的路由索引
+// 规则变更后整体重建并原子替换，Route 只读取索引，不访问数据库也不解析 JSON
+type routeIndex struct {
+	rules       []*compiledRule          // 所有规则，按 ID 排序
+	byName      map[string]*compiledRule // 按原始 server_name 索引（nginx 选中的 server_name）
+	exact       map[string]*compiledRule // 精确名称（小写）
+	leading     []*compiledRule          // 前导通配符，按后缀长度降序
+	trailing    []*compiledRule          // 后缀通配符，按前缀长度降序
+	regex       []*compiledRule          // 正则，按规则 ID 排序（与 conf.d 中配置文件的加载顺序一致）
+	fingerprint string                   // 构建索引时规则表的指纹
+}
+
+// compiledRule 预编译的规则
+type compiledRule struct {
+	rule        db.Rule
+	err         error          // 解析 locations 失败的原因
+	name        string         // 小写的 server_name，通配符去掉 "*"
+	serverRegex *regexp.Regexp // 正则 server_name
+	locations   []compiledLocation
+	exact       map[string]int // "=" location 的路径 → 下标
+	prefixes    []int          // 前缀 location（无修饰符和 "^~"），按路径长度降序
+	regexes     []int          // 正则 location，按声明顺序
+}
+
+// compiledLocation 预编译的 location
+type compiledLocation struct {
+	location  db.Location
+	regex     *regexp.Regexp
+	named     bool // 正则是否包含命名捕获
+	upstreams []compiledUpstream
+}
+
+// compiledUpstream 预编译的上游匹配条件
+type compiledUpstream struct {
+	hasIP    bool
+	prefixes []netip.Prefix // hasIP 为 true 且 prefixes 为空时表示条件配置错误，永不匹配
+	methods  []string
+	headers  []compiledCondition
+	cookies  []compiledCondition
+	query    []compiledCondition
+	rewrite  *compiledRewrite
+	group    int // 条件组编号，见 db.ConditionGroups
+}
+
+// compiledCondition 预编译的匹配条件，头部条件的名称已转为小写
+type compiledCondition struct {
+	db.MatchCondition
+	regex *regexp.Regexp
+}
+
+// buildRouteIndex 编译所有规则，rules 需按 ID 排序，ipSets 用于展开 IP 条件中的集合引用
+func buildRouteIndex(rules []db.Rule, fingerprint string, ipSets db.IPSets) *routeIndex {
+	index := &routeIndex{
+		byName:      make(map[string]*compiledRule, len(rules)),
+		exact:       make(map[string]*compiledRule),
+		fingerprint: fingerprint,
+	}
+	for _, rule := range rules {
+		compiled := compileRule(rule, ipSets)
+		index.rules = append(index.rules, compiled)
+		if _, exists := index.byName[rule.ServerName]; !exists {
+			index.byName[rule.ServerName] = compiled
+		}
+		switch serverNameType(rule.ServerName) {
+		case serverNameExact:
+			if _, exists := index.exact[compiled.name]; !exists {
+				index.exact[compiled.name] = compiled
+			}
+		case serverNameLeadingWildcard:
+			index.leading = append(index.leading, compiled)
+		case serverNameTrailingWildcard:
+			index.trailing = append(index.trailing, compiled)
+		case serverNameRegex:
+			if compiled.serverRegex != nil {
+				index.regex = append(index.regex, compiled)
+			}
+		}
+	}
+	sort.SliceStable(index.leading, func(i, j int) bool {
+		return len(index.leading[i].name) > len(index.leading[j].name)
+	})
+	sort.SliceStable(index.trailing, func(i, j int) bool {
+		return len(index.trailing[i].name) > len(index.trailing[j].name)
+	})
+	return index
+}
+
+// compileRule 编译单个规则，配置错误的正则和 CIDR 会记录日志并视为不匹配
+func compileRule(rule db.Rule, ipSets db.IPSets) *compiledRule {
+	compiled := &compiledRule{
+		rule:  rule,
+		name:  strings.ToLower(rule.ServerName),
+		exact: make(map[string]int),
+	}
+	switch serverNameType(rule.ServerName) {
+	case serverNameLeadingWildcard:
+		compiled.name = strings.TrimPrefix(compiled.name, "*")
+	case serverNameTrailingWildcard:
+		compiled.name = strings.TrimSuffix(compiled.name, "*")
+	case serverNameRegex:
+		re, err := compileServerName(rule.ServerName)
+		if err != nil {
+			log.Printf("Warning: Invalid server_name regex %s: %v", rule.ServerName, err)
+		}
+		compiled.serverRegex = re
+	}
+	locations, err := rule.GetLocations()
+	if err != nil {
+		compiled.err = err
+		return compiled
+	}
+	db.ResolvePoolTargets(locations)
+	for i, location := range locations {
+		cl := compiledLocation{location: location}
+		switch {
+		case location.Modifier == db.LocationModifierExact:
+			compiled.exact[location.Path] = i
+		case location.IsPrefix():
+			compiled.prefixes = append(compiled.prefixes, i)
+		case location.IsRegex():
+			re, err := location.CompileRegex()
+			if err != nil {
+				log.Printf("Warning: Invalid location regex %s: %v", location.Path, err)
+				break
+			}
+			cl.regex = re
+			cl.named = hasNamedGroups(re)
+			compiled.regexes = append(compiled.regexes, i)
+		}
+		groups := db.ConditionGroups(location.Upstreams)
+		for j, upstream := range location.Upstreams {
+			cu := compileUpstream(location, upstream, ipSets)
+			cu.group = groups[j]
+			cl.upstreams = append(cl.upstreams, cu)
+		}
+		compiled.locations = append(compiled.locations, cl)
+	}
+	sort.SliceStable(compiled.prefixes, func(i, j int) bool {
+		return len(locations[compiled.prefixes[i]].Path) > len(locations[compiled.prefixes[j]].Path)
+	})
+	return compiled
+}
+
+// compileUpstream 编译上游的匹配条件和路径重写
+func compileUpstream(location db.Location, upstream db.Upstream, ipSets db.IPSets) compiledUpstream {
+	compiled := compiledUpstream{
+		methods: upstream.Methods,
+		headers: compileConditions(upstream.Headers, true),
+		cookies: compileConditions(upstream.Cookies, false),
+		query:   compileConditions(upstream.Query, false),
+		rewrite: compileRewrite(location, upstream.Rewrite),
+	}
+	// 空条件或默认路由，匹配所有
+	if upstream.ConditionIP != "" && upstream.ConditionIP != "0.0.0.0/0" {
+		compiled.hasIP = true
+		conditions, err := ipSets.Expand([]string{upstream.ConditionIP})
+		if err != nil {
+			log.Printf("Warning: Invalid IP condition %s: %v", upstream.ConditionIP, err)
+		}
+		for _, condition := range conditions {
+			prefix, err := parseConditionIP(condition)
+			if err != nil {
+				log.Printf("Warning: Invalid IP condition %s: %v", condition, err)
+				// 任一网段无效时整个条件视为配置错误
+				compiled.prefixes = nil
+				break
+			}
+			compiled.prefixes = append(compiled.prefixes, prefix)
+		}
+	}
+	return compiled
+}
+
+// parseConditionIP 将 IP 或 CIDR 条件解析为网络前缀，IPv4 映射的 IPv6 地址统一转为 IPv4
+func parseConditionIP(conditionIP string) (netip.Prefix, error) {
+	if !strings.Contains(conditionIP, "/") {
+		addr, err := netip.ParseAddr(conditionIP)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(conditionIP)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+// compileConditions 编译匹配条件，lowerName 为 true 时名称转为小写（头部名称不区分大小写）
+func compileConditions(conditions db.MatchConditions, lowerName bool) []compiledCondition {
+	compiled := make([]compiledCondition, 0, len(conditions))
+	for _, condition := range conditions {
+		cc := compiledCondition{MatchCondition: condition}
+		if lowerName {
+			cc.Name = strings.ToLower(condition.Name)
+		}
+		if condition.Operator == db.MatchOperatorRegex || condition.Operator == db.MatchOperatorNotRegex {
+			re, err := regexp.Compile(condition.Value)
+			if err != nil {
+				log.Printf("Warning: Invalid condition regex %s: %v", condition.Value, err)
+			}
+			cc.regex = re
+		}
+		compiled = append(compiled, cc)
+	}
+	return compiled
+}
+
+// hasNamedGroups 检查正则是否包含命名捕获
+func hasNamedGroups(re *regexp.Regexp) bool {
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// findRule 查找请求对应的规则，返回规则及 server_name 正则的命名捕获
+// 优先按 nginx 选中的 server_name 精确查找，找不到时再按 nginx 的优先级用主机名匹配通配符和正则规则
+func (idx *routeIndex) findRule(serverName, host string) (*compiledRule, map[string]string) {
+	if rule, ok := idx.byName[serverName]; ok {
+		if rule.serverRegex == nil || host == "" {
+			return rule, nil
+		}
+		captures, _ := regexCaptures(rule.serverRegex, strings.ToLower(host))
+		return rule, captures
+	}
+	if host == "" {
+		host = serverName
+	}
+	return idx.matchServerName(host)
+}
+
+// matchServerName 按 nginx 的优先级查找与主机名匹配的规则，返回规则及正则的命名捕获
+// 1. 精确名称
+// 2. 最长的前导通配符（*.example.com、.example.com）
+// 3. 最长的后缀通配符（mail.*）
+// 4. 按顺序第一个匹配的正则
+func (idx *routeIndex) matchServerName(host string) (*compiledRule, map[string]string) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if rule, ok := idx.exact[host]; ok {
+		return rule, nil
+	}
+	for _, rule := range idx.leading {
+		// .example.com 同时匹配 example.com
+		if strings.HasSuffix(host, rule.name) || (rule.name[0] == '.' && host == rule.name[1:]) {
+			return rule, nil
+		}
+	}
+	for _, rule := range idx.trailing {
+		if strings.HasPrefix(host, rule.name) {
+			return rule, nil
+		}
+	}
+	for _, rule := range idx.regex {
+		if captures, ok := regexCaptures(rule.serverRegex, host); ok {
+			return rule, captures
+		}
+	}
+	return nil, nil
+}
+
+// findLocation 按 nginx 的 location 匹配顺序查找，返回命中的 location 下标及正则的命名捕获
+// 1. "=" 精确匹配，命中即返回
+// 2. 在前缀 location（无修饰符和 "^~"）中找最长前缀，若为 "^~" 则直接返回
+// 3. 按声明顺序检查正则 location（"~" 和 "~*"），第一个命中的返回
+// 4. 否则返回第 2 步找到的最长前缀
+func (r *compiledRule) findLocation(requestPath string) (int, map[string]string, bool) {
+	if i, ok := r.exact[requestPath]; ok {
+		return i, nil, true
+	}
+	longest := -1
+	for _, i := range r.prefixes {
+		if strings.HasPrefix(requestPath, r.locations[i].location.Path) {
+			longest = i
+			break
+		}
+	}
+	if longest >= 0 && r.locations[longest].location.Modifier == db.LocationModifierPrefixPriority {
+		return longest, nil, true
+	}
+	for _, i := range r.regexes {
+		location := &r.locations[i]
+		if !location.named {
+			if location.regex.MatchString(requestPath) {
+				return i, nil, true
+			}
+			continue
+		}
+		if captures, ok := regexCaptures(location.regex, requestPath); ok {
+			return i, captures, true
+		}
+	}
+	return longest, nil, longest >= 0
+}
+
+// maxStackCandidates 候选上游数量不超过该值时使用栈上的数组，避免分配
+const maxStackCandidates = 16
+
+// selectUpstream 在条件匹配的上游中选择一个，返回其下标以及需要下发的会话保持 Cookie
+// 按声明顺序第一个匹配的上游决定条件组，只在组内（条件完全相同的上游）选择：
+// 组内只要有设置了权重的，就只在这些上游中按权重选择（权重为 0 的不参与）；
+// 启用会话保持时按一致性哈希选择（均未设置权重时组内上游权重相同），否则按权重比例随机；
+// 未启用会话保持且均未设置权重时保持原有行为，返回第一个匹配的上游。
+// 启用健康检查或熔断时跳过不可用的上游，匹配的上游全部不可用时忽略可用性，避免直接拒绝请求。
+// 选中半开状态的上游时需要占用其探测名额，名额已被其他请求占用时该上游变为不可用，重新选择
+func (h *Handler) selectUpstream(req *RouteRequest, location *compiledLocation) (int, *http.Cookie, bool) {
+	var matchedBuf, weightedBuf [maxStackCandidates]int
+	for {
+		matched, weighted, totalWeight, skipped := h.matchUpstreams(req, location, true, matchedBuf[:0], weightedBuf[:0])
+		if len(matched) == 0 && skipped {
+			matched, weighted, totalWeight, _ = h.matchUpstreams(req, location, false, matchedBuf[:0], weightedBuf[:0])
+			return h.pickUpstream(req, location, matched, weighted, totalWeight)
+		}
+		i, cookie, ok := h.pickUpstream(req, location, matched, weighted, totalWeight)
+		if !ok || h.breaker == nil || h.breaker.Allow(location.location.Upstreams[i].Target) {
+			return i, cookie, ok
+		}
+	}
+}
+
+// pickUpstream 按权重或会话保持在 matchUpstreams 返回的候选上游中选择一个
+func (h *Handler) pickUpstream(req *RouteRequest, location *compiledLocation, matched, weighted []int, totalWeight int) (int, *http.Cookie, bool) {
+	upstreams := location.location.Upstreams
+	if len(matched) == 0 {
+		return -1, nil, false
+	}
+	if location.location.Sticky != nil {
+		candidates := weighted
+		if len(candidates) == 0 {
+			candidates = matched
+		}
+		key, cookie := h.stickyKey(req, location.location.Sticky)
+		return selectSticky(key, upstreams, candidates), cookie, true
+	}
+	if totalWeight == 0 {
+		return matched[0], nil, true
+	}
+	n := rand.IntN(totalWeight)
+	for _, i := range weighted {
+		n -= upstreams[i].Weight
+		if n < 0 {
+			return i, nil, true
+		}
+	}
+	return weighted[len(weighted)-1], nil, true
+}
+
+// matchUpstreams 找到第一个有可用上游的匹配条件组，将组内上游下标追加到 matched，其中设置了权重的同时追加到 weighted
+// skipUnavailable 为 true 时跳过不可用的上游，返回值 skipped 表示是否有匹配的上游因此被跳过
+func (h *Handler) matchUpstreams(req *RouteRequest, location *compiledLocation, skipUnavailable bool, matched, weighted []int) ([]int, []int, int, bool) {
+	upstreams := location.location.Upstreams
+	totalWeight, skipped := 0, false
+	group := -1
+	for i := range location.upstreams {
+		if !location.upstreams[i].match(req) {
+			continue
+		}
+		if skipUnavailable && !h.upstreamAvailable(upstreams[i].Target) {
+			skipped = true
+			continue
+		}
+		group = location.upstreams[i].group
+		break
+	}
+	if group < 0 {
+		return matched, weighted, 0, skipped
+	}
+	// 组内上游的条件相同，不需要再次匹配
+	for i := group; i < len(location.upstreams); i++ {
+		if location.upstreams[i].group != group {
+			continue
+		}
+		if skipUnavailable && !h.upstreamAvailable(upstreams[i].Target) {
+			skipped = true
+			continue
+		}
+		matched = append(matched, i)
+		if upstreams[i].Weight > 0 {
+			weighted = append(weighted, i)
+			totalWeight += upstreams[i].Weight
+		}
+	}
+	return matched, weighted, totalWeight, skipped
+}
+
+// upstreamAvailable 检查上游是否可用：主动健康检查未判定为不健康，且未被熔断或半开状态下探测名额未被占用
+// 只做检查，不占用探测名额，真正转发前由 selectUpstream 占用
+func (h *Handler) upstreamAvailable(target string) bool {
+	if h.health != nil && !h.health.IsHealthy(target) {
+		return false
+	}
+	return h.breaker == nil || h.breaker.Available(target)
+}
+
+// match 检查请求是否满足上游的所有条件
+func (u *compiledUpstream) match(req *RouteRequest) bool {
+	// 检查 IP 条件
+	if u.hasIP && !u.matchIP(req.RemoteAddr) {
+		return false
+	}
+	// 检查请求方法条件（或关系）
+	if len(u.methods) > 0 && !matchMethod(req.Method, u.methods) {
+		return false
+	}
+	// 检查头部条件（且关系）
+	if len(u.headers) > 0 && !matchHeaders(req.Headers, u.headers) {
+		return false
+	}
+	// 检查 Cookie 条件（且关系）
+	if len(u.cookies) > 0 && !matchValues(req.Cookies, u.cookies) {
+		return false
+	}
+	// 检查查询参数条件（且关系）
+	if len(u.query) > 0 && !matchValues(req.Query, u.query) {
+		return false
+	}
+	return true
+}
+
+// matchIP 检查客户端 IP 是否在任一条件网段内
+func (u *compiledUpstream) matchIP(remoteAddr string) bool {
+	addr, err := netip.ParseAddr(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range u.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMethod 检查请求方法是否在允许列表中（不区分大小写）
+func matchMethod(method string, methods []string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(method, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHeaders 检查头部是否匹配（且关系），条件名称已转为小写
+// OpenResty 传入的头部名称为小写，可以直接查找；查找不到时再忽略大小写遍历
+func matchHeaders(requestHeaders map[string]string, conditions []compiledCondition) bool {
+	for i := range conditions {
+		value, exists := lookupHeader(requestHeaders, conditions[i].Name)
+		if !matchCondition(&conditions[i], value, exists) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupHeader 按小写名称查找请求头
+func lookupHeader(headers map[string]string, name string) (string, bool) {
+	if value, ok := headers[name]; ok {
+		return value, true
+	}
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// matchValues 检查 Cookie、查询参数等是否满足所有条件（且关系），名称区分大小写
+func matchValues(values map[string]string, conditions []compiledCondition) bool {
+	for i := range conditions {
+		value, exists := values[conditions[i].Name]
+		if !matchCondition(&conditions[i], value, exists) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchCondition 检查单个条件，value 和 exists 为请求中该属性的值及是否存在
+// 取反类操作符在属性不存在时视为匹配
+func matchCondition(condition *compiledCondition, value string, exists bool) bool {
+	switch condition.Operator {
+	case db.MatchOperatorExists:
+		return exists
+	case db.MatchOperatorNotExists:
+		return !exists
+	case "", db.MatchOperatorEquals:
+		return exists && value == condition.Value
+	case db.MatchOperatorNotEquals:
+		return !exists || value != condition.Value
+	case db.MatchOperatorPrefix:
+		return exists && strings.HasPrefix(value, condition.Value)
+	case db.MatchOperatorNotPrefix:
+		return !exists || !strings.HasPrefix(value, condition.Value)
+	case db.MatchOperatorRegex, db.MatchOperatorNotRegex:
+		if condition.regex == nil {
+			return false
+		}
+		matched := exists && condition.regex.MatchString(value)
+		if condition.Operator == db.MatchOperatorNotRegex {
+			return !matched
+		}
+		return matched
+	}
+	return false
+}
+
+// rulesFingerprint 返回规则内容的指纹，用于发现绕过 API 的数据库修改，rules 需按 ID 排序
+// 直接修改数据库时 updated_at 不会更新，因此对 ID、域名和 locations 的内容计算哈希
+func rulesFingerprint(rules []db.Rule) string {
+	hash := sha256.New()
+	for _, rule := range rules {
+		fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%d\x00", rule.ID, rule.ServerName, rule.Locations, rule.UpdatedAt.UnixNano())
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// currentRulesFingerprint 从数据库读取规则内容并计算指纹
+func (h *Handler) currentRulesFingerprint() (string, error) {
+	var rules []db.Rule
+	if err := h.db.Select("id", "server_name", "locations", "updated_at").Order("id").Find(&rules).Error; err != nil {
+		return "", err
+	}
+	return rulesFingerprint(rules), nil
+}
+
+// rebuildRoutes 从数据库加载所有规则并重建路由索引，构建完成后原子替换
+func (h *Handler) rebuildRoutes() error {
+	h.routesMu.Lock()
+	defer h.routesMu.Unlock()
+	var rules []db.Rule
+	if err := h.db.Order("id").Find(&rules).Error; err != nil {
+		return fmt.Errorf("failed to load rules: %w", err)
+	}
+	h.routes.Store(buildRouteIndex(rules, rulesFingerprint(rules), h.ipSets.All()))
+	log.Printf("Route index rebuilt: %d rule(s)", len(rules))
+	return nil
+}
+
+// reloadRoutes 规则变更后重建路由索引并使路由快照失效
+func (h *Handler) reloadRoutes() {
+	if err := h.rebuildRoutes(); err != nil {
+		log.Printf("Warning: Failed to rebuild route index: %v", err)
+	}
+	h.snapshots.Invalidate()
+}
+
+// WatchRules 定期检查规则内容的指纹，发现绕过 API 的数据库修改时重建路由索引，ctx 取消后停止
+func (h *Handler) WatchRules(ctx context.Context, interval time.Duration) {
+	log.Printf("Start watching rules interval: %v", interval)
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fingerprint, err := h.currentRulesFingerprint()
+				if err != nil {
+					log.Printf("Warning: Failed to check rules: %v", err)
+					continue
+				}
+				if fingerprint != h.routes.Load().fingerprint {
+					log.Printf("Rules changed outside the API, rebuilding route index")
+					h.reloadRoutes()
+				}
+			case <-ctx.Done():
+				log.Println("rule watcher stopped")
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,200 @@
+package api
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"testing"
+
+	"nginx-proxy/internal/db"
+)
+
+// routingCasesFile 路由用例，与 OpenResty 本地路由共用：
+// testdata/replay_routing_cases.lua 使用 routing_snapshots.json 中编译好的规则回放，期望结果相同
+const routingCasesFile = "../../testdata/routing_cases.json"
+
+// routingCase 一个路由用例
+// Targets 为可能选中的目标地址，多于一个时表示按权重随机选择，为空时表示不匹配
+type routingCase struct {
+	Name     string          `json:"name"`
+	IPSets   db.IPSets       `json:"ip_sets"`
+	Rule     json.RawMessage `json:"rule"`
+	Request  RouteRequest    `json:"request"`
+	Location int             `json:"location"` // 命中的 location 下标，-1 表示没有命中
+	Targets  []string        `json:"targets"`
+	URI      string          `json:"uri"` // 重写后的 URI，为空时表示不重写
+}
+
+// loadRoutingCases 读取路由用例，并将规则转换为数据库中的格式
+func loadRoutingCases(t *testing.T) ([]routingCase, []db.Rule) {
+	t.Helper()
+	data, err := os.ReadFile(routingCasesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases []routingCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		t.Fatal(err)
+	}
+	rules := make([]db.Rule, len(cases))
+	for i, tc := range cases {
+		var rule struct {
+			ServerName string        `json:"server_name"`
+			Locations  []db.Location `json:"locations"`
+		}
+		if err := json.Unmarshal(tc.Rule, &rule); err != nil {
+			t.Fatalf("%s: %v", tc.Name, err)
+		}
+		rules[i] = db.Rule{ID: "rule", ServerName: rule.ServerName}
+		if err := rules[i].SetLocations(rule.Locations); err != nil {
+			t.Fatalf("%s: %v", tc.Name, err)
+		}
+	}
+	return cases, rules
+}
+
+func TestRoutingCases(t *testing.T) {
+	cases, rules := loadRoutingCases(t)
+	h := &Handler{}
+	for i, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			idx := buildRouteIndex([]db.Rule{rules[i]}, "", tc.IPSets)
+			rule, _ := idx.findRule(tc.Request.ServerName, tc.Request.Host)
+			if rule == nil {
+				t.Fatal("rule not found")
+			}
+			location, _, ok := rule.findLocation(tc.Request.Path)
+			if !ok {
+				location = -1
+			}
+			if location != tc.Location {
+				t.Fatalf("location = %d, want %d", location, tc.Location)
+			}
+			// 按权重随机选择时多次路由，结果必须都在候选中且每个候选都出现过
+			runs := 1
+			if len(tc.Targets) > 1 {
+				runs = 200
+			}
+			seen := make(map[string]bool)
+			for range runs {
+				req := tc.Request
+				resp, err := h.route(idx, &req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(tc.Targets) == 0 {
+					if resp.Match {
+						t.Fatalf("matched %s, want no match", resp.Target)
+					}
+					return
+				}
+				if !resp.Match || !slices.Contains(tc.Targets, resp.Target) {
+					t.Fatalf("target = %q (match %v), want one of %v", resp.Target, resp.Match, tc.Targets)
+				}
+				if resp.URI != tc.URI {
+					t.Fatalf("uri = %q, want %q", resp.URI, tc.URI)
+				}
+				seen[resp.Target] = true
+			}
+			if len(seen) != len(tc.Targets) {
+				t.Fatalf("selected %v, want all of %v", seen, tc.Targets)
+			}
+		})
+	}
+}
+
+func TestFindLocation(t *testing.T) {
+	locations := []db.Location{
+		{Path: "/"},
+		{Path: "/api/"},
+		{Modifier: db.LocationModifierExact, Path: "/api/health"},
+		{Modifier: db.LocationModifierPrefixPriority, Path: "/static/"},
+		{Modifier: db.LocationModifierRegex, Path: `\.php$`},
+		{Modifier: db.LocationModifierRegexCaseless, Path: `\.(JPG|PNG)$`},
+		{Modifier: db.LocationModifierRegex, Path: `^/users/(?<id>[0-9]+)$`},
+		{Modifier: db.LocationModifierRegex, Path: `^/users/`},
+	}
+	rule := db.Rule{ID: "rule", ServerName: "a.example.com"}
+	if err := rule.SetLocations(locations); err != nil {
+		t.Fatal(err)
+	}
+	compiled := compileRule(rule, nil)
+	tests := []struct {
+		path     string
+		want     int
+		captures map[string]string
+	}{
+		{"/api/health", 2, nil},    // 精确匹配
+		{"/api/health/x", 1, nil},  // 精确匹配要求完全相同
+		{"/api/users", 1, nil},     // 最长前缀
+		{"/other", 0, nil},         // 只有 "/" 匹配
+		{"/static/a.php", 3, nil},  // "^~" 命中后不再检查正则
+		{"/api/index.php", 4, nil}, // 正则优先于普通前缀
+		{"/img/a.png", 5, nil},     // "~*" 不区分大小写
+		{"/img/a.PNG", 5, nil},     // "~*" 不区分大小写
+		{"/users/42", 6, map[string]string{"id": "42"}},
+		{"/users/42.php", 4, nil}, // 正则按声明顺序
+		{"/users/me", 7, nil},     // 命名捕获的正则未命中时继续检查后面的正则
+	}
+	for _, tt := range tests {
+		got, captures, ok := compiled.findLocation(tt.path)
+		if !ok || got != tt.want {
+			t.Errorf("findLocation(%q) = %d, %v, want %d", tt.path, got, ok, tt.want)
+			continue
+		}
+		if len(captures) != len(tt.captures) {
+			t.Errorf("findLocation(%q) captures = %v, want %v", tt.path, captures, tt.captures)
+			continue
+		}
+		for name, value := range tt.captures {
+			if captures[name] != value {
+				t.Errorf("findLocation(%q) captures = %v, want %v", tt.path, captures, tt.captures)
+			}
+		}
+	}
+
+	// 没有 "/" 时未命中任何 location
+	rule.SetLocations(locations[1:])
+	if got, _, ok := compileRule(rule, nil).findLocation("/other"); ok {
+		t.Errorf("findLocation(%q) = %d, want no match", "/other", got)
+	}
+}
+
+func TestSelectUpstreamConditionGroups(t *testing.T) {
+	upstreams := []db.Upstream{
+		{Target: "http://beta:80", Headers: db.MatchConditions{{Name: "X-Beta", Value: "1"}}, Weight: 5},
+		{Target: "http://a:80", Weight: 1},
+		{Target: "http://beta2:80", Headers: db.MatchConditions{{Name: "x-beta", Operator: db.MatchOperatorEquals, Value: "1"}}},
+		{Target: "http://b:80"},
+		{Target: "http://c:80", Weight: 1},
+	}
+	rule := db.Rule{ID: "rule", ServerName: "a.example.com"}
+	if err := rule.SetLocations([]db.Location{{Path: "/", Upstreams: upstreams}}); err != nil {
+		t.Fatal(err)
+	}
+	location := &compileRule(rule, nil).locations[0]
+	h := &Handler{}
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    []int
+	}{
+		// 条件相同的上游（名称大小写和默认操作符不影响）属于同一组，组内只在设置了权重的上游中选择
+		{"beta group", map[string]string{"X-Beta": "1"}, []int{0}},
+		// 无条件的上游属于另一组，不受条件组权重影响
+		{"default group", nil, []int{1, 4}},
+	}
+	for _, tt := range tests {
+		seen := make(map[int]bool)
+		for range 200 {
+			i, _, ok := h.selectUpstream(&RouteRequest{Path: "/", Headers: tt.headers}, location)
+			if !ok || !slices.Contains(tt.want, i) {
+				t.Fatalf("%s: selected %d, want one of %v", tt.name, i, tt.want)
+			}
+			seen[i] = true
+		}
+		if len(seen) != len(tt.want) {
+			t.Errorf("%s: selected %v, want all of %v", tt.name, seen, tt.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// server_name 类型
+const (
+	serverNameExact            = "exact"             // example.com
+	serverNameLeadingWildcard  = "leading_wildcard"  // *.example.com 或 .example.com
+	serverNameTrailingWildcard = "trailing_wildcard" // mail.*
+	serverNameRegex            = "regex"             // ~^(?<tenant>.+)\.example\.com$
+)
+
+// serverNameType 判断 server_name 的类型
+func serverNameType(name string) string {
+	switch {
+	case strings.HasPrefix(name, "~"):
+		return serverNameRegex
+	case strings.HasPrefix(name, "*.") || strings.HasPrefix(name, "."):
+		return serverNameLeadingWildcard
+	case strings.HasSuffix(name, ".*"):
+		return serverNameTrailingWildcard
+	}
+	return serverNameExact
+}
+
+// compileServerName 编译正则 server_name，与 nginx 一致不区分大小写
+func compileServerName(name string) (*regexp.Regexp, error) {
+	return regexp.Compile("(?i)" + strings.TrimPrefix(name, "~"))
+}
+
+// regexCaptures 执行正则匹配并返回命名捕获
+func regexCaptures(re *regexp.Regexp, s string) (map[string]string, bool) {
+	match := re.FindStringSubmatch(s)
+	if match == nil {
+		return nil, false
+	}
+	captures := make(map[string]string)
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			captures[name] = match[i]
+		}
+	}
+	return captures, true
+}
+
+// validateServerName 验证 server_name 的格式
+func validateServerName(name string) error {
+	if name == "" {
+		return fmt.Errorf("server_name is required")
+	}
+	switch serverNameType(name) {
+	case serverNameRegex:
+		if strings.ContainsAny(name, "\r\n") {
+			return fmt.Errorf("server_name regex must not contain line breaks")
+		}
+		if _, err := compileServerName(name); err != nil {
+			return fmt.Errorf("invalid server_name regex: %w", err)
+		}
+		return nil
+	case serverNameLeadingWildcard:
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "*"), ".")
+	case serverNameTrailingWildcard:
+		name = strings.TrimSuffix(name, ".*")
+	}
+	// nginx 只允许 "*" 出现在名称的开头或结尾，且紧邻 "."
+	if name == "" || strings.ContainsAny(name, "* \t;{}") {
+		return fmt.Errorf("invalid server_name '%s': '*' is only allowed as '*.example.com' or 'example.*'", name)
+	}
+	return nil
+}
+
+// serverNameAliases 返回与 server_name 冲突的等价名称（统一为小写）
+// .example.com 等价于 example.com 加 *.example.com
+func serverNameAliases(name string) []string {
+	if serverNameType(name) == serverNameRegex {
+		return []string{name}
+	}
+	name = strings.ToLower(name)
+	if strings.HasPrefix(name, ".") {
+		return []string{name, name[1:], "*" + name}
+	}
+	if serverNameType(name) == serverNameExact {
+		return []string{name, "." + name}
+	}
+	if strings.HasPrefix(name, "*.") {
+		return []string{name, name[1:]}
+	}
+	return []string{name}
+}
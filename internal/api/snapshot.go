@@ -0,0 +1,26 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetRouteSnapshot 获取路由快照（供 OpenResty 本地路由模式定时同步）
+// 查询参数 since 与当前版本一致时返回 304，避免重复下发
+func (h *Handler) GetRouteSnapshot(c *gin.Context) {
+	if since := c.Query("since"); since != "" && since == strconv.FormatInt(h.snapshots.Version(), 10) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	data, version, err := h.snapshots.Get()
+	if err != nil {
+		log.Printf("Failed to build routing snapshot: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("X-Snapshot-Version", strconv.FormatInt(version, 10))
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"nginx-proxy/internal/db"
+)
+
+// 路由结果的复用范围，OpenResty 在路由服务不可用且规则为 stale 模式时按此范围复用缓存的结果
+const (
+	staleScopeLocation = "location" // 同一 host 下命中该 location 的请求均可复用
+	staleScopePath     = "path"     // 仅同一 host 下相同路径的请求可复用
+)
+
+// staleScope 计算路由结果的复用范围
+// 带请求条件的 upstream 和依赖请求头的目标地址不可复用，避免把只对部分请求开放的后端提供给其他请求；
+// 依赖路径的结果（路径重写、location 正则捕获）只能按路径复用
+func staleScope(upstream db.Upstream, locationCaptures map[string]string, uri string) string {
+	if upstream.HasConditions() {
+		return ""
+	}
+	for _, match := range targetPlaceholder.FindAllStringSubmatch(upstream.Target, -1) {
+		if strings.HasPrefix(match[1], "header.") {
+			return ""
+		}
+		if _, ok := locationCaptures[match[1]]; ok {
+			return staleScopePath
+		}
+	}
+	if uri != "" {
+		return staleScopePath
+	}
+	return staleScopeLocation
+}
+
+// validateFailMode 验证路由服务不可用时的处理方式
+func validateFailMode(mode string, staleTTL int) error {
+	switch mode {
+	case "", db.FailModeClosed, db.FailModeStale:
+	default:
+		return fmt.Errorf("invalid fail_mode '%s': must be %s or %s", mode, db.FailModeClosed, db.FailModeStale)
+	}
+	if staleTTL < 0 || staleTTL > db.MaxStaleTTL {
+		return fmt.Errorf("stale_ttl must be between 0 and %d seconds", db.MaxStaleTTL)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"nginx-proxy/internal/db"
+)
+
+// stickyKey 计算会话保持使用的哈希键
+// issued_cookie 模式下请求未携带 Cookie 时会生成新值，并返回需要下发的 Cookie
+// 指定的请求头或 Cookie 缺失时退化为按客户端 IP 哈希
+func (h *Handler) stickyKey(req *RouteRequest, sticky *db.StickyConfig) (string, *http.Cookie) {
+	switch sticky.Mode {
+	case db.StickyModeHeader:
+		for name, value := range req.Headers {
+			if strings.EqualFold(name, sticky.Key) && value != "" {
+				return value, nil
+			}
+		}
+	case db.StickyModeCookie:
+		if value := req.Cookies[sticky.Key]; value != "" {
+			return value, nil
+		}
+	case db.StickyModeIssuedCookie:
+		name := sticky.CookieName()
+		if value := req.Cookies[name]; value != "" {
+			return value, nil
+		}
+		value := uuid.New().String()
+		return value, &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     "/",
+			MaxAge:   sticky.MaxAge,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		}
+	}
+	return req.RemoteAddr, nil
+}
+
+// selectSticky 使用加权最高随机权重（rendezvous）哈希从候选上游中选择一个
+// 每个上游的得分只取决于键和自身的 Target，增删一个上游只会影响原本落在它上面的那部分键
+func selectSticky(key string, upstreams []db.Upstream, candidates []int) int {
+	best := candidates[0]
+	bestScore := math.Inf(-1)
+	for _, i := range candidates {
+		weight := upstreams[i].Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		score := float64(weight) / -math.Log(stickyHash(key, upstreams[i].Target))
+		if score > bestScore {
+			best = i
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// stickyHash 将键和上游 Target 哈希到 (0, 1) 区间
+// 使用 MD5 的前 4 字节，便于在 OpenResty 中用 ngx.md5 得到相同结果
+func stickyHash(key, target string) float64 {
+	sum := md5.Sum([]byte(key + "\x00" + target))
+	return (float64(binary.BigEndian.Uint32(sum[:4])) + 0.5) / (1 << 32)
+}
+
+// validateSticky 验证会话保持配置
+func validateSticky(sticky *db.StickyConfig) error {
+	if sticky == nil {
+		return nil
+	}
+	switch sticky.Mode {
+	case db.StickyModeIP:
+	case db.StickyModeHeader, db.StickyModeCookie:
+		if sticky.Key == "" {
+			return fmt.Errorf("sticky mode '%s' requires a key", sticky.Mode)
+		}
+	case db.StickyModeIssuedCookie:
+		cookie := http.Cookie{Name: sticky.CookieName(), Value: "x"}
+		if err := cookie.Valid(); err != nil {
+			return fmt.Errorf("invalid sticky cookie: %w", err)
+		}
+		if sticky.MaxAge < 0 {
+			return fmt.Errorf("sticky max_age must not be negative")
+		}
+	default:
+		return fmt.Errorf("unsupported sticky mode '%s'", sticky.Mode)
+	}
+	return nil
+}
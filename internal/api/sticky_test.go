@@ -0,0 +1,59 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+
+	"nginx-proxy/internal/db"
+)
+
+func TestSelectSticky(t *testing.T) {
+	upstreams := []db.Upstream{
+		{Target: "http://a:80"},
+		{Target: "http://b:80"},
+		{Target: "http://c:80"},
+	}
+	weighted := []db.Upstream{
+		{Target: "http://a:80", Weight: 1},
+		{Target: "http://b:80", Weight: 9},
+		{Target: "http://c:80"},
+	}
+	// 期望结果与 OpenResty 本地路由的 select_sticky 一致
+	tests := []struct {
+		key        string
+		upstreams  []db.Upstream
+		candidates []int
+		want       int
+	}{
+		{"user-42", upstreams, []int{0, 1, 2}, 1},
+		{"203.0.113.9", upstreams, []int{0, 1, 2}, 2},
+		{"alice", upstreams, []int{0, 1, 2}, 0},
+		{"bob", upstreams, []int{0, 1, 2}, 1},
+		{"k1", upstreams, []int{0, 1, 2}, 2},
+		{"alice", weighted, []int{0, 1}, 1},
+		{"alice", upstreams, []int{1, 2}, 1}, // 只在候选中选择
+		{"user-42", upstreams, []int{2}, 2},
+	}
+	for _, tt := range tests {
+		if got := selectSticky(tt.key, tt.upstreams, tt.candidates); got != tt.want {
+			t.Errorf("selectSticky(%q, %v) = %d, want %d", tt.key, tt.candidates, got, tt.want)
+		}
+	}
+}
+
+func TestSelectStickyStability(t *testing.T) {
+	upstreams := []db.Upstream{
+		{Target: "http://a:80"},
+		{Target: "http://b:80"},
+		{Target: "http://c:80"},
+	}
+	// 移除一个上游时，只有原本落在它上面的键需要重新分配
+	for i := range 1000 {
+		key := fmt.Sprintf("key-%d", i)
+		before := selectSticky(key, upstreams, []int{0, 1, 2})
+		after := selectSticky(key, upstreams, []int{0, 1})
+		if before != 2 && after != before {
+			t.Fatalf("%s moved from %d to %d", key, before, after)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"nginx-proxy/internal/db"
+)
+
+// targetPlaceholder 上游 Target 中的占位符
+// {name} 引用 server_name 或 location 正则的命名捕获，{header.X-Name} 引用请求头
+var targetPlaceholder = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*|header\.[A-Za-z0-9_-]+)\}`)
+
+// safeTargetValue 允许替换进 Target 的值，避免通过捕获或请求头注入其他主机、路径或用户信息
+var safeTargetValue = regexp.MustCompile(`^[A-Za-z0-9._~-]+$`)
+
+// hasPlaceholders 检查 Target 是否包含占位符
+func hasPlaceholders(target string) bool {
+	return targetPlaceholder.MatchString(target)
+}
+
+// expandTarget 展开 Target 中的占位符，并校验展开后的 URL
+func expandTarget(target string, captures map[string]string, headers map[string]string) (string, error) {
+	if !hasPlaceholders(target) {
+		return target, nil
+	}
+	var expandErr error
+	expanded := targetPlaceholder.ReplaceAllStringFunc(target, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		var value string
+		var ok bool
+		if headerName, isHeader := strings.CutPrefix(name, "header."); isHeader {
+			for key, v := range headers {
+				if strings.EqualFold(key, headerName) {
+					value, ok = v, true
+					break
+				}
+			}
+		} else {
+			value, ok = captures[name]
+		}
+		if !ok || value == "" {
+			if expandErr == nil {
+				expandErr = fmt.Errorf("no value for placeholder %s", placeholder)
+			}
+			return ""
+		}
+		if !safeTargetValue.MatchString(value) {
+			if expandErr == nil {
+				expandErr = fmt.Errorf("unsafe value %q for placeholder %s", value, placeholder)
+			}
+			return ""
+		}
+		return value
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+	if err := validateTargetURL(expanded); err != nil {
+		return "", err
+	}
+	return expanded, nil
+}
+
+// validateTargetURL 验证上游地址为 http(s)://host[:port][/path] 格式
+func validateTargetURL(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid target '%s': %w", target, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid target '%s': scheme must be http or https", target)
+	}
+	if u.Host == "" || u.Hostname() == "" {
+		return fmt.Errorf("invalid target '%s': host is required", target)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid target '%s': user info, query and fragment are not allowed", target)
+	}
+	return nil
+}
+
+// validateTarget 验证上游 Target，占位符必须能由 server_name 或 location 的命名捕获提供
+func validateTarget(target string, serverName string, location db.Location) error {
+	if target == "" {
+		return fmt.Errorf("target is required")
+	}
+	if !hasPlaceholders(target) {
+		return validateTargetURL(target)
+	}
+	names := make(map[string]bool)
+	if serverNameType(serverName) == serverNameRegex {
+		if re, err := compileServerName(serverName); err == nil {
+			for _, name := range re.SubexpNames() {
+				names[name] = true
+			}
+		}
+	}
+	if location.IsRegex() {
+		if re, err := location.CompileRegex(); err == nil {
+			for _, name := range re.SubexpNames() {
+				names[name] = true
+			}
+		}
+	}
+	for _, match := range targetPlaceholder.FindAllStringSubmatch(target, -1) {
+		if !strings.HasPrefix(match[1], "header.") && !names[match[1]] {
+			return fmt.Errorf("target '%s': placeholder {%s} is not a named capture of server_name or location", target, match[1])
+		}
+	}
+	// 用示例值替换占位符后校验 URL 格式
+	return validateTargetURL(targetPlaceholder.ReplaceAllString(target, "x"))
+}
@@ -0,0 +1,35 @@
+package api
+
+import "testing"
+
+func TestExpandTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		captures map[string]string
+		headers  map[string]string
+		want     string // 为空时期望返回错误
+	}{
+		{"no placeholders", "http://backend:8080", nil, nil, "http://backend:8080"},
+		{"capture", "http://{tenant}.svc.internal:8080", map[string]string{"tenant": "acme"}, nil, "http://acme.svc.internal:8080"},
+		{"multiple captures", "http://{app}-{env}:80/base", map[string]string{"app": "shop", "env": "prod"}, nil, "http://shop-prod:80/base"},
+		{"header is case-insensitive", "http://{header.X-Region}.backend:80", nil, map[string]string{"x-region": "eu"}, "http://eu.backend:80"},
+		{"missing capture", "http://{tenant}.svc:80", nil, nil, ""},
+		{"empty header", "http://{header.X-Region}.backend:80", nil, map[string]string{"x-region": ""}, ""},
+		{"host injection", "http://{tenant}.svc:80", map[string]string{"tenant": "evil.com/x#"}, nil, ""},
+		{"userinfo injection", "http://{header.X-Region}.backend:80", nil, map[string]string{"X-Region": "a@b"}, ""},
+		{"port injection", "http://{tenant}:80", map[string]string{"tenant": "a:1"}, nil, ""},
+	}
+	for _, tt := range tests {
+		got, err := expandTarget(tt.target, tt.captures, tt.headers)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: expandTarget(%q) = %q, want error", tt.name, tt.target, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: expandTarget(%q) = %q, %v, want %q", tt.name, tt.target, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package core
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 熔断器状态
+const (
+	CircuitClosed   = "closed"    // 正常转发
+	CircuitOpen     = "open"      // 已熔断，路由时跳过该上游
+	CircuitHalfOpen = "half_open" // 冷却时间已过，每个冷却周期只放行一个探测请求，由其结果决定恢复或再次熔断
+)
+
+// ProxyOutcome OpenResty 上报的一次代理结果
+type ProxyOutcome struct {
+	RuleID   string `json:"rule_id,omitempty"` // 请求命中的规则
+	Location int    `json:"location"`          // 请求命中的 location 下标
+	Target   string `json:"target"`            // 转发的目标地址（$backend）
+	Status   int    `json:"status"`            // 上游响应状态码，未收到响应时为 0
+	Error    string `json:"error,omitempty"`   // 未收到响应的原因：connect、timeout
+}
+
+// Failed 判断代理结果是否视为失败：连接错误、超时或 5xx
+func (o ProxyOutcome) Failed() bool {
+	return o.Error != "" || o.Status == 0 || o.Status >= 500
+}
+
+// CircuitState 单个上游 Target 的熔断状态
+type CircuitState struct {
+	Target              string     `json:"target"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastStatus          int        `json:"last_status,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"` // 最近一次熔断的时间
+	RetryAt             *time.Time `json:"retry_at,omitempty"`  // 进入半开状态的时间
+}
+
+// circuit 熔断器内部状态，openedAt 为零值表示未熔断
+type circuit struct {
+	failures   int
+	lastStatus int
+	lastError  string
+	openedAt   time.Time
+}
+
+// probeWindow 已熔断 Target 的半开探测窗口
+// next 为下一次允许探测的时间（UnixNano），放行探测请求时通过 CAS 推后一个冷却周期，保证每个周期只有一个探测请求
+type probeWindow struct {
+	halfOpenAt time.Time
+	next       atomic.Int64
+}
+
+// CircuitBreaker 根据实际流量的代理结果对上游 Target 熔断
+// 只记录出现过失败的 Target，恢复正常后移除，避免状态无限增长
+type CircuitBreaker struct {
+	config   CircuitBreakerConfig
+	mu       sync.Mutex
+	circuits map[string]*circuit
+	open     atomic.Pointer[map[string]*probeWindow] // 已熔断 Target 的探测窗口，状态变化后整体替换
+	onChange []func()
+}
+
+// NewCircuitBreaker 创建熔断器
+func NewCircuitBreaker(config CircuitBreakerConfig) *CircuitBreaker {
+	breaker := &CircuitBreaker{
+		config:   config,
+		circuits: make(map[string]*circuit),
+	}
+	breaker.open.Store(&map[string]*probeWindow{})
+	return breaker
+}
+
+// OnChange 注册熔断或恢复时的回调
+func (b *CircuitBreaker) OnChange(fn func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onChange = append(b.onChange, fn)
+}
+
+// Allow 检查是否可以向 Target 转发请求：未熔断时直接放行；
+// 半开状态下只放行一个探测请求，并将下一次探测时间推后一个冷却周期，探测结果上报前其他请求仍被拒绝
+func (b *CircuitBreaker) Allow(target string) bool {
+	window, ok := (*b.open.Load())[target]
+	if !ok {
+		return true
+	}
+	now := time.Now().UnixNano()
+	next := window.next.Load()
+	if now < next {
+		return false
+	}
+	return window.next.CompareAndSwap(next, now+int64(b.Cooldown()))
+}
+
+// Available 检查 Target 当前是否可以接收请求（未熔断，或半开状态下本周期的探测名额未被占用），不占用探测名额
+func (b *CircuitBreaker) Available(target string) bool {
+	window, ok := (*b.open.Load())[target]
+	return !ok || time.Now().UnixNano() >= window.next.Load()
+}
+
+// State 返回 Target 当前的熔断状态
+func (b *CircuitBreaker) State(target string) string {
+	window, ok := (*b.open.Load())[target]
+	switch {
+	case !ok:
+		return CircuitClosed
+	case time.Now().Before(window.halfOpenAt):
+		return CircuitOpen
+	default:
+		return CircuitHalfOpen
+	}
+}
+
+// OpenCircuits 返回已熔断的 Target 及其进入半开状态的时间
+func (b *CircuitBreaker) OpenCircuits() map[string]time.Time {
+	open := *b.open.Load()
+	result := make(map[string]time.Time, len(open))
+	for target, window := range open {
+		result[target] = window.halfOpenAt
+	}
+	return result
+}
+
+// Cooldown 返回熔断后进入半开状态的冷却时间，也是半开状态下的探测间隔
+func (b *CircuitBreaker) Cooldown() time.Duration {
+	return time.Duration(b.config.Cooldown) * time.Second
+}
+
+// Report 处理一批代理结果，同一 Target 的结果按顺序生效
+func (b *CircuitBreaker) Report(outcomes []ProxyOutcome) {
+	cooldown := b.Cooldown()
+	now := time.Now()
+	b.mu.Lock()
+	changed := false
+	for _, outcome := range outcomes {
+		if outcome.Target == "" {
+			continue
+		}
+		c, ok := b.circuits[outcome.Target]
+		if !outcome.Failed() {
+			if !ok {
+				continue
+			}
+			// 冷却期内的成功结果来自熔断前已发出的请求，不改变状态
+			if !c.openedAt.IsZero() && now.Before(c.openedAt.Add(cooldown)) {
+				continue
+			}
+			if !c.openedAt.IsZero() {
+				log.Printf("Circuit for %s closed", outcome.Target)
+				changed = true
+			}
+			delete(b.circuits, outcome.Target)
+			continue
+		}
+		if !ok {
+			c = &circuit{}
+			b.circuits[outcome.Target] = c
+		}
+		c.failures++
+		c.lastStatus, c.lastError = outcome.Status, outcome.Error
+		switch {
+		case c.openedAt.IsZero():
+			if c.failures >= b.config.FailureThreshold {
+				c.openedAt = now
+				changed = true
+				log.Printf("Circuit for %s opened after %d consecutive failures", outcome.Target, c.failures)
+			}
+		case !now.Before(c.openedAt.Add(cooldown)):
+			// 半开状态下探测失败，重新熔断
+			c.openedAt = now
+			changed = true
+			log.Printf("Circuit for %s re-opened", outcome.Target)
+		}
+	}
+	var callbacks []func()
+	if changed {
+		// 半开时间未变的 Target 沿用原探测窗口，避免其他 Target 的状态变化重置探测名额
+		previous := *b.open.Load()
+		open := make(map[string]*probeWindow)
+		for target, c := range b.circuits {
+			if c.openedAt.IsZero() {
+				continue
+			}
+			halfOpenAt := c.openedAt.Add(cooldown)
+			if window, ok := previous[target]; ok && window.halfOpenAt.Equal(halfOpenAt) {
+				open[target] = window
+				continue
+			}
+			window := &probeWindow{halfOpenAt: halfOpenAt}
+			window.next.Store(halfOpenAt.UnixNano())
+			open[target] = window
+		}
+		b.open.Store(&open)
+		callbacks = b.onChange
+	}
+	b.mu.Unlock()
+
+	for _, fn := range callbacks {
+		fn()
+	}
+}
+
+// Status 返回所有出现过失败的 Target 的熔断状态
+func (b *CircuitBreaker) Status() []CircuitState {
+	cooldown := b.Cooldown()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	result := make([]CircuitState, 0, len(b.circuits))
+	for target, c := range b.circuits {
+		state := CircuitState{
+			Target:              target,
+			State:               CircuitClosed,
+			ConsecutiveFailures: c.failures,
+			LastStatus:          c.lastStatus,
+			LastError:           c.lastError,
+		}
+		if !c.openedAt.IsZero() {
+			openedAt, retryAt := c.openedAt, c.openedAt.Add(cooldown)
+			state.OpenedAt, state.RetryAt = &openedAt, &retryAt
+			state.State = CircuitOpen
+			if !time.Now().Before(retryAt) {
+				state.State = CircuitHalfOpen
+			}
+		}
+		result = append(result, state)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Target < result[j].Target
+	})
+	return result
+}
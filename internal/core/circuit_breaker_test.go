@@ -0,0 +1,149 @@
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testTarget = "http://a:80"
+
+// failures 返回 n 个失败的代理结果
+func failures(n int) []ProxyOutcome {
+	outcomes := make([]ProxyOutcome, n)
+	for i := range outcomes {
+		outcomes[i] = ProxyOutcome{Target: testTarget, Status: 502, Error: "connect"}
+	}
+	return outcomes
+}
+
+// expireCooldown 把 Target 的熔断时间提前一个冷却周期，使其进入半开状态
+func expireCooldown(t *testing.T, b *CircuitBreaker, target string) {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[target]
+	if !ok || c.openedAt.IsZero() {
+		t.Fatalf("%s is not open", target)
+	}
+	c.openedAt = c.openedAt.Add(-b.Cooldown())
+	window := &probeWindow{halfOpenAt: c.openedAt.Add(b.Cooldown())}
+	window.next.Store(window.halfOpenAt.UnixNano())
+	open := map[string]*probeWindow{target: window}
+	b.open.Store(&open)
+}
+
+// expireProbeWindow 结束当前的探测周期，使下一个探测请求可以放行
+func expireProbeWindow(b *CircuitBreaker, target string) {
+	window := (*b.open.Load())[target]
+	window.next.Add(-int64(b.Cooldown()))
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	b := NewCircuitBreaker(CircuitBreakerConfig{Enabled: true, FailureThreshold: 3, Cooldown: 30})
+	var changes atomic.Int32
+	b.OnChange(func() { changes.Add(1) })
+
+	// closed：失败次数未达到阈值，成功结果清除失败计数
+	b.Report(failures(2))
+	b.Report([]ProxyOutcome{{Target: testTarget, Status: 200}})
+	b.Report(failures(2))
+	if state := b.State(testTarget); state != CircuitClosed || !b.Allow(testTarget) {
+		t.Fatalf("state = %s, want closed", state)
+	}
+	if changes.Load() != 0 {
+		t.Fatalf("changes = %d, want 0", changes.Load())
+	}
+
+	// closed -> open
+	b.Report(failures(1))
+	if state := b.State(testTarget); state != CircuitOpen {
+		t.Fatalf("state = %s, want open", state)
+	}
+	if b.Allow(testTarget) || b.Available(testTarget) {
+		t.Fatal("open circuit allowed a request")
+	}
+	// 冷却期内的成功结果来自熔断前已发出的请求，不恢复
+	b.Report([]ProxyOutcome{{Target: testTarget, Status: 200}})
+	if state := b.State(testTarget); state != CircuitOpen {
+		t.Fatalf("state = %s, want open", state)
+	}
+
+	// open -> half-open，探测失败后重新熔断
+	expireCooldown(t, b, testTarget)
+	if state := b.State(testTarget); state != CircuitHalfOpen {
+		t.Fatalf("state = %s, want half_open", state)
+	}
+	if !b.Allow(testTarget) {
+		t.Fatal("half-open circuit rejected the probe")
+	}
+	b.Report(failures(1))
+	if state := b.State(testTarget); state != CircuitOpen {
+		t.Fatalf("state = %s, want open after failed probe", state)
+	}
+
+	// open -> half-open，探测成功后恢复
+	expireCooldown(t, b, testTarget)
+	if !b.Allow(testTarget) {
+		t.Fatal("half-open circuit rejected the probe")
+	}
+	b.Report([]ProxyOutcome{{Target: testTarget, Status: 200}})
+	if state := b.State(testTarget); state != CircuitClosed || !b.Allow(testTarget) || !b.Allow(testTarget) {
+		t.Fatalf("state = %s, want closed", state)
+	}
+	if len(b.Status()) != 0 {
+		t.Fatalf("status = %v, want recovered target removed", b.Status())
+	}
+	// 熔断、重新熔断、恢复
+	if changes.Load() != 3 {
+		t.Fatalf("changes = %d, want 3", changes.Load())
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	b := NewCircuitBreaker(CircuitBreakerConfig{Enabled: true, FailureThreshold: 1, Cooldown: 30})
+	b.Report(failures(1))
+	expireCooldown(t, b, testTarget)
+	if !b.Available(testTarget) {
+		t.Fatal("half-open circuit unavailable before the probe")
+	}
+
+	// 并发请求中只有一个被放行
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b.Allow(testTarget) {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed.Load() != 1 {
+		t.Fatalf("allowed %d probes, want 1", allowed.Load())
+	}
+	if b.Available(testTarget) {
+		t.Fatal("probe slot still available after it was claimed")
+	}
+
+	// 探测结果未上报时，下一个周期再放行一个探测请求
+	expireProbeWindow(b, testTarget)
+	if !b.Allow(testTarget) || b.Allow(testTarget) {
+		t.Fatal("want exactly one probe in the next window")
+	}
+
+	// 其他 Target 的状态变化不重置探测名额
+	b.Report([]ProxyOutcome{{Target: "http://b:80", Error: "timeout"}})
+	if b.Allow(testTarget) {
+		t.Fatal("probe slot reset by another target")
+	}
+	if b.State("http://b:80") != CircuitOpen {
+		t.Fatalf("state = %s, want open", b.State("http://b:80"))
+	}
+	if got := time.Until(b.OpenCircuits()[testTarget]); got > 0 {
+		t.Fatalf("half-open time moved to %v from now", got)
+	}
+}
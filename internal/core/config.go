@@ -7,12 +7,16 @@ import (
 )
 
 type Config struct {
-	Server       ServerConfig       `json:"server"`
-	Database     DatabaseConfig     `json:"database"`
-	Nginx        NginxConfig        `json:"nginx"`
-	SSL          SSLConfig          `json:"ssl"`
-	TencentCloud TencentCloudConfig `json:"tencent_cloud"`
-	Cloudflare   CloudflareConfig   `json:"cloudflare"`
+	Server         ServerConfig         `json:"server"`
+	Database       DatabaseConfig       `json:"database"`
+	Nginx          NginxConfig          `json:"nginx"`
+	SSL            SSLConfig            `json:"ssl"`
+	TencentCloud   TencentCloudConfig   `json:"tencent_cloud"`
+	Cloudflare     CloudflareConfig     `json:"cloudflare"`
+	Routing        RoutingConfig        `json:"routing"`
+	HealthCheck    HealthCheckConfig    `json:"health_check"`
+	CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker"`
+	Rollout        RolloutConfig        `json:"rollout"`
 }
 
 type CloudflareConfig struct {
@@ -31,9 +35,38 @@ type DatabaseConfig struct {
 }
 
 type NginxConfig struct {
-	Path        string `json:"path"`
-	ConfigDir   string `json:"config_dir"`
-	TemplateDir string `json:"template_dir"`
+	Path             string `json:"path"`
+	ConfigDir        string `json:"config_dir"`
+	TemplateDir      string `json:"template_dir"`
+	ACMEChallengeDir string `json:"acme_challenge_dir"` // 强制 HTTPS 时 ACME HTTP-01 验证文件的根目录
+}
+
+// RoutingConfig 路由配置
+type RoutingConfig struct {
+	Mode string `json:"mode"` // remote: 每个请求调用路由接口; local: OpenResty 同步路由快照后本地判断
+}
+
+// HealthCheckConfig 上游健康检查配置
+type HealthCheckConfig struct {
+	Enabled            bool   `json:"enabled"`
+	Path               string `json:"path"`                // 探测路径，拼接在上游 Target 之后
+	Interval           int    `json:"interval"`            // 探测间隔（秒）
+	Timeout            int    `json:"timeout"`             // 单次探测超时（秒）
+	HealthyThreshold   int    `json:"healthy_threshold"`   // 连续成功多少次后恢复为健康
+	UnhealthyThreshold int    `json:"unhealthy_threshold"` // 连续失败多少次后标记为不健康
+}
+
+// CircuitBreakerConfig 被动健康检查（熔断）配置，OpenResty 上报实际请求的代理结果
+type CircuitBreakerConfig struct {
+	Enabled          bool `json:"enabled"`
+	FailureThreshold int  `json:"failure_threshold"` // 连续失败多少次后熔断
+	Cooldown         int  `json:"cooldown"`          // 熔断后多久进入半开状态（秒）
+}
+
+// RolloutConfig 灰度发布控制器配置，错误率依赖 OpenResty 上报的代理结果
+type RolloutConfig struct {
+	Enabled  bool `json:"enabled"`
+	Interval int  `json:"interval"` // 检查间隔（秒）
 }
 
 type SSLConfig struct {
@@ -77,6 +110,36 @@ func LoadConfig(configPath string) (*Config, error) {
 	if config.Nginx.TemplateDir == "" {
 		config.Nginx.TemplateDir = "./template"
 	}
+	if config.Nginx.ACMEChallengeDir == "" {
+		config.Nginx.ACMEChallengeDir = "/var/www/acme"
+	}
+	if config.Routing.Mode == "" {
+		config.Routing.Mode = RoutingModeRemote
+	}
+	if config.HealthCheck.Path == "" {
+		config.HealthCheck.Path = "/"
+	}
+	if config.HealthCheck.Interval <= 0 {
+		config.HealthCheck.Interval = 10
+	}
+	if config.HealthCheck.Timeout <= 0 {
+		config.HealthCheck.Timeout = 3
+	}
+	if config.HealthCheck.HealthyThreshold <= 0 {
+		config.HealthCheck.HealthyThreshold = 2
+	}
+	if config.HealthCheck.UnhealthyThreshold <= 0 {
+		config.HealthCheck.UnhealthyThreshold = 3
+	}
+	if config.CircuitBreaker.FailureThreshold <= 0 {
+		config.CircuitBreaker.FailureThreshold = 5
+	}
+	if config.CircuitBreaker.Cooldown <= 0 {
+		config.CircuitBreaker.Cooldown = 30
+	}
+	if config.Rollout.Interval <= 0 {
+		config.Rollout.Interval = 10
+	}
 	if config.TencentCloud.Region == "" {
 		config.TencentCloud.Region = "ap-beijing"
 	}
@@ -0,0 +1,62 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"gorm.io/gorm"
+
+	"nginx-proxy/internal/db"
+)
+
+// CredentialIndex 凭据库的内存索引，供配置生成写入 htpasswd 文件
+type CredentialIndex struct {
+	db     *gorm.DB
+	mu     sync.RWMutex
+	stores map[string][]db.Credential
+}
+
+// NewCredentialIndex 创建凭据库索引
+func NewCredentialIndex(database *gorm.DB) *CredentialIndex {
+	return &CredentialIndex{
+		db:     database,
+		stores: make(map[string][]db.Credential),
+	}
+}
+
+// Reload 从数据库重新加载所有凭据库，加载完成后整体替换索引
+func (i *CredentialIndex) Reload() error {
+	var stores []db.CredentialStore
+	if err := i.db.Find(&stores).Error; err != nil {
+		return fmt.Errorf("failed to load credential stores: %w", err)
+	}
+	names := make(map[string]string, len(stores))
+	index := make(map[string][]db.Credential, len(stores))
+	for _, store := range stores {
+		names[store.ID] = store.Name
+		index[store.Name] = []db.Credential{}
+	}
+	var credentials []db.Credential
+	if err := i.db.Order("username").Find(&credentials).Error; err != nil {
+		return fmt.Errorf("failed to load credentials: %w", err)
+	}
+	for _, credential := range credentials {
+		if name, ok := names[credential.StoreID]; ok {
+			index[name] = append(index[name], credential)
+		}
+	}
+	i.mu.Lock()
+	i.stores = index
+	i.mu.Unlock()
+	log.Printf("Credential index reloaded: %d store(s), %d user(s)", len(stores), len(credentials))
+	return nil
+}
+
+// Users 返回凭据库中的用户，按用户名排序，调用方不能修改返回值
+func (i *CredentialIndex) Users(store string) ([]db.Credential, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	users, ok := i.stores[store]
+	return users, ok
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"text/template"
 
 	"nginx-proxy/internal/db"
@@ -11,24 +12,56 @@ import (
 
 // Generator 负责生成 Nginx 配置文件
 type Generator struct {
-	templateDir string
-	configDir   string
-	template    *template.Template
+	templateDir      string
+	configDir        string
+	routingMode      string
+	reportOutcomes   bool             // 是否在 log 阶段上报代理结果（启用熔断或灰度发布时）
+	acmeChallengeDir string           // 强制 HTTPS 的重定向服务器中 ACME 验证文件的根目录
+	ipSets           *IPSetIndex      // 展开 allow/deny 中引用的 IP 集合
+	credentials      *CredentialIndex // 写入基本认证引用的凭据库
+	template         *template.Template
 }
 
-// NewGenerator 创建新的配置生成器
-func NewGenerator(templateDir, configDir string) *Generator {
+// NewGenerator 创建新的配置生成器，routingMode 决定 location 中路由判断的方式，
+// reportOutcomes 为 true 时每个 location 在 log 阶段向管理服务上报代理结果
+func NewGenerator(templateDir, configDir, routingMode string, reportOutcomes bool, acmeChallengeDir string) *Generator {
 	return &Generator{
-		templateDir: templateDir,
-		configDir:   configDir,
+		templateDir:      templateDir,
+		configDir:        configDir,
+		routingMode:      routingMode,
+		reportOutcomes:   reportOutcomes,
+		acmeChallengeDir: acmeChallengeDir,
 	}
 }
 
+// SetIPSets 设置展开 allow/deny 中 IP 集合引用所用的索引
+func (g *Generator) SetIPSets(index *IPSetIndex) {
+	g.ipSets = index
+}
+
+// SetCredentials 设置写入 htpasswd 文件所用的凭据库索引
+func (g *Generator) SetCredentials(index *CredentialIndex) {
+	g.credentials = index
+}
+
+// templateFuncs 模板中可用的自定义函数
+var templateFuncs = template.FuncMap{
+	"nginxQuote": nginxQuote,
+	"hasPrefix":  strings.HasPrefix,
+}
+
+// nginxQuote 将字符串转为 nginx 配置中的双引号字符串（用于正则等包含特殊字符的参数）
+func nginxQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
 // loadTemplate 加载模板文件
 func (g *Generator) loadTemplate() error {
 	templatePath := filepath.Join(g.templateDir, "nginx.conf.tpl")
 	// 创建带有自定义函数的模板
-	tmpl := template.New("nginx.conf.tpl")
+	tmpl := template.New("nginx.conf.tpl").Funcs(templateFuncs)
 	tmpl, err := tmpl.ParseFiles(templatePath)
 	if err != nil {
 		return fmt.Errorf("failed to parse template: %w", err)
@@ -39,6 +72,16 @@ func (g *Generator) loadTemplate() error {
 
 // GenerateConfig 生成单个规则的配置文件
 func (g *Generator) GenerateConfig(rule *db.Rule) error {
+	sets := db.IPSets{}
+	if g.ipSets != nil {
+		sets = g.ipSets.All()
+	}
+	return g.GenerateConfigWithIPSets(rule, sets)
+}
+
+// GenerateConfigWithIPSets 使用指定的 IP 集合展开 allow/deny 并生成配置文件，
+// 供 IP 集合修改在保存前验证引用它的规则
+func (g *Generator) GenerateConfigWithIPSets(rule *db.Rule, ipSets db.IPSets) error {
 	if g.template == nil {
 		if err := g.loadTemplate(); err != nil {
 			return err
@@ -49,10 +92,16 @@ func (g *Generator) GenerateConfig(rule *db.Rule) error {
 		return fmt.Errorf("failed to create config directory: %w", err)
 	}
 	// 转换为模板数据
-	templateData, err := g.prepareTemplateData(rule)
+	templateData, err := g.prepareTemplateData(rule, ipSets)
 	if err != nil {
 		return fmt.Errorf("failed to prepare template data: %w", err)
 	}
+	// 先写入引用的凭据库，nginx 加载配置时文件已存在
+	for store := range templateData.HtpasswdFiles {
+		if err := g.WriteHtpasswd(store); err != nil {
+			return err
+		}
+	}
 	// 生成配置文件路径
 	configPath := filepath.Join(g.configDir, fmt.Sprintf("%s.conf", rule.ID))
 	// 创建配置文件
@@ -74,6 +123,41 @@ func (g *Generator) GenerateConfig(rule *db.Rule) error {
 	return nil
 }
 
+// ConfigBackup 规则配置文件修改前的内容，用于 nginx 配置测试失败时恢复
+type ConfigBackup struct {
+	path   string
+	data   []byte
+	exists bool
+}
+
+// BackupConfig 备份规则当前的配置文件
+func (g *Generator) BackupConfig(ruleID string) (*ConfigBackup, error) {
+	backup := &ConfigBackup{path: filepath.Join(g.configDir, fmt.Sprintf("%s.conf", ruleID))}
+	data, err := os.ReadFile(backup.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return backup, nil
+		}
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	backup.data, backup.exists = data, true
+	return backup, nil
+}
+
+// Restore 恢复备份的配置文件，备份时文件不存在则删除
+func (b *ConfigBackup) Restore() error {
+	if !b.exists {
+		if err := os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete config file: %w", err)
+		}
+		return nil
+	}
+	if err := os.WriteFile(b.path, b.data, 0644); err != nil {
+		return fmt.Errorf("failed to restore config file: %w", err)
+	}
+	return nil
+}
+
 // DeleteConfig 删除配置文件
 func (g *Generator) DeleteConfig(ruleID string) error {
 	configPath := filepath.Join(g.configDir, fmt.Sprintf("%s.conf", ruleID))
@@ -83,8 +167,67 @@ func (g *Generator) DeleteConfig(ruleID string) error {
 	return nil
 }
 
+// HtpasswdPath 返回凭据库的 htpasswd 文件路径，文件与规则配置位于同一目录，
+// 扩展名不是 .conf，不会被 nginx 当作配置加载
+func (g *Generator) HtpasswdPath(store string) string {
+	path := filepath.Join(g.configDir, store+".htpasswd")
+	// auth_basic_user_file 的相对路径按 nginx 的前缀目录解析，需要使用绝对路径
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// WriteHtpasswd 将凭据库的用户写入 htpasswd 文件
+// nginx 在每次认证时读取文件，更新用户后不需要重新加载
+func (g *Generator) WriteHtpasswd(store string) error {
+	var users []db.Credential
+	if g.credentials != nil {
+		var ok bool
+		if users, ok = g.credentials.Users(store); !ok {
+			return fmt.Errorf("credential store '%s' does not exist", store)
+		}
+	}
+	var content strings.Builder
+	for _, user := range users {
+		content.WriteString(user.Username + ":" + user.PasswordHash + "\n")
+	}
+	if err := os.MkdirAll(g.configDir, 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	// 先写临时文件再重命名，避免 nginx 读到写了一半的文件
+	tmp, err := os.CreateTemp(g.configDir, ".htpasswd-*")
+	if err != nil {
+		return fmt.Errorf("failed to create htpasswd file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(content.String()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write htpasswd file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write htpasswd file: %w", err)
+	}
+	// nginx worker 以非 root 用户运行，需要能读取该文件
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to set htpasswd file mode: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), g.HtpasswdPath(store)); err != nil {
+		return fmt.Errorf("failed to replace htpasswd file: %w", err)
+	}
+	return nil
+}
+
+// DeleteHtpasswd 删除凭据库的 htpasswd 文件
+func (g *Generator) DeleteHtpasswd(store string) error {
+	if err := os.Remove(g.HtpasswdPath(store)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete htpasswd file: %w", err)
+	}
+	return nil
+}
+
 // prepareTemplateData 准备模板数据
-func (g *Generator) prepareTemplateData(rule *db.Rule) (*TemplateData, error) {
+func (g *Generator) prepareTemplateData(rule *db.Rule, ipSets db.IPSets) (*TemplateData, error) {
 	ports, err := rule.GetListenPorts()
 	if err != nil {
 		return nil, err
@@ -93,20 +236,96 @@ func (g *Generator) prepareTemplateData(rule *db.Rule) (*TemplateData, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := expandAccessLists(locations, ipSets); err != nil {
+		return nil, err
+	}
+	htpasswdFiles, err := g.htpasswdFiles(locations)
+	if err != nil {
+		return nil, err
+	}
+	plan := db.PlanListens(ports, rule.HasSSL(), rule.ForceHTTPS)
 	return &TemplateData{
-		ServerName:  rule.ServerName,
-		ListenPorts: ports,
-		SSLCert:     rule.SSLCert,
-		SSLKey:      rule.SSLKey,
-		Locations:   locations,
+		RuleID:           rule.ID,
+		RoutingMode:      g.routingMode,
+		ReportOutcomes:   g.reportOutcomes,
+		ServerName:       rule.ServerName,
+		ListenPorts:      plan.Listens,
+		SSLCert:          rule.SSLCert,
+		SSLKey:           rule.SSLKey,
+		RedirectPorts:    plan.RedirectPorts,
+		HTTPSPort:        plan.HTTPSPort,
+		ACMEChallengeDir: g.acmeChallengeDir,
+		Locations:        locations,
+		HtpasswdFiles:    htpasswdFiles,
+		FailMode:         rule.FailMode,
+		StaleTTL:         rule.GetStaleTTL(),
 	}, nil
 }
 
+// expandAccessLists 将 allow/deny 中的 IP 集合引用展开为网段，引用的集合不存在时返回错误
+func expandAccessLists(locations []db.Location, sets db.IPSets) error {
+	for i := range locations {
+		location := &locations[i]
+		var err error
+		if location.Allow, err = sets.Expand(location.Allow); err != nil {
+			return fmt.Errorf("location %s allow: %w", location.Path, err)
+		}
+		if location.Deny, err = sets.Expand(location.Deny); err != nil {
+			return fmt.Errorf("location %s deny: %w", location.Path, err)
+		}
+	}
+	return nil
+}
+
+// htpasswdFiles 返回 locations 引用的凭据库到 htpasswd 文件路径的映射，引用的凭据库不存在时返回错误
+func (g *Generator) htpasswdFiles(locations []db.Location) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, location := range locations {
+		if location.BasicAuth == nil {
+			continue
+		}
+		store := location.BasicAuth.Store
+		if g.credentials != nil {
+			if _, ok := g.credentials.Users(store); !ok {
+				return nil, fmt.Errorf("location %s basic_auth: credential store '%s' does not exist", location.Path, store)
+			}
+		}
+		files[store] = g.HtpasswdPath(store)
+	}
+	return files, nil
+}
+
 // TemplateData 模板数据结构
 type TemplateData struct {
-	ServerName  string        `json:"server_name"`
-	ListenPorts []int         `json:"listen_ports"`
-	SSLCert     string        `json:"ssl_cert"`
-	SSLKey      string        `json:"ssl_key"`
-	Locations   []db.Location `json:"locations"`
+	RuleID           string            `json:"rule_id"`
+	RoutingMode      string            `json:"routing_mode"`
+	ReportOutcomes   bool              `json:"report_outcomes"`
+	ServerName       string            `json:"server_name"`
+	ListenPorts      []db.ListenEntry  `json:"listen_ports"` // 主 server 的监听项，协议已确定
+	SSLCert          string            `json:"ssl_cert"`
+	SSLKey           string            `json:"ssl_key"`
+	RedirectPorts    []int             `json:"redirect_ports"` // 强制 HTTPS 时重定向服务器的明文端口
+	HTTPSPort        int               `json:"https_port"`     // 重定向的目标端口
+	ACMEChallengeDir string            `json:"acme_challenge_dir"`
+	Locations        []db.Location     `json:"locations"`
+	HtpasswdFiles    map[string]string `json:"htpasswd_files"` // 凭据库名称到 htpasswd 文件路径
+	FailMode         string            `json:"fail_mode"`
+	StaleTTL         int               `json:"stale_ttl"`
+}
+
+// HTTP2 是否有监听项使用 http2 协议
+// nginx 1.25.1 起 listen 的 http2 参数已弃用，改用 server 级别的 http2 指令，对该 server 的所有监听项生效
+func (d *TemplateData) HTTP2() bool {
+	for _, listen := range d.ListenPorts {
+		if listen.Protocol == db.ListenProtocolHTTP2 {
+			return true
+		}
+	}
+	return false
+}
+
+// MirrorVar 返回 location 流量镜像采样使用的 nginx 变量名（不含 $）
+// 变量由 http 级别的 split_clients 定义，需要在所有规则中唯一
+func (d *TemplateData) MirrorVar(index int) string {
+	return fmt.Sprintf("nginx_proxy_mirror_%s_%d", strings.ReplaceAll(d.RuleID, "-", "_"), index)
 }
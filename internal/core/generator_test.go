@@ -0,0 +1,204 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	_ "modernc.org/sqlite"
+
+	"nginx-proxy/internal/db"
+)
+
+// newTestDB 创建内存数据库并迁移指定的表
+func newTestDB(t *testing.T, models ...interface{}) *gorm.DB {
+	t.Helper()
+	database, err := gorm.Open(sqlite.Dialector{DriverName: "sqlite", DSN: ":memory:"},
+		&gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 每个连接是独立的内存数据库
+	sqlDB, err := database.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	if err := database.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+	return database
+}
+
+// generateTestConfig 生成规则的配置文件并返回其内容
+func generateTestConfig(t *testing.T, g *Generator, rule *db.Rule) string {
+	t.Helper()
+	if err := g.GenerateConfig(rule); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(g.configDir, rule.ID+".conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestExpandAccessLists(t *testing.T) {
+	sets := db.IPSets{
+		"office": {"10.0.0.0/8", "192.168.1.0/24"},
+		"vpn":    {"2001:db8::/32"},
+	}
+	locations := []db.Location{
+		{Path: "/", Allow: []string{"@office", "203.0.113.7/32", "@vpn"}, Deny: []string{"@vpn"}},
+		{Path: "/public"},
+	}
+	if err := expandAccessLists(locations, sets); err != nil {
+		t.Fatal(err)
+	}
+	wantAllow := []string{"10.0.0.0/8", "192.168.1.0/24", "203.0.113.7/32", "2001:db8::/32"}
+	if strings.Join(locations[0].Allow, ",") != strings.Join(wantAllow, ",") {
+		t.Errorf("allow = %v, want %v", locations[0].Allow, wantAllow)
+	}
+	if strings.Join(locations[0].Deny, ",") != "2001:db8::/32" {
+		t.Errorf("deny = %v, want [2001:db8::/32]", locations[0].Deny)
+	}
+	if locations[1].Allow != nil || locations[1].Deny != nil {
+		t.Errorf("location without access list = %v, %v", locations[1].Allow, locations[1].Deny)
+	}
+
+	// 引用的集合不存在
+	err := expandAccessLists([]db.Location{{Path: "/", Deny: []string{"@missing"}}}, sets)
+	if err == nil || !strings.Contains(err.Error(), "ip set 'missing' does not exist") {
+		t.Errorf("err = %v, want missing ip set", err)
+	}
+}
+
+func TestGenerateConfigIPSets(t *testing.T) {
+	database := newTestDB(t, &db.IPSet{})
+	office := db.IPSet{ID: "s1", Name: "office"}
+	if err := office.SetCIDRs([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Create(&office).Error; err != nil {
+		t.Fatal(err)
+	}
+	index := NewIPSetIndex(database)
+	if err := index.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	g := NewGenerator(filepath.Join("..", "..", "template"), t.TempDir(), RoutingModeRemote, false, "")
+	g.SetIPSets(index)
+	rule := &db.Rule{ID: "r1", ServerName: "a.example.com"}
+	if err := rule.SetLocations([]db.Location{{Path: "/", Allow: []string{"@office"}, Upstreams: []db.Upstream{{Target: "http://a:80"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	config := generateTestConfig(t, g, rule)
+	if !strings.Contains(config, "allow 10.0.0.0/8;") || strings.Contains(config, "@office") {
+		t.Fatalf("config does not expand @office:\n%s", config)
+	}
+
+	// 使用修改后的网段生成配置，供修改集合前验证引用它的规则
+	if err := g.GenerateConfigWithIPSets(rule, db.IPSets{"office": {"172.16.0.0/12"}}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(g.configDir, "r1.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "allow 172.16.0.0/12;") {
+		t.Fatalf("config does not use the given ip sets:\n%s", data)
+	}
+	if err := g.GenerateConfigWithIPSets(rule, db.IPSets{}); err == nil {
+		t.Fatal("expected error for a missing ip set")
+	}
+}
+
+func TestGenerateConfigBasicAuth(t *testing.T) {
+	database := newTestDB(t, &db.CredentialStore{}, &db.Credential{})
+	stores := []db.CredentialStore{{ID: "s1", Name: "staff"}, {ID: "s2", Name: "empty"}}
+	if err := database.Create(&stores).Error; err != nil {
+		t.Fatal(err)
+	}
+	credentials := []db.Credential{
+		{StoreID: "s1", Username: "bob", PasswordHash: "$2a$10$bob"},
+		{StoreID: "s1", Username: "alice", PasswordHash: "$2a$10$alice"},
+	}
+	if err := database.Create(&credentials).Error; err != nil {
+		t.Fatal(err)
+	}
+	index := NewCredentialIndex(database)
+	if err := index.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	g := NewGenerator(filepath.Join("..", "..", "template"), t.TempDir(), RoutingModeRemote, false, "")
+	g.SetCredentials(index)
+	rule := &db.Rule{ID: "r1", ServerName: "a.example.com"}
+	if err := rule.SetLocations([]db.Location{
+		{Path: "/admin", BasicAuth: &db.BasicAuthConfig{Store: "staff", Realm: `Staff "only"`}, Upstreams: []db.Upstream{{Target: "http://a:80"}}},
+		{Path: "/status", BasicAuth: &db.BasicAuthConfig{Store: "empty"}, Upstreams: []db.Upstream{{Target: "http://a:80"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	config := generateTestConfig(t, g, rule)
+
+	// htpasswd 文件按用户名排序，使用绝对路径引用
+	staff := g.HtpasswdPath("staff")
+	if !filepath.IsAbs(staff) {
+		t.Fatalf("htpasswd path %s is not absolute", staff)
+	}
+	data, err := os.ReadFile(staff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "alice:$2a$10$alice\nbob:$2a$10$bob\n"; string(data) != want {
+		t.Errorf("staff htpasswd = %q, want %q", data, want)
+	}
+	if data, err := os.ReadFile(g.HtpasswdPath("empty")); err != nil || len(data) != 0 {
+		t.Errorf("empty htpasswd = %q, %v", data, err)
+	}
+	for _, want := range []string{
+		`auth_basic "Staff \"only\"";`,
+		`auth_basic_user_file "` + staff + `";`,
+		`auth_basic "` + db.DefaultBasicAuthRealm + `";`,
+		`auth_basic_user_file "` + g.HtpasswdPath("empty") + `";`,
+	} {
+		if !strings.Contains(config, want) {
+			t.Errorf("config does not contain %s:\n%s", want, config)
+		}
+	}
+
+	// 引用的凭据库不存在
+	if err := rule.SetLocations([]db.Location{{Path: "/", BasicAuth: &db.BasicAuthConfig{Store: "missing"}, Upstreams: []db.Upstream{{Target: "http://a:80"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.GenerateConfig(rule); err == nil || !strings.Contains(err.Error(), "credential store 'missing' does not exist") {
+		t.Errorf("err = %v, want missing credential store", err)
+	}
+}
+
+func TestGenerateConfigHTTP2(t *testing.T) {
+	g := NewGenerator(filepath.Join("..", "..", "template"), t.TempDir(), RoutingModeRemote, false, "")
+	rule := &db.Rule{ID: "r1", ServerName: "a.example.com", SSLCert: "/certs/a.crt", SSLKey: "/certs/a.key"}
+	if err := rule.SetLocations([]db.Location{{Path: "/", Upstreams: []db.Upstream{{Target: "http://a:80"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	rule.ListenPorts = `[{"port":443,"protocol":"http2"},{"port":8443,"protocol":"ssl"}]`
+	config := generateTestConfig(t, g, rule)
+	for _, want := range []string{"listen 443 ssl;\n", "listen 8443 ssl;\n", "http2 on;\n"} {
+		if !strings.Contains(config, want) {
+			t.Errorf("config does not contain %q:\n%s", want, config)
+		}
+	}
+	if strings.Contains(config, " http2;") {
+		t.Errorf("config uses the deprecated listen http2 parameter:\n%s", config)
+	}
+
+	rule.ListenPorts = `[{"port":443,"protocol":"ssl"}]`
+	if config := generateTestConfig(t, g, rule); strings.Contains(config, "http2") {
+		t.Errorf("config enables http2 without an http2 listen port:\n%s", config)
+	}
+}
@@ -0,0 +1,275 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+
+	"nginx-proxy/internal/db"
+)
+
+// healthCheckWorkers 同时探测的目标数量上限
+const healthCheckWorkers = 16
+
+// HealthChecker 上游健康检查服务
+// 定时探测所有规则中出现的上游 Target（包含占位符的 Target 无法探测，视为健康）
+type HealthChecker struct {
+	db       *gorm.DB
+	config   HealthCheckConfig
+	client   *http.Client
+	mu       sync.Mutex
+	states   map[string]*TargetHealth
+	down     atomic.Pointer[map[string]bool] // 不健康的 Target，每轮探测后整体替换
+	onChange []func()
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// TargetHealth 单个上游 Target 的健康状态
+type TargetHealth struct {
+	Target               string     `json:"target"`
+	Healthy              bool       `json:"healthy"`
+	ConsecutiveSuccesses int        `json:"consecutive_successes"`
+	ConsecutiveFailures  int        `json:"consecutive_failures"`
+	LastStatus           int        `json:"last_status,omitempty"` // 最近一次探测的 HTTP 状态码
+	LastError            string     `json:"last_error,omitempty"`  // 最近一次探测失败的原因
+	LastCheck            time.Time  `json:"last_check"`
+	LastChange           *time.Time `json:"last_change,omitempty"` // 最近一次状态变化的时间
+}
+
+// NewHealthChecker 创建健康检查服务
+func NewHealthChecker(database *gorm.DB, config HealthCheckConfig) *HealthChecker {
+	ctx, cancel := context.WithCancel(context.Background())
+	checker := &HealthChecker{
+		db:     database,
+		config: config,
+		client: &http.Client{
+			Timeout: time.Duration(config.Timeout) * time.Second,
+			// 不跟随重定向，3xx 直接视为健康
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		states: make(map[string]*TargetHealth),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	checker.down.Store(&map[string]bool{})
+	return checker
+}
+
+// OnChange 注册健康状态变化时的回调
+func (c *HealthChecker) OnChange(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onChange = append(c.onChange, fn)
+}
+
+// Start 启动健康检查服务
+func (c *HealthChecker) Start() {
+	interval := time.Duration(c.config.Interval) * time.Second
+	log.Printf("Start health checker interval: %v, path: %s", interval, c.config.Path)
+	// 立即执行一次检查
+	go c.check()
+	// 启动定时器
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.check()
+			case <-c.ctx.Done():
+				log.Println("health checker stopped")
+				return
+			}
+		}
+	}()
+}
+
+// Stop 停止健康检查服务
+func (c *HealthChecker) Stop() {
+	log.Println("stopping health checker...")
+	c.cancel()
+}
+
+// IsHealthy 检查 Target 是否健康，未探测过的 Target 视为健康
+func (c *HealthChecker) IsHealthy(target string) bool {
+	return !(*c.down.Load())[target]
+}
+
+// Unhealthy 返回所有不健康的 Target
+func (c *HealthChecker) Unhealthy() []string {
+	down := *c.down.Load()
+	targets := make([]string, 0, len(down))
+	for target := range down {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// Status 返回所有 Target 的健康状态
+func (c *HealthChecker) Status() []TargetHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make([]TargetHealth, 0, len(c.states))
+	for _, state := range c.states {
+		result = append(result, *state)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Target < result[j].Target
+	})
+	return result
+}
+
+// check 探测所有 Target 并更新健康状态
+func (c *HealthChecker) check() {
+	targets, err := c.loadTargets()
+	if err != nil {
+		log.Printf("load health check targets error: %v", err)
+		return
+	}
+	type probeResult struct {
+		target string
+		status int
+		err    error
+	}
+	results := make(chan probeResult, len(targets))
+	sem := make(chan struct{}, healthCheckWorkers)
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(target string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			status, err := c.probe(target)
+			results <- probeResult{target: target, status: status, err: err}
+		}(target)
+	}
+	wg.Wait()
+	close(results)
+
+	c.mu.Lock()
+	changed := false
+	current := make(map[string]bool, len(targets))
+	for result := range results {
+		current[result.target] = true
+		state, ok := c.states[result.target]
+		if !ok {
+			state = &TargetHealth{Target: result.target, Healthy: true}
+			c.states[result.target] = state
+		}
+		if c.update(state, result.status, result.err) {
+			changed = true
+		}
+	}
+	// 移除已不再使用的 Target
+	for target, state := range c.states {
+		if !current[target] {
+			delete(c.states, target)
+			if !state.Healthy {
+				changed = true
+			}
+		}
+	}
+	down := make(map[string]bool)
+	for target, state := range c.states {
+		if !state.Healthy {
+			down[target] = true
+		}
+	}
+	c.down.Store(&down)
+	callbacks := c.onChange
+	c.mu.Unlock()
+
+	if changed {
+		for _, fn := range callbacks {
+			fn()
+		}
+	}
+}
+
+// update 根据探测结果更新状态，返回健康状态是否发生变化
+func (c *HealthChecker) update(state *TargetHealth, status int, err error) bool {
+	state.LastCheck = time.Now()
+	state.LastStatus = status
+	if err == nil {
+		state.LastError = ""
+		state.ConsecutiveSuccesses++
+		state.ConsecutiveFailures = 0
+		if !state.Healthy && state.ConsecutiveSuccesses >= c.config.HealthyThreshold {
+			state.Healthy = true
+			changedAt := state.LastCheck
+			state.LastChange = &changedAt
+			log.Printf("Upstream %s is healthy again", state.Target)
+			return true
+		}
+		return false
+	}
+	state.LastError = err.Error()
+	state.ConsecutiveFailures++
+	state.ConsecutiveSuccesses = 0
+	if state.Healthy && state.ConsecutiveFailures >= c.config.UnhealthyThreshold {
+		state.Healthy = false
+		changedAt := state.LastCheck
+		state.LastChange = &changedAt
+		log.Printf("Upstream %s is unhealthy: %v", state.Target, err)
+		return true
+	}
+	return false
+}
+
+// probe 探测单个 Target，2xx 和 3xx 视为成功
+func (c *HealthChecker) probe(target string) (int, error) {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, strings.TrimSuffix(target, "/")+c.config.Path, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", "nginx-proxy-health-checker")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// loadTargets 加载所有规则中出现的上游 Target（去重，跳过包含占位符的 Target）
+func (c *HealthChecker) loadTargets() ([]string, error) {
+	var rules []db.Rule
+	if err := c.db.Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var targets []string
+	for _, rule := range rules {
+		locations, err := rule.GetLocations()
+		if err != nil {
+			continue
+		}
+		for _, location := range locations {
+			for _, upstream := range location.Upstreams {
+				target := upstream.Target
+				if target == "" || strings.Contains(target, "{") || seen[target] {
+					continue
+				}
+				seen[target] = true
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets, nil
+}
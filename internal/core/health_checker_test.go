@@ -0,0 +1,86 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"nginx-proxy/internal/db"
+)
+
+func TestHealthCheckerTransitions(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	database := newTestDB(t, &db.Rule{})
+	rule := db.Rule{ID: "r1", ServerName: "a.example.com"}
+	if err := rule.SetLocations([]db.Location{{Path: "/", Upstreams: []db.Upstream{
+		{Target: server.URL},
+		{Target: "http://{host}:80"}, // 包含占位符，不探测
+	}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Create(&rule).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	checker := NewHealthChecker(database, HealthCheckConfig{
+		Enabled: true, Path: "/healthz", Interval: 10, Timeout: 2, HealthyThreshold: 2, UnhealthyThreshold: 2,
+	})
+	var changes atomic.Int32
+	checker.OnChange(func() { changes.Add(1) })
+	check := func(wantHealthy bool, wantChanges int32) {
+		t.Helper()
+		checker.check()
+		if checker.IsHealthy(server.URL) != wantHealthy {
+			t.Fatalf("healthy = %v, want %v (status %v)", !wantHealthy, wantHealthy, checker.Status())
+		}
+		if changes.Load() != wantChanges {
+			t.Fatalf("changes = %d, want %d", changes.Load(), wantChanges)
+		}
+	}
+
+	check(true, 0)
+	if targets := checker.Status(); len(targets) != 1 || targets[0].Target != server.URL {
+		t.Fatalf("status = %v, want only %s", targets, server.URL)
+	}
+	// 连续失败达到阈值后标记为不健康
+	status.Store(http.StatusServiceUnavailable)
+	check(true, 0)
+	check(false, 1)
+	if got := checker.Unhealthy(); len(got) != 1 || got[0] != server.URL {
+		t.Fatalf("unhealthy = %v", got)
+	}
+	if state := checker.Status()[0]; state.LastStatus != http.StatusServiceUnavailable || state.LastError == "" || state.LastChange == nil {
+		t.Fatalf("state = %+v", state)
+	}
+	// 连续成功达到阈值后恢复，中间的失败重新计数
+	status.Store(http.StatusOK)
+	check(false, 1)
+	status.Store(http.StatusInternalServerError)
+	check(false, 1)
+	status.Store(http.StatusFound) // 3xx 视为健康
+	check(false, 1)
+	check(true, 2)
+
+	// 规则不再使用的不健康 Target 被移除
+	status.Store(http.StatusServiceUnavailable)
+	check(true, 2)
+	check(false, 3)
+	if err := database.Delete(&rule).Error; err != nil {
+		t.Fatal(err)
+	}
+	check(true, 4)
+	if len(checker.Status()) != 0 {
+		t.Fatalf("status = %v, want empty", checker.Status())
+	}
+}
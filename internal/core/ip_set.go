@@ -0,0 +1,64 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"gorm.io/gorm"
+
+	"nginx-proxy/internal/db"
+)
+
+// IPSetIndex IP 集合的内存索引，供路由判断和配置生成展开规则中的集合引用
+type IPSetIndex struct {
+	db   *gorm.DB
+	mu   sync.RWMutex
+	sets db.IPSets
+}
+
+// NewIPSetIndex 创建 IP 集合索引
+func NewIPSetIndex(database *gorm.DB) *IPSetIndex {
+	return &IPSetIndex{
+		db:   database,
+		sets: make(db.IPSets),
+	}
+}
+
+// Reload 从数据库重新加载所有 IP 集合，加载完成后整体替换索引
+func (i *IPSetIndex) Reload() error {
+	sets, err := loadIPSets(i.db)
+	if err != nil {
+		return err
+	}
+	i.mu.Lock()
+	i.sets = sets
+	i.mu.Unlock()
+	log.Printf("IP set index reloaded: %d set(s)", len(sets))
+	return nil
+}
+
+// All 返回当前所有 IP 集合，调用方不能修改返回值
+func (i *IPSetIndex) All() db.IPSets {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.sets
+}
+
+// loadIPSets 从数据库加载所有 IP 集合
+func loadIPSets(database *gorm.DB) (db.IPSets, error) {
+	var records []db.IPSet
+	if err := database.Find(&records).Error; err != nil {
+		return nil, fmt.Errorf("failed to load ip sets: %w", err)
+	}
+	sets := make(db.IPSets, len(records))
+	for _, record := range records {
+		cidrs, err := record.GetCIDRs()
+		if err != nil {
+			log.Printf("Warning: Failed to parse ip set %s: %v", record.Name, err)
+			continue
+		}
+		sets[record.Name] = cidrs
+	}
+	return sets, nil
+}
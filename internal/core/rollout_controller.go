@@ -0,0 +1,589 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"nginx-proxy/internal/db"
+)
+
+// 灰度发布的默认参数
+const (
+	DefaultRolloutInitialPercent = 5
+	DefaultRolloutStepPercent    = 10
+	DefaultRolloutStepInterval   = 600
+	DefaultRolloutMaxErrorRate   = 0.05
+	DefaultRolloutMinRequests    = 20
+)
+
+// minRolloutStepInterval 每一步的最短持续时间（秒）
+const minRolloutStepInterval = 10
+
+// rolloutWeightScale 流量比例乘以该值作为上游权重，使按比例分配后的权重仍为整数
+const rolloutWeightScale = db.MaxUpstreamWeight / 100
+
+var (
+	ErrRolloutNotFound = errors.New("rollout not found")
+	ErrRolloutConflict = errors.New("location already has an active rollout")
+	ErrRolloutState    = errors.New("invalid rollout status")
+	ErrInvalidRollout  = errors.New("invalid rollout")
+	ErrRolloutApply    = errors.New("failed to apply rollout weights")
+)
+
+// RuleUpdater 修改规则的 locations，并按与规则更新接口相同的流程生效（由 API 层提供）
+type RuleUpdater func(ruleID string, mutate func(locations []db.Location) error) error
+
+// RolloutSpec 创建灰度发布的参数，为空的字段使用默认值
+// MaxErrorRate 和 MinRequests 为 0 时有意义（出现错误即中止、不要求最少请求数），未设置时才使用默认值
+type RolloutSpec struct {
+	RuleID         string   `json:"rule_id"`
+	LocationIndex  int      `json:"location_index"`
+	Target         string   `json:"target"` // 新目标，必须是该 location 中某个上游的 Target（服务器池为 scheme://pool-名称）
+	InitialPercent int      `json:"initial_percent"`
+	StepPercent    int      `json:"step_percent"`
+	StepInterval   int      `json:"step_interval"` // 秒
+	MaxErrorRate   *float64 `json:"max_error_rate"`
+	MinRequests    *int     `json:"min_requests"`
+}
+
+// rolloutKey 灰度发布统计代理结果的范围：同一目标可能同时被其他规则或 location 使用，只统计发布的 location 的结果
+type rolloutKey struct {
+	ruleID   string
+	location int
+	target   string
+}
+
+// rolloutCounts 新目标在两次检查之间的请求数和错误数
+type rolloutCounts struct {
+	requests int64
+	errors   int64
+}
+
+// RolloutController 灰度发布控制器
+// 定时推进运行中的灰度发布，根据 OpenResty 上报的代理结果统计新目标的错误率，超过阈值时自动回滚
+type RolloutController struct {
+	db       *gorm.DB
+	interval time.Duration
+	updater  RuleUpdater
+	mu       sync.Mutex // 串行化灰度发布的状态变更
+	statsMu  sync.Mutex
+	watched  map[rolloutKey]bool // 运行中的灰度发布的新目标
+	pending  map[rolloutKey]*rolloutCounts
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// NewRolloutController 创建灰度发布控制器
+func NewRolloutController(database *gorm.DB, config RolloutConfig) *RolloutController {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RolloutController{
+		db:       database,
+		interval: time.Duration(config.Interval) * time.Second,
+		watched:  make(map[rolloutKey]bool),
+		pending:  make(map[rolloutKey]*rolloutCounts),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// SetRuleUpdater 设置修改规则权重的方式
+func (c *RolloutController) SetRuleUpdater(updater RuleUpdater) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.updater = updater
+}
+
+// Start 启动灰度发布控制器
+func (c *RolloutController) Start() {
+	log.Printf("Start rollout controller interval: %v", c.interval)
+	c.mu.Lock()
+	c.refreshWatched()
+	c.mu.Unlock()
+	ticker := time.NewTicker(c.interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.check()
+			case <-c.ctx.Done():
+				log.Println("rollout controller stopped")
+				return
+			}
+		}
+	}()
+}
+
+// Stop 停止灰度发布控制器
+func (c *RolloutController) Stop() {
+	log.Println("stopping rollout controller...")
+	c.cancel()
+}
+
+// Observe 统计运行中的灰度发布新目标的代理结果
+func (c *RolloutController) Observe(outcomes []ProxyOutcome) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	for _, outcome := range outcomes {
+		key := rolloutKey{ruleID: outcome.RuleID, location: outcome.Location, target: outcome.Target}
+		if !c.watched[key] {
+			continue
+		}
+		counts, ok := c.pending[key]
+		if !ok {
+			counts = &rolloutCounts{}
+			c.pending[key] = counts
+		}
+		counts.requests++
+		if outcome.Failed() {
+			counts.errors++
+		}
+	}
+}
+
+// List 获取灰度发布列表，ruleID 为空时返回所有规则的
+func (c *RolloutController) List(ruleID string) ([]db.Rollout, error) {
+	query := c.db.Order("created_at desc")
+	if ruleID != "" {
+		query = query.Where("rule_id = ?", ruleID)
+	}
+	var rollouts []db.Rollout
+	if err := query.Find(&rollouts).Error; err != nil {
+		return nil, err
+	}
+	return rollouts, nil
+}
+
+// Get 获取灰度发布
+func (c *RolloutController) Get(id string) (*db.Rollout, error) {
+	var rollout db.Rollout
+	if err := c.db.First(&rollout, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrRolloutNotFound
+		}
+		return nil, err
+	}
+	return &rollout, nil
+}
+
+// Create 创建并开始灰度发布，立即把新目标的流量比例设置为起始比例
+func (c *RolloutController) Create(spec RolloutSpec) (*db.Rollout, error) {
+	if err := normalizeRolloutSpec(&spec); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var active int64
+	if err := c.db.Model(&db.Rollout{}).
+		Where("rule_id = ? AND location_index = ? AND status IN ?", spec.RuleID, spec.LocationIndex,
+			db.ActiveRolloutStatuses).
+		Count(&active).Error; err != nil {
+		return nil, err
+	}
+	if active > 0 {
+		return nil, ErrRolloutConflict
+	}
+	var rule db.Rule
+	if err := c.db.First(&rule, "id = ?", spec.RuleID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: rule not found", ErrInvalidRollout)
+		}
+		return nil, err
+	}
+	locations, err := rule.GetLocations()
+	if err != nil {
+		return nil, err
+	}
+	if spec.LocationIndex < 0 || spec.LocationIndex >= len(locations) {
+		return nil, fmt.Errorf("%w: location index %d out of range", ErrInvalidRollout, spec.LocationIndex)
+	}
+	location := locations[spec.LocationIndex]
+	canary := rolloutUpstreamIndex(location, spec.Target)
+	if canary < 0 {
+		return nil, fmt.Errorf("%w: target '%s' is not an upstream of location '%s'", ErrInvalidRollout, spec.Target, location.Path)
+	}
+	// 权重只在条件相同的上游之间生效，流量只能从与新目标条件相同的上游切出
+	groups := db.ConditionGroups(location.Upstreams)
+	siblings := 0
+	for i := range groups {
+		if i != canary && groups[i] == groups[canary] {
+			siblings++
+		}
+	}
+	if siblings == 0 {
+		return nil, fmt.Errorf("%w: location '%s' needs another upstream with the same conditions as the target to shift traffic from",
+			ErrInvalidRollout, location.Path)
+	}
+	weights := make([]int, len(location.Upstreams))
+	for i, upstream := range location.Upstreams {
+		weights[i] = upstream.Weight
+	}
+	rollout := &db.Rollout{
+		ID:             uuid.New().String(),
+		RuleID:         spec.RuleID,
+		LocationIndex:  spec.LocationIndex,
+		LocationPath:   location.Path,
+		Target:         spec.Target,
+		InitialPercent: spec.InitialPercent,
+		StepPercent:    spec.StepPercent,
+		StepInterval:   spec.StepInterval,
+		MaxErrorRate:   *spec.MaxErrorRate,
+		MinRequests:    *spec.MinRequests,
+		Percent:        spec.InitialPercent,
+		StepStartedAt:  time.Now(),
+		Status:         db.RolloutStatusRunning,
+	}
+	if err := rollout.SetOriginalWeights(weights); err != nil {
+		return nil, err
+	}
+	// 先保存灰度发布再修改权重，保证修改过的权重总能按记录的发布前权重恢复
+	if err := c.db.Create(rollout).Error; err != nil {
+		return nil, err
+	}
+	if err := c.applyPercent(rollout, spec.InitialPercent); err != nil {
+		// 权重未修改，撤销创建的灰度发布
+		if deleteErr := c.db.Delete(rollout).Error; deleteErr != nil {
+			log.Printf("Rollout %s cleanup error: %v", rollout.ID, deleteErr)
+		}
+		return nil, err
+	}
+	if rollout.Percent >= 100 {
+		rollout.Status = db.RolloutStatusCompleted
+		if err := c.db.Save(rollout).Error; err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("Rollout %s started: %s at %d%%", rollout.ID, rollout.Target, rollout.Percent)
+	c.refreshWatched()
+	return rollout, nil
+}
+
+// Pause 暂停灰度发布，保持当前流量比例
+func (c *RolloutController) Pause(id string) (*db.Rollout, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rollout, err := c.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if rollout.Status != db.RolloutStatusRunning {
+		return nil, fmt.Errorf("%w: rollout is %s", ErrRolloutState, rollout.Status)
+	}
+	rollout.Status = db.RolloutStatusPaused
+	rollout.Reason = "paused by user"
+	if err := c.db.Save(rollout).Error; err != nil {
+		return nil, err
+	}
+	c.refreshWatched()
+	return rollout, nil
+}
+
+// Resume 继续暂停的灰度发布，当前比例重新开始计时和统计
+func (c *RolloutController) Resume(id string) (*db.Rollout, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rollout, err := c.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if rollout.Status != db.RolloutStatusPaused {
+		return nil, fmt.Errorf("%w: rollout is %s", ErrRolloutState, rollout.Status)
+	}
+	rollout.Status = db.RolloutStatusRunning
+	rollout.Reason = ""
+	rollout.StepRequests, rollout.StepErrors = 0, 0
+	rollout.StepStartedAt = time.Now()
+	if err := c.db.Save(rollout).Error; err != nil {
+		return nil, err
+	}
+	c.refreshWatched()
+	return rollout, nil
+}
+
+// Abort 中止灰度发布，恢复发布前的权重
+func (c *RolloutController) Abort(id string) (*db.Rollout, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rollout, err := c.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if !rollout.IsActive() {
+		return nil, fmt.Errorf("%w: rollout is %s", ErrRolloutState, rollout.Status)
+	}
+	if err := c.abort(rollout, "aborted by user"); err != nil {
+		return nil, err
+	}
+	c.refreshWatched()
+	return rollout, nil
+}
+
+// Active 获取规则进行中的灰度发布
+func (c *RolloutController) Active(ruleID string) ([]db.Rollout, error) {
+	var rollouts []db.Rollout
+	if err := c.db.Where("rule_id = ? AND status IN ?", ruleID, db.ActiveRolloutStatuses).Find(&rollouts).Error; err != nil {
+		return nil, err
+	}
+	return rollouts, nil
+}
+
+// check 检查所有运行中的灰度发布：错误率超过阈值时回滚，当前步到期时提高流量比例；
+// 重试中止时恢复权重失败的灰度发布
+func (c *RolloutController) check() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var rollouts []db.Rollout
+	if err := c.db.Where("status IN ?", []string{db.RolloutStatusRunning, db.RolloutStatusAborting}).
+		Find(&rollouts).Error; err != nil {
+		log.Printf("load rollouts error: %v", err)
+		return
+	}
+	counts := c.takeCounts()
+	for i := range rollouts {
+		rollout := &rollouts[i]
+		if rollout.Status == db.RolloutStatusAborting {
+			if err := c.abort(rollout, rollout.Reason); err != nil {
+				log.Printf("Rollout %s check error: %v", rollout.ID, err)
+			}
+			continue
+		}
+		if n, ok := counts[rolloutKey{ruleID: rollout.RuleID, location: rollout.LocationIndex, target: rollout.Target}]; ok {
+			rollout.StepRequests += n.requests
+			rollout.StepErrors += n.errors
+		}
+		var err error
+		switch {
+		case rollout.StepRequests > 0 && rollout.StepRequests >= int64(rollout.MinRequests) &&
+			float64(rollout.StepErrors)/float64(rollout.StepRequests) > rollout.MaxErrorRate:
+			err = c.abort(rollout, fmt.Sprintf("error rate %.2f%% (%d/%d) exceeded %.2f%% at %d%%",
+				float64(rollout.StepErrors)*100/float64(rollout.StepRequests), rollout.StepErrors,
+				rollout.StepRequests, rollout.MaxErrorRate*100, rollout.Percent))
+		case time.Since(rollout.StepStartedAt) >= time.Duration(rollout.StepInterval)*time.Second:
+			err = c.advance(rollout)
+		default:
+			err = c.db.Save(rollout).Error
+		}
+		if err != nil {
+			log.Printf("Rollout %s check error: %v", rollout.ID, err)
+		}
+	}
+	c.refreshWatched()
+}
+
+// advance 把新目标的流量比例提高一步，失败时暂停灰度发布等待人工处理
+func (c *RolloutController) advance(rollout *db.Rollout) error {
+	percent := min(rollout.Percent+rollout.StepPercent, 100)
+	if err := c.applyPercent(rollout, percent); err != nil {
+		rollout.Status = db.RolloutStatusPaused
+		rollout.Reason = err.Error()
+		log.Printf("Rollout %s paused: %v", rollout.ID, err)
+		return c.db.Save(rollout).Error
+	}
+	rollout.Percent = percent
+	rollout.StepRequests, rollout.StepErrors = 0, 0
+	rollout.StepStartedAt = time.Now()
+	if percent >= 100 {
+		rollout.Status = db.RolloutStatusCompleted
+		log.Printf("Rollout %s completed: %s receives all traffic", rollout.ID, rollout.Target)
+	} else {
+		log.Printf("Rollout %s advanced: %s at %d%%", rollout.ID, rollout.Target, percent)
+	}
+	return c.db.Save(rollout).Error
+}
+
+// abort 恢复发布前的权重并把灰度发布标记为中止
+// 恢复失败时新目标仍承担当前比例的流量，灰度发布保持为 aborting，每次检查时重试；
+// 规则已被删除时没有需要恢复的权重，直接标记为中止
+func (c *RolloutController) abort(rollout *db.Rollout, reason string) error {
+	rollout.Reason = reason
+	err := c.update(rollout, func(location *db.Location, original []int) {
+		for i := range location.Upstreams {
+			location.Upstreams[i].Weight = original[i]
+		}
+	})
+	if err != nil && c.ruleDeleted(rollout.RuleID) {
+		log.Printf("Rollout %s: rule %s no longer exists", rollout.ID, rollout.RuleID)
+		err = nil
+	}
+	if err != nil {
+		rollout.Status = db.RolloutStatusAborting
+		rollout.LastError = err.Error()
+		log.Printf("Rollout %s abort pending, failed to restore weights: %v", rollout.ID, err)
+		if saveErr := c.db.Save(rollout).Error; saveErr != nil {
+			return saveErr
+		}
+		return err
+	}
+	rollout.Status = db.RolloutStatusAborted
+	rollout.LastError = ""
+	log.Printf("Rollout %s aborted: %s", rollout.ID, reason)
+	return c.db.Save(rollout).Error
+}
+
+// ruleDeleted 判断规则是否已被删除，查询失败时视为仍然存在
+func (c *RolloutController) ruleDeleted(ruleID string) bool {
+	var count int64
+	if err := c.db.Model(&db.Rule{}).Where("id = ?", ruleID).Count(&count).Error; err != nil {
+		log.Printf("check rule %s error: %v", ruleID, err)
+		return false
+	}
+	return count == 0
+}
+
+// applyPercent 按流量比例设置 location 中各上游的权重
+func (c *RolloutController) applyPercent(rollout *db.Rollout, percent int) error {
+	return c.update(rollout, func(location *db.Location, original []int) {
+		weights := rolloutWeights(original, db.ConditionGroups(location.Upstreams), rolloutUpstreamIndex(*location, rollout.Target), percent)
+		for i := range location.Upstreams {
+			location.Upstreams[i].Weight = weights[i]
+		}
+	})
+}
+
+// update 通过 RuleUpdater 修改灰度发布对应 location 的权重
+// location 的路径、上游数量或新目标的位置在发布期间被修改时返回错误
+func (c *RolloutController) update(rollout *db.Rollout, mutate func(location *db.Location, original []int)) error {
+	if c.updater == nil {
+		return fmt.Errorf("%w: rule updater is not configured", ErrRolloutApply)
+	}
+	original, err := rollout.GetOriginalWeights()
+	if err != nil {
+		return err
+	}
+	err = c.updater(rollout.RuleID, func(locations []db.Location) error {
+		if rollout.LocationIndex >= len(locations) {
+			return fmt.Errorf("location %d no longer exists", rollout.LocationIndex)
+		}
+		location := &locations[rollout.LocationIndex]
+		if location.Path != rollout.LocationPath || len(location.Upstreams) != len(original) ||
+			rolloutUpstreamIndex(*location, rollout.Target) < 0 {
+			return fmt.Errorf("location '%s' changed since the rollout started", rollout.LocationPath)
+		}
+		mutate(location, original)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRolloutApply, err)
+	}
+	return nil
+}
+
+// takeCounts 取出并清空两次检查之间的统计
+func (c *RolloutController) takeCounts() map[rolloutKey]*rolloutCounts {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	counts := c.pending
+	c.pending = make(map[rolloutKey]*rolloutCounts)
+	return counts
+}
+
+// refreshWatched 更新需要统计的新目标
+func (c *RolloutController) refreshWatched() {
+	var rollouts []db.Rollout
+	if err := c.db.Select("rule_id", "location_index", "target").Where("status = ?", db.RolloutStatusRunning).
+		Find(&rollouts).Error; err != nil {
+		log.Printf("load rollout targets error: %v", err)
+		return
+	}
+	watched := make(map[rolloutKey]bool, len(rollouts))
+	for _, rollout := range rollouts {
+		watched[rolloutKey{ruleID: rollout.RuleID, location: rollout.LocationIndex, target: rollout.Target}] = true
+	}
+	c.statsMu.Lock()
+	c.watched = watched
+	c.statsMu.Unlock()
+}
+
+// normalizeRolloutSpec 填充默认值并验证灰度发布参数
+func normalizeRolloutSpec(spec *RolloutSpec) error {
+	if spec.RuleID == "" {
+		return fmt.Errorf("%w: rule_id is required", ErrInvalidRollout)
+	}
+	if spec.Target == "" || strings.Contains(spec.Target, "{") {
+		return fmt.Errorf("%w: target is required and must not contain placeholders", ErrInvalidRollout)
+	}
+	if spec.InitialPercent == 0 {
+		spec.InitialPercent = DefaultRolloutInitialPercent
+	}
+	if spec.StepPercent == 0 {
+		spec.StepPercent = DefaultRolloutStepPercent
+	}
+	if spec.StepInterval == 0 {
+		spec.StepInterval = DefaultRolloutStepInterval
+	}
+	if spec.MaxErrorRate == nil {
+		maxErrorRate := DefaultRolloutMaxErrorRate
+		spec.MaxErrorRate = &maxErrorRate
+	}
+	if spec.MinRequests == nil {
+		minRequests := DefaultRolloutMinRequests
+		spec.MinRequests = &minRequests
+	}
+	switch {
+	case spec.InitialPercent < 1 || spec.InitialPercent > 100:
+		return fmt.Errorf("%w: initial_percent must be between 1 and 100", ErrInvalidRollout)
+	case spec.StepPercent < 1 || spec.StepPercent > 100:
+		return fmt.Errorf("%w: step_percent must be between 1 and 100", ErrInvalidRollout)
+	case spec.StepInterval < minRolloutStepInterval:
+		return fmt.Errorf("%w: step_interval must be at least %d seconds", ErrInvalidRollout, minRolloutStepInterval)
+	case *spec.MaxErrorRate < 0 || *spec.MaxErrorRate > 1:
+		return fmt.Errorf("%w: max_error_rate must be between 0 and 1", ErrInvalidRollout)
+	case *spec.MinRequests < 0:
+		return fmt.Errorf("%w: min_requests must not be negative", ErrInvalidRollout)
+	}
+	return nil
+}
+
+// rolloutUpstreamIndex 查找 location 中 Target 为新目标的上游，不存在时返回 -1
+func rolloutUpstreamIndex(location db.Location, target string) int {
+	for i, upstream := range location.Upstreams {
+		if upstream.Target == target || (upstream.Pool != nil && upstream.Pool.Target() == target) {
+			return i
+		}
+	}
+	return -1
+}
+
+// rolloutWeights 计算新目标占其条件组 percent% 流量时各上游的权重，groups 为 db.ConditionGroups 的结果
+// 组内其余流量按发布前的权重比例分给其他上游（均未设置权重时平均分配，权重为 0 的上游保持不参与分流），
+// 其他条件组的上游保持发布前的权重
+func rolloutWeights(original []int, groups []int, canary int, percent int) []int {
+	weights := make([]int, len(original))
+	copy(weights, original)
+	weights[canary] = percent * rolloutWeightScale
+	rest := (100 - percent) * rolloutWeightScale
+	shares := make([]int, len(original))
+	sum := 0
+	for i, weight := range original {
+		if i != canary && groups[i] == groups[canary] && weight > 0 {
+			shares[i] = weight
+			sum += weight
+		}
+	}
+	if sum == 0 {
+		for i := range original {
+			if i != canary && groups[i] == groups[canary] {
+				shares[i] = 1
+				sum++
+			}
+		}
+	}
+	for i, share := range shares {
+		if share == 0 {
+			continue
+		}
+		weights[i] = rest * share / sum
+		if rest > 0 && weights[i] == 0 {
+			weights[i] = 1
+		}
+	}
+	return weights
+}
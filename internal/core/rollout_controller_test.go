@@ -0,0 +1,261 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"nginx-proxy/internal/db"
+)
+
+func TestRolloutWeights(t *testing.T) {
+	tests := []struct {
+		name     string
+		original []int
+		groups   []int
+		canary   int
+		percent  int
+		want     []int
+	}{
+		{"unweighted group split evenly", []int{0, 0, 0}, []int{0, 0, 0}, 1, 10, []int{4500, 1000, 4500}},
+		{"weighted group keeps ratio", []int{3, 1, 1}, []int{0, 0, 0}, 2, 20, []int{6000, 2000, 2000}},
+		{"small share keeps at least weight 1", []int{1, 9999, 0}, []int{0, 0, 0}, 2, 99, []int{1, 99, 9900}},
+		// 其他条件组的上游保持发布前的权重
+		{"other condition group untouched", []int{0, 0, 0}, []int{0, 1, 1}, 2, 5, []int{0, 9500, 500}},
+		{"canary is the only member of its group", []int{0, 0}, []int{0, 1}, 1, 30, []int{0, 3000}},
+		{"100 percent", []int{0, 0, 0}, []int{0, 0, 0}, 0, 100, []int{10000, 0, 0}},
+	}
+	for _, tt := range tests {
+		got := rolloutWeights(tt.original, tt.groups, tt.canary, tt.percent)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: rolloutWeights = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeRolloutSpec(t *testing.T) {
+	spec := RolloutSpec{RuleID: "r1", Target: "http://new"}
+	if err := normalizeRolloutSpec(&spec); err != nil {
+		t.Fatal(err)
+	}
+	if *spec.MaxErrorRate != DefaultRolloutMaxErrorRate || *spec.MinRequests != DefaultRolloutMinRequests {
+		t.Errorf("defaults = %v, %v", *spec.MaxErrorRate, *spec.MinRequests)
+	}
+	// 显式设置的 0 不使用默认值
+	maxErrorRate, minRequests := 0.0, 0
+	spec = RolloutSpec{RuleID: "r1", Target: "http://new", MaxErrorRate: &maxErrorRate, MinRequests: &minRequests}
+	if err := normalizeRolloutSpec(&spec); err != nil {
+		t.Fatal(err)
+	}
+	if *spec.MaxErrorRate != 0 || *spec.MinRequests != 0 {
+		t.Errorf("explicit zero = %v, %v", *spec.MaxErrorRate, *spec.MinRequests)
+	}
+}
+
+// testRollouts 使用内存数据库的灰度发布控制器，规则更新直接保存到数据库，fail 不为空时更新失败
+type testRollouts struct {
+	*RolloutController
+	db   *gorm.DB
+	fail error
+}
+
+func newTestRollouts(t *testing.T, upstreams []db.Upstream) *testRollouts {
+	t.Helper()
+	database := newTestDB(t, &db.Rule{}, &db.Rollout{})
+	rule := db.Rule{ID: "r1", ServerName: "a.example.com"}
+	if err := rule.SetLocations([]db.Location{{Path: "/", Upstreams: upstreams}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Create(&rule).Error; err != nil {
+		t.Fatal(err)
+	}
+	r := &testRollouts{RolloutController: NewRolloutController(database, RolloutConfig{Interval: 1}), db: database}
+	r.SetRuleUpdater(func(ruleID string, mutate func(locations []db.Location) error) error {
+		if r.fail != nil {
+			return r.fail
+		}
+		var rule db.Rule
+		if err := database.First(&rule, "id = ?", ruleID).Error; err != nil {
+			return err
+		}
+		locations, err := rule.GetLocations()
+		if err != nil {
+			return err
+		}
+		if err := mutate(locations); err != nil {
+			return err
+		}
+		if err := rule.SetLocations(locations); err != nil {
+			return err
+		}
+		return database.Save(&rule).Error
+	})
+	return r
+}
+
+// weights 返回规则第一个 location 中各上游的权重
+func (r *testRollouts) weights(t *testing.T) []int {
+	t.Helper()
+	var rule db.Rule
+	if err := r.db.First(&rule, "id = ?", "r1").Error; err != nil {
+		t.Fatal(err)
+	}
+	locations, err := rule.GetLocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	weights := make([]int, len(locations[0].Upstreams))
+	for i, upstream := range locations[0].Upstreams {
+		weights[i] = upstream.Weight
+	}
+	return weights
+}
+
+// expireStep 使灰度发布的当前步到期
+func (r *testRollouts) expireStep(t *testing.T, id string) {
+	t.Helper()
+	if err := r.db.Model(&db.Rollout{}).Where("id = ?", id).
+		Update("step_started_at", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (r *testRollouts) get(t *testing.T, id string) *db.Rollout {
+	t.Helper()
+	rollout, err := r.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rollout
+}
+
+func TestRolloutCreate(t *testing.T) {
+	r := newTestRollouts(t, []db.Upstream{
+		{Target: "http://beta", ConditionIP: "10.0.0.0/8"},
+		{Target: "http://old"},
+		{Target: "http://new"},
+	})
+	// 与新目标条件相同的上游才能分出流量
+	if _, err := r.Create(RolloutSpec{RuleID: "r1", Target: "http://beta"}); !errors.Is(err, ErrInvalidRollout) {
+		t.Errorf("rollout without siblings: err = %v", err)
+	}
+	// 修改权重失败时不保留灰度发布
+	r.fail = errors.New("nginx -t failed")
+	if _, err := r.Create(RolloutSpec{RuleID: "r1", Target: "http://new"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if rollouts, _ := r.List("r1"); len(rollouts) != 0 {
+		t.Fatalf("rollouts = %d, want 0", len(rollouts))
+	}
+	r.fail = nil
+	rollout, err := r.Create(RolloutSpec{RuleID: "r1", Target: "http://new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rollout.Status != db.RolloutStatusRunning || rollout.Percent != DefaultRolloutInitialPercent {
+		t.Errorf("rollout = %s at %d%%", rollout.Status, rollout.Percent)
+	}
+	if got := r.weights(t); !slices.Equal(got, []int{0, 9500, 500}) {
+		t.Errorf("weights = %v", got)
+	}
+	if _, err := r.Create(RolloutSpec{RuleID: "r1", Target: "http://new"}); !errors.Is(err, ErrRolloutConflict) {
+		t.Errorf("second rollout: err = %v", err)
+	}
+}
+
+func TestRolloutCheck(t *testing.T) {
+	r := newTestRollouts(t, []db.Upstream{{Target: "http://old"}, {Target: "http://new"}})
+	rollout, err := r.Create(RolloutSpec{RuleID: "r1", Target: "http://new", StepPercent: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 当前步到期后提高流量比例
+	r.expireStep(t, rollout.ID)
+	r.check()
+	if got := r.get(t, rollout.ID); got.Percent != 55 || got.Status != db.RolloutStatusRunning {
+		t.Fatalf("after advance: %s at %d%%", got.Status, got.Percent)
+	}
+	if got := r.weights(t); !slices.Equal(got, []int{4500, 5500}) {
+		t.Fatalf("weights = %v", got)
+	}
+
+	// 只统计发布的规则和 location 中新目标的结果
+	var outcomes []ProxyOutcome
+	for range DefaultRolloutMinRequests {
+		outcomes = append(outcomes,
+			ProxyOutcome{RuleID: "r2", Target: "http://new", Status: 500},
+			ProxyOutcome{RuleID: "r1", Location: 1, Target: "http://new", Status: 500},
+			ProxyOutcome{RuleID: "r1", Target: "http://old", Status: 500},
+			ProxyOutcome{RuleID: "r1", Target: "http://new", Status: 200})
+	}
+	r.Observe(outcomes)
+	r.check()
+	if got := r.get(t, rollout.ID); got.Status != db.RolloutStatusRunning || got.StepRequests != DefaultRolloutMinRequests || got.StepErrors != 0 {
+		t.Fatalf("after healthy step: %s %d/%d", got.Status, got.StepErrors, got.StepRequests)
+	}
+
+	// 错误率超过阈值时中止，恢复失败时保持 aborting 并在检查时重试
+	outcomes = outcomes[:0]
+	for range DefaultRolloutMinRequests {
+		outcomes = append(outcomes, ProxyOutcome{RuleID: "r1", Target: "http://new", Error: "connect"})
+	}
+	r.Observe(outcomes)
+	r.fail = errors.New("nginx -t failed")
+	r.check()
+	got := r.get(t, rollout.ID)
+	if got.Status != db.RolloutStatusAborting || got.LastError == "" {
+		t.Fatalf("after failed abort: %s %q", got.Status, got.LastError)
+	}
+	r.check()
+	if got := r.get(t, rollout.ID); got.Status != db.RolloutStatusAborting {
+		t.Fatalf("after failed retry: %s", got.Status)
+	}
+	r.fail = nil
+	r.check()
+	got = r.get(t, rollout.ID)
+	if got.Status != db.RolloutStatusAborted || got.LastError != "" {
+		t.Fatalf("after retry: %s %q", got.Status, got.LastError)
+	}
+	if got := r.weights(t); !slices.Equal(got, []int{0, 0}) {
+		t.Fatalf("weights = %v, want original", got)
+	}
+
+	// 到达 100% 时完成
+	rollout, err = r.Create(RolloutSpec{RuleID: "r1", Target: "http://new", InitialPercent: 60, StepPercent: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.expireStep(t, rollout.ID)
+	r.check()
+	if got := r.get(t, rollout.ID); got.Status != db.RolloutStatusCompleted || got.Percent != 100 {
+		t.Fatalf("after last step: %s at %d%%", got.Status, got.Percent)
+	}
+	if got := r.weights(t); !slices.Equal(got, []int{0, 10000}) {
+		t.Fatalf("weights = %v", got)
+	}
+}
+
+func TestRolloutAbortDeletedRule(t *testing.T) {
+	r := newTestRollouts(t, []db.Upstream{{Target: "http://old"}, {Target: "http://new"}})
+	rollout, err := r.Create(RolloutSpec{RuleID: "r1", Target: "http://new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.fail = fmt.Errorf("rule not found")
+	if _, err := r.Abort(rollout.ID); err == nil {
+		t.Fatal("expected abort error while the rule exists")
+	}
+	if err := r.db.Delete(&db.Rule{ID: "r1"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	// 规则删除后没有需要恢复的权重，不再重试
+	r.check()
+	if got := r.get(t, rollout.ID); got.Status != db.RolloutStatusAborted {
+		t.Fatalf("status = %s, want aborted", got.Status)
+	}
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"log"
+	"sync"
+
+	"gorm.io/gorm"
+
+	"nginx-proxy/internal/db"
+)
+
+// RouteTableIndex 路由表的内存索引，按表名和键查找目标地址
+type RouteTableIndex struct {
+	db     *gorm.DB
+	mu     sync.RWMutex
+	tables map[string]map[string]string
+}
+
+// NewRouteTableIndex 创建路由表索引
+func NewRouteTableIndex(database *gorm.DB) *RouteTableIndex {
+	return &RouteTableIndex{
+		db:     database,
+		tables: make(map[string]map[string]string),
+	}
+}
+
+// Reload 从数据库重新加载所有路由表，加载完成后整体替换索引
+func (i *RouteTableIndex) Reload() error {
+	var tables []db.RouteTable
+	if err := i.db.Find(&tables).Error; err != nil {
+		return err
+	}
+	names := make(map[string]string, len(tables))
+	index := make(map[string]map[string]string, len(tables))
+	for _, table := range tables {
+		names[table.ID] = table.Name
+		index[table.Name] = make(map[string]string)
+	}
+	var entries []db.RouteTableEntry
+	if err := i.db.Find(&entries).Error; err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if name, ok := names[entry.TableID]; ok {
+			index[name][entry.Key] = entry.Target
+		}
+	}
+	i.mu.Lock()
+	i.tables = index
+	i.mu.Unlock()
+	log.Printf("Route table index reloaded: %d table(s), %d entries", len(tables), len(entries))
+	return nil
+}
+
+// Lookup 在指定路由表中查找键对应的目标地址
+func (i *RouteTableIndex) Lookup(table, key string) (string, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	target, ok := i.tables[table][key]
+	return target, ok
+}
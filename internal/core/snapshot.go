@@ -0,0 +1,357 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"nginx-proxy/internal/db"
+)
+
+// 路由模式
+const (
+	RoutingModeRemote = "remote" // 每个请求调用 /api/route
+	RoutingModeLocal  = "local"  // OpenResty 同步路由快照后在本地判断
+)
+
+// RoutingSnapshot 路由快照，包含所有规则编译后的路由配置，供 OpenResty 在本地执行路由判断
+type RoutingSnapshot struct {
+	Version      int64                        `json:"version"`
+	GeneratedAt  time.Time                    `json:"generated_at"`
+	Rules        map[string]SnapshotRule      `json:"rules"`                   // 按规则 ID 索引
+	RouteTables  map[string]map[string]string `json:"route_tables,omitempty"`  // 被引用的路由表
+	Unhealthy    []string                     `json:"unhealthy,omitempty"`     // 健康检查判定为不健康的 Target
+	OpenCircuits map[string]int64             `json:"open_circuits,omitempty"` // 已熔断的 Target 及进入半开状态的时间（毫秒时间戳）
+	ProbeWindow  int                          `json:"probe_window,omitempty"`  // 半开状态下的探测间隔（秒），每个间隔内只放行一个探测请求
+}
+
+// SnapshotRule 快照中的规则
+type SnapshotRule struct {
+	ServerName  string             `json:"server_name"`
+	ServerRegex string             `json:"server_regex,omitempty"` // 正则 server_name（去掉 "~"），用于提取命名捕获
+	Locations   []SnapshotLocation `json:"locations,omitempty"`    // 顺序与配置文件中的 location 一致
+}
+
+// SnapshotLocation 快照中的 location
+type SnapshotLocation struct {
+	Modifier  string             `json:"modifier,omitempty"`
+	Path      string             `json:"path"`
+	Caseless  bool               `json:"caseless,omitempty"` // 正则不区分大小写
+	Upstreams []SnapshotUpstream `json:"upstreams,omitempty"`
+	Sticky    *db.StickyConfig   `json:"sticky,omitempty"`
+	Lookup    *db.LookupConfig   `json:"lookup,omitempty"`
+}
+
+// SnapshotUpstream 快照中的上游，条件已预处理为便于 Lua 判断的形式
+type SnapshotUpstream struct {
+	Target    string              `json:"target"`
+	Templated bool                `json:"templated,omitempty"` // Target 是否包含占位符
+	Weight    int                 `json:"weight,omitempty"`
+	Group     int                 `json:"group"`              // 条件组编号，为组内第一个上游的下标（从 1 开始，与 Lua 数组下标一致）
+	HasIP     bool                `json:"has_ip,omitempty"`   // 是否有 IP 条件，为 true 且 Networks 为空时永不匹配
+	Networks  []SnapshotNetwork   `json:"networks,omitempty"` // IP 条件的网段（IP 集合引用已展开）
+	Methods   []string            `json:"methods,omitempty"`  // 大写
+	Headers   []db.MatchCondition `json:"headers,omitempty"`  // 名称为小写
+	Cookies   []db.MatchCondition `json:"cookies,omitempty"`
+	Query     []db.MatchCondition `json:"query,omitempty"`
+	Rewrite   *SnapshotRewrite    `json:"rewrite,omitempty"`
+}
+
+// SnapshotNetwork 快照中 IP 条件的一个网段
+type SnapshotNetwork struct {
+	Network string `json:"network"` // 网络地址（16 字节，IPv4 映射为 IPv6，十六进制）
+	Bits    int    `json:"bits"`    // 前缀长度（按 128 位计算）
+}
+
+// SnapshotRewrite 快照中的路径重写，前缀已补全，正则替换已转换为 ngx.re.gsub 的格式
+type SnapshotRewrite struct {
+	Type        string `json:"type"`
+	Prefix      string `json:"prefix,omitempty"`
+	Pattern     string `json:"pattern,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// SnapshotStore 管理路由快照
+// 规则或路由表变更后调用 Invalidate 使版本号递增，下次获取时重新编译
+type SnapshotStore struct {
+	db      *gorm.DB
+	mu      sync.Mutex
+	version int64
+	data    []byte          // 当前版本编译好的快照 JSON，nil 表示需要重新编译
+	health  *HealthChecker  // 为空表示未启用健康检查
+	breaker *CircuitBreaker // 为空表示未启用熔断
+}
+
+// NewSnapshotStore 创建路由快照存储
+// 初始版本号取当前毫秒时间戳，保证服务重启后版本号不会回退
+func NewSnapshotStore(database *gorm.DB) *SnapshotStore {
+	return &SnapshotStore{
+		db:      database,
+		version: time.Now().UnixMilli(),
+	}
+}
+
+// Invalidate 使当前快照失效
+func (s *SnapshotStore) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+	s.data = nil
+	log.Printf("Routing snapshot invalidated, new version: %d", s.version)
+}
+
+// WatchHealth 将上游健康状态加入快照，健康状态变化时使快照失效
+func (s *SnapshotStore) WatchHealth(checker *HealthChecker) {
+	s.mu.Lock()
+	s.health = checker
+	s.mu.Unlock()
+	checker.OnChange(s.Invalidate)
+}
+
+// WatchCircuits 将熔断状态加入快照，熔断或恢复时使快照失效
+func (s *SnapshotStore) WatchCircuits(breaker *CircuitBreaker) {
+	s.mu.Lock()
+	s.breaker = breaker
+	s.mu.Unlock()
+	breaker.OnChange(s.Invalidate)
+}
+
+// Version 返回当前快照版本号
+func (s *SnapshotStore) Version() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
+
+// Get 返回当前版本的快照 JSON 及版本号
+func (s *SnapshotStore) Get() ([]byte, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data != nil {
+		return s.data, s.version, nil
+	}
+	snapshot, err := s.build()
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.data = data
+	return s.data, s.version, nil
+}
+
+// build 从数据库加载规则和路由表并编译为快照
+func (s *SnapshotStore) build() (*RoutingSnapshot, error) {
+	var rules []db.Rule
+	if err := s.db.Find(&rules).Error; err != nil {
+		return nil, fmt.Errorf("failed to load rules: %w", err)
+	}
+	snapshot := &RoutingSnapshot{
+		Version:     s.version,
+		GeneratedAt: time.Now(),
+		Rules:       make(map[string]SnapshotRule, len(rules)),
+	}
+	ipSets, err := loadIPSets(s.db)
+	if err != nil {
+		return nil, err
+	}
+	tables := make(map[string]bool)
+	for _, rule := range rules {
+		compiled, err := compileSnapshotRule(&rule, ipSets)
+		if err != nil {
+			log.Printf("Warning: Failed to compile rule %s for snapshot: %v", rule.ID, err)
+			continue
+		}
+		for _, location := range compiled.Locations {
+			if location.Lookup != nil {
+				tables[location.Lookup.Table] = true
+			}
+		}
+		snapshot.Rules[rule.ID] = *compiled
+	}
+	if s.health != nil {
+		snapshot.Unhealthy = s.health.Unhealthy()
+	}
+	if s.breaker != nil {
+		snapshot.ProbeWindow = int(s.breaker.Cooldown() / time.Second)
+		for target, retryAt := range s.breaker.OpenCircuits() {
+			if snapshot.OpenCircuits == nil {
+				snapshot.OpenCircuits = make(map[string]int64)
+			}
+			snapshot.OpenCircuits[target] = retryAt.UnixMilli()
+		}
+	}
+	if len(tables) > 0 {
+		routeTables, err := s.loadRouteTables(tables)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.RouteTables = routeTables
+	}
+	log.Printf("Routing snapshot %d compiled: %d rule(s), %d route table(s)",
+		snapshot.Version, len(snapshot.Rules), len(snapshot.RouteTables))
+	return snapshot, nil
+}
+
+// loadRouteTables 加载被引用的路由表
+func (s *SnapshotStore) loadRouteTables(names map[string]bool) (map[string]map[string]string, error) {
+	var tables []db.RouteTable
+	if err := s.db.Find(&tables).Error; err != nil {
+		return nil, fmt.Errorf("failed to load route tables: %w", err)
+	}
+	result := make(map[string]map[string]string)
+	for _, table := range tables {
+		if !names[table.Name] {
+			continue
+		}
+		var entries []db.RouteTableEntry
+		if err := s.db.Where("table_id = ?", table.ID).Find(&entries).Error; err != nil {
+			return nil, fmt.Errorf("failed to load route table %s: %w", table.Name, err)
+		}
+		mapping := make(map[string]string, len(entries))
+		for _, entry := range entries {
+			mapping[entry.Key] = entry.Target
+		}
+		result[table.Name] = mapping
+	}
+	return result, nil
+}
+
+// compileSnapshotRule 编译单个规则，ipSets 用于展开 IP 条件中的集合引用
+func compileSnapshotRule(rule *db.Rule, ipSets db.IPSets) (*SnapshotRule, error) {
+	locations, err := rule.GetLocations()
+	if err != nil {
+		return nil, err
+	}
+	db.ResolvePoolTargets(locations)
+	compiled := &SnapshotRule{ServerName: rule.ServerName}
+	if strings.HasPrefix(rule.ServerName, "~") {
+		compiled.ServerRegex = rule.ServerName[1:]
+	}
+	for _, location := range locations {
+		snapshotLocation := SnapshotLocation{
+			Modifier: location.Modifier,
+			Path:     location.Path,
+			Caseless: location.Modifier == db.LocationModifierRegexCaseless,
+			Sticky:   location.Sticky,
+			Lookup:   location.Lookup,
+		}
+		groups := db.ConditionGroups(location.Upstreams)
+		for i, upstream := range location.Upstreams {
+			snapshotUpstream, err := compileSnapshotUpstream(location, upstream, ipSets)
+			if err != nil {
+				return nil, fmt.Errorf("location %s: %w", location.Path, err)
+			}
+			snapshotUpstream.Group = groups[i] + 1
+			snapshotLocation.Upstreams = append(snapshotLocation.Upstreams, *snapshotUpstream)
+		}
+		compiled.Locations = append(compiled.Locations, snapshotLocation)
+	}
+	return compiled, nil
+}
+
+// compileSnapshotUpstream 编译单个上游
+func compileSnapshotUpstream(location db.Location, upstream db.Upstream, ipSets db.IPSets) (*SnapshotUpstream, error) {
+	compiled := &SnapshotUpstream{
+		Target:    upstream.Target,
+		Templated: strings.Contains(upstream.Target, "{"),
+		Weight:    upstream.Weight,
+		Cookies:   upstream.Cookies,
+		Query:     upstream.Query,
+	}
+	if upstream.ConditionIP != "" && upstream.ConditionIP != "0.0.0.0/0" {
+		compiled.HasIP = true
+		// 引用的集合不存在时保留空网段，与路由接口一样视为不匹配
+		conditions, err := ipSets.Expand([]string{upstream.ConditionIP})
+		if err != nil {
+			log.Printf("Warning: Invalid IP condition %s: %v", upstream.ConditionIP, err)
+		}
+		for _, condition := range conditions {
+			network, bits, err := snapshotNetwork(condition)
+			if err != nil {
+				return nil, err
+			}
+			compiled.Networks = append(compiled.Networks, SnapshotNetwork{Network: network, Bits: bits})
+		}
+	}
+	for _, method := range upstream.Methods {
+		compiled.Methods = append(compiled.Methods, strings.ToUpper(method))
+	}
+	for _, condition := range upstream.Headers {
+		condition.Name = strings.ToLower(condition.Name)
+		compiled.Headers = append(compiled.Headers, condition)
+	}
+	if upstream.Rewrite != nil {
+		rewrite := &SnapshotRewrite{
+			Type:        upstream.Rewrite.Type,
+			Prefix:      upstream.Rewrite.Prefix,
+			Pattern:     upstream.Rewrite.Pattern,
+			Replacement: upstream.Rewrite.Replacement,
+		}
+		switch rewrite.Type {
+		case db.RewriteStripPrefix, db.RewriteReplacePrefix:
+			if rewrite.Prefix == "" && !location.IsRegex() {
+				rewrite.Prefix = location.Path
+			}
+		case db.RewriteRegex:
+			re, err := regexp.Compile(rewrite.Pattern)
+			if err != nil {
+				return nil, err
+			}
+			rewrite.Replacement = ngxReplacement(re, rewrite.Replacement)
+		}
+		compiled.Rewrite = rewrite
+	}
+	return compiled, nil
+}
+
+// snapshotNetwork 将 IP 或 CIDR 转为 16 字节网络地址的十六进制及 128 位下的前缀长度
+func snapshotNetwork(conditionIP string) (string, int, error) {
+	if !strings.Contains(conditionIP, "/") {
+		ip := net.ParseIP(conditionIP)
+		if ip == nil {
+			return "", 0, fmt.Errorf("invalid IP: %s", conditionIP)
+		}
+		return fmt.Sprintf("%x", []byte(ip.To16())), 128, nil
+	}
+	_, ipNet, err := net.ParseCIDR(conditionIP)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid CIDR: %s", conditionIP)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits == net.IPv4len*8 {
+		ones += 96
+	}
+	return fmt.Sprintf("%x", []byte(ipNet.IP.To16())), ones, nil
+}
+
+// replacementRef 匹配 Go 正则替换中的 $$、$name 和 ${name}
+var replacementRef = regexp.MustCompile(`\$(\$|\{[A-Za-z0-9_]+\}|[A-Za-z0-9_]+)`)
+
+// ngxReplacement 将 Go 正则替换模板转为 ngx.re.gsub 的格式（命名引用转为 ${N}）
+func ngxReplacement(re *regexp.Regexp, replacement string) string {
+	return replacementRef.ReplaceAllStringFunc(replacement, func(ref string) string {
+		name := strings.TrimSuffix(strings.TrimPrefix(ref[1:], "{"), "}")
+		if name == "$" {
+			return "$$"
+		}
+		index, err := strconv.Atoi(name)
+		if err != nil {
+			index = re.SubexpIndex(name)
+		}
+		if index < 0 || index > re.NumSubexp() {
+			return ""
+		}
+		return fmt.Sprintf("${%d}", index)
+	})
+}
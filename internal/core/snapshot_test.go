@@ -0,0 +1,124 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"reflect"
+	"testing"
+
+	"nginx-proxy/internal/db"
+)
+
+var update = flag.Bool("update", false, "update testdata/routing_snapshots.json")
+
+const (
+	routingCasesFile     = "../../testdata/routing_cases.json"
+	routingSnapshotsFile = "../../testdata/routing_snapshots.json"
+)
+
+func TestCompileSnapshotRule(t *testing.T) {
+	ipSets := db.IPSets{"office": {"10.0.0.0/8", "192.168.1.7"}}
+	rule := db.Rule{ID: "rule", ServerName: "~^(?<tenant>[a-z]+)\\.example\\.com$"}
+	err := rule.SetLocations([]db.Location{
+		{Path: "/api/", Upstreams: []db.Upstream{
+			{ConditionIP: "@office", Target: "http://{tenant}.internal:80", Methods: []string{"get"}},
+			{ConditionIP: "0.0.0.0/0", Target: "http://a:80", Weight: 1, Headers: db.MatchConditions{{Name: "X-Beta", Value: "1"}}},
+			{Target: "http://b:80", Headers: db.MatchConditions{{Name: "x-beta", Operator: db.MatchOperatorEquals, Value: "1"}}, Rewrite: &db.RewriteConfig{Type: db.RewriteStripPrefix}},
+			{ConditionIP: "@missing", Target: "http://c:80"},
+		}},
+		{Modifier: db.LocationModifierRegexCaseless, Path: `^/(?<app>[a-z]+)/`, Upstreams: []db.Upstream{
+			{Target: "http://d:80", Rewrite: &db.RewriteConfig{Type: db.RewriteRegex, Pattern: `^/(?P<app>[a-z]+)/(.*)$`, Replacement: "/${app}/$2$$"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiled, err := compileSnapshotRule(&rule, ipSets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compiled.ServerRegex != `^(?<tenant>[a-z]+)\.example\.com$` {
+		t.Errorf("server_regex = %q", compiled.ServerRegex)
+	}
+	upstreams := compiled.Locations[0].Upstreams
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		// IP 集合展开为 16 字节网段，IPv4 前缀长度加 96
+		{"ip set networks", upstreams[0].Networks, []SnapshotNetwork{
+			{Network: "00000000000000000000ffff0a000000", Bits: 104},
+			{Network: "00000000000000000000ffffc0a80107", Bits: 128},
+		}},
+		{"templated", upstreams[0].Templated, true},
+		{"methods upper-cased", upstreams[0].Methods, []string{"GET"}},
+		// 0.0.0.0/0 视为没有 IP 条件
+		{"default route has no ip", upstreams[1].HasIP, false},
+		{"header names lower-cased", upstreams[1].Headers, []db.MatchCondition{{Name: "x-beta", Value: "1"}}},
+		// 条件相同的上游属于同一组，编号为组内第一个上游的 Lua 下标
+		{"groups", []int{upstreams[0].Group, upstreams[1].Group, upstreams[2].Group, upstreams[3].Group}, []int{1, 2, 2, 4}},
+		{"strip prefix defaults to location path", upstreams[2].Rewrite.Prefix, "/api/"},
+		// 引用的集合不存在时保留空网段，视为不匹配
+		{"missing ip set", []any{upstreams[3].HasIP, len(upstreams[3].Networks)}, []any{true, 0}},
+		{"caseless regex location", compiled.Locations[1].Caseless, true},
+		{"ngx replacement", compiled.Locations[1].Upstreams[0].Rewrite.Replacement, "/${1}/${2}$$"},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+// TestRoutingCaseSnapshots 编译路由用例中的规则，与 OpenResty 本地路由回放用例时使用的快照比较
+// 修改用例或快照格式后使用 -update 重新生成
+func TestRoutingCaseSnapshots(t *testing.T) {
+	data, err := os.ReadFile(routingCasesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases []struct {
+		Name   string    `json:"name"`
+		IPSets db.IPSets `json:"ip_sets"`
+		Rule   struct {
+			ServerName string        `json:"server_name"`
+			Locations  []db.Location `json:"locations"`
+		} `json:"rule"`
+	}
+	if err := json.Unmarshal(data, &cases); err != nil {
+		t.Fatal(err)
+	}
+	snapshots := make(map[string]*SnapshotRule, len(cases))
+	for _, tc := range cases {
+		rule := db.Rule{ID: "rule", ServerName: tc.Rule.ServerName}
+		if err := rule.SetLocations(tc.Rule.Locations); err != nil {
+			t.Fatalf("%s: %v", tc.Name, err)
+		}
+		compiled, err := compileSnapshotRule(&rule, tc.IPSets)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.Name, err)
+		}
+		snapshots[tc.Name] = compiled
+	}
+	got, err := json.MarshalIndent(snapshots, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+	if *update {
+		if err := os.WriteFile(routingSnapshotsFile, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(routingSnapshotsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("compiled snapshots differ from %s, run go test -update if the change is intended", routingSnapshotsFile)
+	}
+}
@@ -24,7 +24,8 @@ func InitDB(dbPath string) (*gorm.DB, error) {
 	}
 
 	// 自动迁移数据表
-	err = db.AutoMigrate(&Rule{}, &Certificate{})
+	err = db.AutoMigrate(&Rule{}, &Certificate{}, &RouteTable{}, &RouteTableEntry{}, &Rollout{}, &IPSet{},
+		&CredentialStore{}, &Credential{})
 	if err != nil {
 		return nil, err
 	}
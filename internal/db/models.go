@@ -1,7 +1,14 @@
 package db
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -14,41 +21,579 @@ type Rule struct {
 	ListenPorts string         `json:"listen_ports" gorm:"column:listen_ports"` // JSON 存储
 	SSLCert     string         `json:"ssl_cert"`
 	SSLKey      string         `json:"ssl_key"`
-	Locations   string         `json:"locations" gorm:"column:locations;type:text"` // JSON 存储
+	ForceHTTPS  bool           `json:"force_https" gorm:"column:force_https"`         // 明文端口只做 HTTPS 重定向
+	Locations   string         `json:"locations" gorm:"column:locations;type:text"`   // JSON 存储
+	FailMode    string         `json:"fail_mode" gorm:"column:fail_mode"`             // 路由服务不可用时的处理方式，为空时等同于 closed
+	StaleTTL    int            `json:"stale_ttl" gorm:"column:stale_ttl"`             // stale 模式下缓存路由结果的有效期（秒），0 表示使用默认值
+	TestCases   string         `json:"test_cases" gorm:"column:test_cases;type:text"` // JSON 存储
 	CreatedAt   time.Time      `json:"created_at"`
 	UpdatedAt   time.Time      `json:"updated_at"`
 	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
 }
 
+// 路由服务不可用时的处理方式（仅 remote 路由模式下生效）
+const (
+	FailModeClosed = "closed" // 直接返回 502
+	FailModeStale  = "stale"  // 使用 OpenResty 缓存的最近一次成功路由结果
+)
+
+// DefaultStaleTTL 缓存路由结果的默认有效期（秒）
+const DefaultStaleTTL = 600
+
+// MaxStaleTTL 缓存路由结果的最大有效期（秒）
+const MaxStaleTTL = 7 * 24 * 3600
+
+// GetStaleTTL 返回实际使用的缓存有效期
+func (r *Rule) GetStaleTTL() int {
+	if r.StaleTTL <= 0 {
+		return DefaultStaleTTL
+	}
+	return r.StaleTTL
+}
+
+// 监听协议
+const (
+	ListenProtocolPlain = "plain" // 明文 HTTP
+	ListenProtocolSSL   = "ssl"   // HTTPS
+	ListenProtocolHTTP2 = "http2" // HTTPS 并启用 HTTP/2（http2 为 server 级别的指令，同一规则的其他 HTTPS 端口也会启用）
+)
+
+// DefaultHTTPPort 强制 HTTPS 且没有明文端口时，重定向服务器监听的端口
+const DefaultHTTPPort = 80
+
+// ListenEntry 一个监听端口及其协议
+// 兼容旧版的纯端口号格式，旧格式的协议为空：配置了证书时使用 ssl，否则使用 plain
+type ListenEntry struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// UnmarshalJSON 同时支持 {"port": 443, "protocol": "ssl"} 和旧版的纯端口号格式
+func (e *ListenEntry) UnmarshalJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] != '{' {
+		*e = ListenEntry{}
+		return json.Unmarshal(data, &e.Port)
+	}
+	type plain ListenEntry
+	var entry plain
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	}
+	*e = ListenEntry(entry)
+	return nil
+}
+
+// GetProtocol 返回实际使用的协议，hasCert 表示规则是否配置了证书
+func (e ListenEntry) GetProtocol(hasCert bool) string {
+	if e.Protocol != "" {
+		return e.Protocol
+	}
+	if hasCert {
+		return ListenProtocolSSL
+	}
+	return ListenProtocolPlain
+}
+
+// HasSSL 是否配置了证书
+func (r *Rule) HasSSL() bool {
+	return r.SSLCert != "" && r.SSLKey != ""
+}
+
+// ListenPlan 规则的监听安排：主 server 的监听项，以及强制 HTTPS 时重定向服务器的明文端口
+type ListenPlan struct {
+	Listens       []ListenEntry // 主 server 的监听项，协议已确定
+	RedirectPorts []int         // 重定向服务器的端口，未强制 HTTPS 时为空
+	HTTPSPort     int           // 重定向的目标端口（第一个 HTTPS 端口）
+}
+
+// PlanListens 按协议和 force_https 安排监听端口
+// 强制 HTTPS 时明文端口改由重定向服务器监听，没有明文端口时使用 DefaultHTTPPort
+func PlanListens(entries []ListenEntry, hasCert, forceHTTPS bool) ListenPlan {
+	var plan ListenPlan
+	for _, entry := range entries {
+		entry.Protocol = entry.GetProtocol(hasCert)
+		if entry.Protocol == ListenProtocolPlain {
+			if forceHTTPS {
+				plan.RedirectPorts = append(plan.RedirectPorts, entry.Port)
+				continue
+			}
+		} else if plan.HTTPSPort == 0 {
+			plan.HTTPSPort = entry.Port
+		}
+		plan.Listens = append(plan.Listens, entry)
+	}
+	if forceHTTPS && len(plan.RedirectPorts) == 0 {
+		plan.RedirectPorts = []int{DefaultHTTPPort}
+	}
+	return plan
+}
+
+// Location 修饰符，与 nginx location 语义一致
+const (
+	LocationModifierPrefix         = ""   // 前缀匹配
+	LocationModifierExact          = "="  // 精确匹配
+	LocationModifierPrefixPriority = "^~" // 前缀匹配，命中最长前缀后不再检查正则
+	LocationModifierRegex          = "~"  // 正则匹配（区分大小写）
+	LocationModifierRegexCaseless  = "~*" // 正则匹配（不区分大小写）
+)
+
+// location 类型
+const (
+	LocationTypeProxy    = "proxy"    // 按 upstreams 反向代理（默认）
+	LocationTypeRedirect = "redirect" // 重定向
+	LocationTypeReturn   = "return"   // 返回固定响应
+	LocationTypeStatic   = "static"   // 静态文件
+)
+
 // Location 代表一个 location 配置
 type Location struct {
-	Path      string     `json:"path"`
-	Upstreams []Upstream `json:"upstreams"`
+	Modifier  string           `json:"modifier,omitempty"` // 匹配修饰符: "", "=", "^~", "~", "~*"
+	Path      string           `json:"path"`
+	Type      string           `json:"type,omitempty"` // location 类型，为空时等同于 proxy
+	Upstreams []Upstream       `json:"upstreams"`
+	Sticky    *StickyConfig    `json:"sticky,omitempty"`     // 会话保持，为空时不启用
+	Lookup    *LookupConfig    `json:"lookup,omitempty"`     // 路由表查找，命中时优先于 upstreams
+	Mirror    *MirrorConfig    `json:"mirror,omitempty"`     // 流量镜像，为空时不启用
+	Redirect  *RedirectConfig  `json:"redirect,omitempty"`   // redirect 类型的重定向配置
+	Return    *ReturnConfig    `json:"return,omitempty"`     // return 类型的固定响应配置
+	Static    *StaticConfig    `json:"static,omitempty"`     // static 类型的静态文件配置
+	Allow     []string         `json:"allow,omitempty"`      // 允许访问的 CIDR 或 "@名称" 引用的 IP 集合，设置后其余地址返回 403
+	Deny      []string         `json:"deny,omitempty"`       // 拒绝访问的 CIDR 或 IP 集合，优先于 allow
+	BasicAuth *BasicAuthConfig `json:"basic_auth,omitempty"` // HTTP 基本认证，为空时不启用
+}
+
+// DefaultBasicAuthRealm 基本认证的默认提示域
+const DefaultBasicAuthRealm = "Restricted"
+
+// BasicAuthConfig HTTP 基本认证配置，用户和密码哈希由凭据库管理
+type BasicAuthConfig struct {
+	Store string `json:"store"`           // 凭据库名称
+	Realm string `json:"realm,omitempty"` // 浏览器登录框中显示的提示域，为空时使用 Restricted
+}
+
+// GetRealm 返回基本认证的提示域
+func (b *BasicAuthConfig) GetRealm() string {
+	if b.Realm != "" {
+		return b.Realm
+	}
+	return DefaultBasicAuthRealm
+}
+
+// RedirectConfig 重定向配置
+type RedirectConfig struct {
+	Code        int    `json:"code,omitempty"`         // 301、302、303、307 或 308，为空时使用 302
+	Target      string `json:"target"`                 // 重定向地址，http(s) URL 或以 / 开头的路径
+	PreserveURI bool   `json:"preserve_uri,omitempty"` // 在 Target 后追加原始请求 URI（$request_uri，包含查询参数）
+}
+
+// GetCode 返回重定向状态码
+func (r *RedirectConfig) GetCode() int {
+	if r.Code != 0 {
+		return r.Code
+	}
+	return 302
+}
+
+// URL 返回 nginx return 指令使用的重定向地址
+func (r *RedirectConfig) URL() string {
+	if r.PreserveURI {
+		return strings.TrimSuffix(r.Target, "/") + "$request_uri"
+	}
+	return r.Target
+}
+
+// ReturnConfig 固定响应配置
+type ReturnConfig struct {
+	Status      int    `json:"status,omitempty"`       // 为空时使用 200
+	Body        string `json:"body,omitempty"`         // 响应内容
+	ContentType string `json:"content_type,omitempty"` // 为空时使用 text/plain
+}
+
+// GetStatus 返回响应状态码
+func (r *ReturnConfig) GetStatus() int {
+	if r.Status != 0 {
+		return r.Status
+	}
+	return 200
+}
+
+// GetContentType 返回响应的 Content-Type
+func (r *ReturnConfig) GetContentType() string {
+	if r.ContentType != "" {
+		return r.ContentType
+	}
+	return "text/plain"
+}
+
+// StaticConfig 静态文件配置，与 nginx 的 root 语义一致：文件路径为 Root 加上请求 URI
+type StaticConfig struct {
+	Root     string   `json:"root"`                // 根目录，绝对路径
+	Index    []string `json:"index,omitempty"`     // 目录索引文件，为空时使用 index.html
+	TryFiles []string `json:"try_files,omitempty"` // 依次尝试的文件，如 ["$uri", "$uri/", "/index.html"]，为空时不设置
+}
+
+// GetIndex 返回目录索引文件
+func (s *StaticConfig) GetIndex() []string {
+	if len(s.Index) > 0 {
+		return s.Index
+	}
+	return []string{"index.html"}
+}
+
+// 路由表查找键的来源
+const (
+	LookupSourceHeader = "header"
+	LookupSourceCookie = "cookie"
+	LookupSourceQuery  = "query"
+)
+
+// LookupConfig 路由表查找配置：取请求中的头部、Cookie 或查询参数的值，到路由表中查找目标地址
+// 值缺失或表中没有对应的键时，继续按 upstreams 选择
+type LookupConfig struct {
+	Table  string `json:"table"`  // 路由表名称
+	Source string `json:"source"` // header、cookie 或 query
+	Key    string `json:"key"`    // 头部、Cookie 或查询参数的名称
+}
+
+// 会话保持模式
+const (
+	StickyModeIP           = "ip"            // 按客户端 IP 哈希
+	StickyModeHeader       = "header"        // 按指定请求头哈希
+	StickyModeCookie       = "cookie"        // 按指定 Cookie 哈希
+	StickyModeIssuedCookie = "issued_cookie" // 由代理下发 Cookie 并按其哈希
+)
+
+// DefaultStickyCookie 代理下发的会话保持 Cookie 默认名称
+const DefaultStickyCookie = "nginx_proxy_sticky"
+
+// StickyConfig 会话保持配置
+// 启用后在匹配的上游中按一致性哈希选择，同一个键总是落到同一个上游
+type StickyConfig struct {
+	Mode   string `json:"mode"`
+	Key    string `json:"key,omitempty"`     // header/cookie 模式下的名称，issued_cookie 模式下的 Cookie 名称
+	MaxAge int    `json:"max_age,omitempty"` // issued_cookie 模式下 Cookie 的有效期（秒），0 表示会话 Cookie
+}
+
+// CookieName 返回 issued_cookie 模式下使用的 Cookie 名称
+func (s *StickyConfig) CookieName() string {
+	if s.Key != "" {
+		return s.Key
+	}
+	return DefaultStickyCookie
+}
+
+// MirrorConfig 流量镜像配置：按比例将请求复制一份发送到 Target，镜像请求的响应被丢弃
+// 由 nginx mirror 指令实现，不影响路由判断
+type MirrorConfig struct {
+	Target  string  `json:"target"`  // http://host:port，不带路径，镜像请求保持原始 URI
+	Percent float64 `json:"percent"` // 镜像比例（0, 100]
+}
+
+// Origin 返回镜像目标的 scheme://host[:port] 部分
+func (m *MirrorConfig) Origin() string {
+	return strings.TrimSuffix(m.Target, "/")
+}
+
+// Host 返回镜像请求使用的 Host 头
+func (m *MirrorConfig) Host() string {
+	u, err := url.Parse(m.Target)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// RouteTestCase 规则的路由测试用例，规则变更时会用新的 locations 验证
+type RouteTestCase struct {
+	Name    string           `json:"name,omitempty"`
+	Request RouteTestRequest `json:"request"`
+	Expect  RouteTestExpect  `json:"expect"`
+}
+
+// RouteTestRequest 测试用例的请求
+type RouteTestRequest struct {
+	Path       string            `json:"path"`
+	Method     string            `json:"method,omitempty"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	Host       string            `json:"host,omitempty"` // 为空时使用规则的 server_name
+	Headers    map[string]string `json:"headers,omitempty"`
+	Cookies    map[string]string `json:"cookies,omitempty"`
+	Query      map[string]string `json:"query,omitempty"`
+}
+
+// RouteTestExpect 测试用例的期望结果
+type RouteTestExpect struct {
+	Target string `json:"target"`        // 期望的目标地址，为空表示期望不匹配任何上游
+	URI    string `json:"uri,omitempty"` // 期望的重写后 URI，为空时不检查
+}
+
+// GetType 返回 location 类型
+func (l Location) GetType() string {
+	if l.Type == "" {
+		return LocationTypeProxy
+	}
+	return l.Type
+}
+
+// IsProxy 是否为反向代理 location，只有这类 location 需要路由判断
+func (l Location) IsProxy() bool {
+	return l.GetType() == LocationTypeProxy
+}
+
+// IsRegex 是否为正则 location
+func (l Location) IsRegex() bool {
+	return l.Modifier == LocationModifierRegex || l.Modifier == LocationModifierRegexCaseless
+}
+
+// CompileRegex 编译正则 location 的路径，~* 不区分大小写
+func (l Location) CompileRegex() (*regexp.Regexp, error) {
+	if l.Modifier == LocationModifierRegexCaseless {
+		return regexp.Compile("(?i)" + l.Path)
+	}
+	return regexp.Compile(l.Path)
+}
+
+// IsPrefix 是否为前缀 location（包括 ^~）
+func (l Location) IsPrefix() bool {
+	return l.Modifier == LocationModifierPrefix || l.Modifier == LocationModifierPrefixPriority
 }
 
 // Upstream 代表一个上游服务器配置
 type Upstream struct {
-	ConditionIP string            `json:"condition_ip"`      // CIDR 格式
-	Target      string            `json:"target"`            // http://host:port
-	Headers     map[string]string `json:"headers,omitempty"` // HTTP头部路由条件
+	ConditionIP string          `json:"condition_ip"`      // CIDR 格式，或 "@名称" 引用 IP 集合
+	Target      string          `json:"target"`            // http://host:port
+	Headers     MatchConditions `json:"headers,omitempty"` // HTTP头部路由条件
+	Cookies     MatchConditions `json:"cookies,omitempty"` // Cookie 路由条件
+	Query       MatchConditions `json:"query,omitempty"`   // 查询参数路由条件
+	Methods     []string        `json:"methods,omitempty"` // 请求方法条件（或关系），为空时不限制
+	Weight      int             `json:"weight,omitempty"`  // 流量权重，只在条件完全相同的上游（条件组）之间生效；0 表示不参与按权重分流
+	Rewrite     *RewriteConfig  `json:"rewrite,omitempty"` // 转发前的路径重写，为空时保持原始 URI
+	Pool        *UpstreamPool   `json:"pool,omitempty"`    // 后端服务器池，设置后 Target 为空，由 nginx upstream 块在服务器间负载均衡
+}
+
+// HasConditions 是否设置了请求条件（IP、头部、Cookie、查询参数或请求方法）
+func (u *Upstream) HasConditions() bool {
+	return u.conditionIP() != "" || len(u.Headers) > 0 || len(u.Cookies) > 0 || len(u.Query) > 0 || len(u.Methods) > 0
+}
+
+// conditionIP 返回 IP 条件，0.0.0.0/0 匹配所有地址，等同于未设置
+func (u *Upstream) conditionIP() string {
+	if u.ConditionIP == "0.0.0.0/0" {
+		return ""
+	}
+	return u.ConditionIP
+}
+
+// ConditionKey 返回上游请求条件的规范化表示，条件相同的上游返回相同的值
+func (u *Upstream) ConditionKey() string {
+	methods := make([]string, 0, len(u.Methods))
+	for _, method := range u.Methods {
+		methods = append(methods, strings.ToUpper(method))
+	}
+	sort.Strings(methods)
+	normalize := func(conditions MatchConditions, lowerName bool) MatchConditions {
+		normalized := make(MatchConditions, 0, len(conditions))
+		for _, condition := range conditions {
+			if lowerName {
+				condition.Name = strings.ToLower(condition.Name)
+			}
+			if condition.Operator == "" {
+				condition.Operator = MatchOperatorEquals
+			}
+			normalized = append(normalized, condition)
+		}
+		// 条件之间是且关系，与声明顺序无关
+		sort.Slice(normalized, func(i, j int) bool {
+			a, b := normalized[i], normalized[j]
+			if a.Name != b.Name {
+				return a.Name < b.Name
+			}
+			if a.Operator != b.Operator {
+				return a.Operator < b.Operator
+			}
+			return a.Value < b.Value
+		})
+		return normalized
+	}
+	key, _ := json.Marshal([]interface{}{
+		u.conditionIP(), methods,
+		normalize(u.Headers, true), normalize(u.Cookies, false), normalize(u.Query, false),
+	})
+	return string(key)
+}
+
+// ConditionGroups 返回每个上游所在条件组的编号，编号为组内第一个上游的下标
+// 请求按声明顺序命中的第一个上游决定条件组，权重和会话保持只在该组内生效，
+// 因此带条件的上游不会因为其他上游设置了权重而失去流量
+func ConditionGroups(upstreams []Upstream) []int {
+	groups := make([]int, len(upstreams))
+	first := make(map[string]int, len(upstreams))
+	for i := range upstreams {
+		key := upstreams[i].ConditionKey()
+		if group, ok := first[key]; ok {
+			groups[i] = group
+			continue
+		}
+		first[key] = i
+		groups[i] = i
+	}
+	return groups
+}
+
+// 路径重写类型
+const (
+	RewriteStripPrefix   = "strip_prefix"   // 去掉前缀
+	RewriteReplacePrefix = "replace_prefix" // 将前缀替换为 Replacement
+	RewriteRegex         = "regex"          // 正则替换
+)
+
+// RewriteConfig 路径重写配置
+type RewriteConfig struct {
+	Type        string `json:"type"`
+	Prefix      string `json:"prefix,omitempty"`      // strip_prefix/replace_prefix 的前缀，为空时使用前缀 location 的路径
+	Pattern     string `json:"pattern,omitempty"`     // regex 模式下的正则
+	Replacement string `json:"replacement,omitempty"` // replace_prefix 的新前缀，或 regex 的替换内容（支持 $1、${name}）
+}
+
+// 服务器池的负载均衡算法
+const (
+	BalanceRoundRobin = "round_robin" // 加权轮询（默认）
+	BalanceLeastConn  = "least_conn"  // 最少连接
+	BalanceRandomTwo  = "random_two"  // 随机选两台，取连接数较少的一台
+	BalanceIPHash     = "ip_hash"     // 按客户端 IP 哈希
+)
+
+// DefaultPoolKeepalive 每个 worker 与服务器池保持的默认空闲长连接数
+const DefaultPoolKeepalive = 32
+
+// UpstreamPool 上游的后端服务器池，生成为 nginx 的 upstream 块
+type UpstreamPool struct {
+	Name      string       `json:"name"`                // 池名称，所有规则中唯一
+	Scheme    string       `json:"scheme,omitempty"`    // http（默认）或 https
+	Balance   string       `json:"balance,omitempty"`   // 负载均衡算法，为空时等同于 round_robin
+	Keepalive int          `json:"keepalive,omitempty"` // 空闲长连接数，为空时使用默认值
+	Servers   []PoolServer `json:"servers"`
+}
+
+// PoolServer 服务器池中的一台后端服务器
+type PoolServer struct {
+	Address string `json:"address"`          // host:port
+	Weight  int    `json:"weight,omitempty"` // 为空时等同于 1
+}
+
+// UpstreamName 返回服务器池在 nginx 配置中的 upstream 名称
+// 加上前缀，避免与不带端口的 Target 主机名（如容器服务名）冲突
+func (p *UpstreamPool) UpstreamName() string {
+	return "pool-" + p.Name
 }
 
+// Target 返回路由到服务器池时使用的目标地址
+func (p *UpstreamPool) Target() string {
+	scheme := p.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + p.UpstreamName()
+}
+
+// GetKeepalive 返回空闲长连接数
+func (p *UpstreamPool) GetKeepalive() int {
+	if p.Keepalive > 0 {
+		return p.Keepalive
+	}
+	return DefaultPoolKeepalive
+}
+
+// ResolvePoolTargets 将使用服务器池的上游 Target 设置为服务器池的目标地址，用于路由判断
+func ResolvePoolTargets(locations []Location) {
+	for i := range locations {
+		for j := range locations[i].Upstreams {
+			if pool := locations[i].Upstreams[j].Pool; pool != nil {
+				locations[i].Upstreams[j].Target = pool.Target()
+			}
+		}
+	}
+}
+
+// 匹配条件操作符
+const (
+	MatchOperatorEquals    = "equals"     // 值相等（默认）
+	MatchOperatorNotEquals = "not_equals" // 值不相等或不存在
+	MatchOperatorPrefix    = "prefix"     // 值以指定前缀开头
+	MatchOperatorNotPrefix = "not_prefix" // 值不以指定前缀开头或不存在
+	MatchOperatorRegex     = "regex"      // 值匹配正则
+	MatchOperatorNotRegex  = "not_regex"  // 值不匹配正则或不存在
+	MatchOperatorExists    = "exists"     // 存在
+	MatchOperatorNotExists = "not_exists" // 不存在
+)
+
+// MatchCondition 代表一个请求属性（HTTP 头部、Cookie 或查询参数）的匹配条件
+type MatchCondition struct {
+	Name     string `json:"name"`
+	Operator string `json:"operator,omitempty"` // 为空时等同于 equals
+	Value    string `json:"value,omitempty"`
+}
+
+// MatchConditions 匹配条件列表（且关系）
+// 兼容旧版 {"name": "value"} 格式，旧格式的每一项都视为 equals 条件
+type MatchConditions []MatchCondition
+
+// UnmarshalJSON 同时支持条件列表和旧版键值对格式
+func (m *MatchConditions) UnmarshalJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		var conditions []MatchCondition
+		if err := json.Unmarshal(data, &conditions); err != nil {
+			return err
+		}
+		*m = conditions
+		return nil
+	}
+	var legacy map[string]string
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(legacy))
+	for name := range legacy {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	conditions := make([]MatchCondition, 0, len(names))
+	for _, name := range names {
+		conditions = append(conditions, MatchCondition{
+			Name:     name,
+			Operator: MatchOperatorEquals,
+			Value:    legacy[name],
+		})
+	}
+	*m = conditions
+	return nil
+}
+
+// MaxUpstreamWeight 单个上游允许的最大权重
+const MaxUpstreamWeight = 10000
+
 // RuleResponse 用于 API 响应
 type RuleResponse struct {
-	ID          string     `json:"id"`
-	ServerName  string     `json:"server_name"`
-	ListenPorts []int      `json:"listen_ports"`
-	SSLCert     string     `json:"ssl_cert"`
-	SSLKey      string     `json:"ssl_key"`
-	Enabled     bool       `json:"enabled"`
-	Locations   []Location `json:"locations"`
-	CreatedAt   time.Time  `json:"created_at"`
-	UpdatedAt   time.Time  `json:"updated_at"`
+	ID          string          `json:"id"`
+	ServerName  string          `json:"server_name"`
+	ListenPorts []ListenEntry   `json:"listen_ports"`
+	SSLCert     string          `json:"ssl_cert"`
+	SSLKey      string          `json:"ssl_key"`
+	ForceHTTPS  bool            `json:"force_https"`
+	Enabled     bool            `json:"enabled"`
+	Locations   []Location      `json:"locations"`
+	FailMode    string          `json:"fail_mode"`
+	StaleTTL    int             `json:"stale_ttl"`
+	TestCases   []RouteTestCase `json:"test_cases"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
 }
 
 // GetListenPorts 解析监听端口
-func (r *Rule) GetListenPorts() ([]int, error) {
-	var ports []int
+func (r *Rule) GetListenPorts() ([]ListenEntry, error) {
+	var ports []ListenEntry
 	if r.ListenPorts == "" {
 		return ports, nil
 	}
@@ -57,7 +602,7 @@ func (r *Rule) GetListenPorts() ([]int, error) {
 }
 
 // SetListenPorts 设置监听端口
-func (r *Rule) SetListenPorts(ports []int) error {
+func (r *Rule) SetListenPorts(ports []ListenEntry) error {
 	data, err := json.Marshal(ports)
 	if err != nil {
 		return err
@@ -86,6 +631,26 @@ func (r *Rule) SetLocations(locations []Location) error {
 	return nil
 }
 
+// GetTestCases 解析路由测试用例
+func (r *Rule) GetTestCases() ([]RouteTestCase, error) {
+	var cases []RouteTestCase
+	if r.TestCases == "" {
+		return cases, nil
+	}
+	err := json.Unmarshal([]byte(r.TestCases), &cases)
+	return cases, err
+}
+
+// SetTestCases 设置路由测试用例
+func (r *Rule) SetTestCases(cases []RouteTestCase) error {
+	data, err := json.Marshal(cases)
+	if err != nil {
+		return err
+	}
+	r.TestCases = string(data)
+	return nil
+}
+
 // ToResponse 转换为响应格式
 func (r *Rule) ToResponse() (*RuleResponse, error) {
 	ports, err := r.GetListenPorts()
@@ -98,14 +663,23 @@ func (r *Rule) ToResponse() (*RuleResponse, error) {
 		return nil, err
 	}
 
+	testCases, err := r.GetTestCases()
+	if err != nil {
+		return nil, err
+	}
+
 	return &RuleResponse{
 		ID:          r.ID,
 		ServerName:  r.ServerName,
 		ListenPorts: ports,
 		SSLCert:     r.SSLCert,
 		SSLKey:      r.SSLKey,
+		ForceHTTPS:  r.ForceHTTPS,
 		Enabled:     true,
 		Locations:   locations,
+		FailMode:    r.FailMode,
+		StaleTTL:    r.StaleTTL,
+		TestCases:   testCases,
 		CreatedAt:   r.CreatedAt,
 		UpdatedAt:   r.UpdatedAt,
 	}, nil
@@ -142,3 +716,194 @@ type AuthRecord struct {
 	UpdatedAt     time.Time      `json:"updated_at"`
 	DeletedAt     gorm.DeletedAt `json:"-" gorm:"index"`
 }
+
+// RouteTable 路由表，保存键到目标地址的映射，供 location 按请求属性查找
+type RouteTable struct {
+	ID          string         `json:"id" gorm:"primaryKey"`
+	Name        string         `json:"name" gorm:"not null"`
+	Description string         `json:"description"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// RouteTableEntry 路由表中的一条映射
+type RouteTableEntry struct {
+	ID        uint      `json:"-" gorm:"primaryKey"`
+	TableID   string    `json:"-" gorm:"not null;uniqueIndex:idx_route_table_entry_key"`
+	Key       string    `json:"key" gorm:"not null;uniqueIndex:idx_route_table_entry_key"`
+	Target    string    `json:"target" gorm:"not null"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// IPSetRefPrefix 引用 IP 集合的前缀，condition_ip 和 allow/deny 中的 "@名称" 表示引用该集合
+const IPSetRefPrefix = "@"
+
+// IPSet 命名的 IP 集合，可在多个规则的 condition_ip 和 allow/deny 中引用
+type IPSet struct {
+	ID          string         `json:"id" gorm:"primaryKey"`
+	Name        string         `json:"name" gorm:"not null"`
+	Description string         `json:"description"`
+	CIDRs       string         `json:"-" gorm:"column:cidrs;type:text"` // JSON 存储
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// GetCIDRs 解析 IP 集合的网段
+func (s *IPSet) GetCIDRs() ([]string, error) {
+	var cidrs []string
+	if s.CIDRs == "" {
+		return cidrs, nil
+	}
+	err := json.Unmarshal([]byte(s.CIDRs), &cidrs)
+	return cidrs, err
+}
+
+// SetCIDRs 设置 IP 集合的网段
+func (s *IPSet) SetCIDRs(cidrs []string) error {
+	data, err := json.Marshal(cidrs)
+	if err != nil {
+		return err
+	}
+	s.CIDRs = string(data)
+	return nil
+}
+
+// IPSetRef 返回条目引用的 IP 集合名称，条目不是引用时返回 false
+func IPSetRef(value string) (string, bool) {
+	return strings.CutPrefix(value, IPSetRefPrefix)
+}
+
+// IPSets IP 集合名称到网段列表的映射
+type IPSets map[string][]string
+
+// Expand 将条目中的 IP 集合引用展开为集合中的网段，其他条目保持不变
+func (s IPSets) Expand(values []string) ([]string, error) {
+	var expanded []string
+	for _, value := range values {
+		name, ok := IPSetRef(value)
+		if !ok {
+			expanded = append(expanded, value)
+			continue
+		}
+		cidrs, exists := s[name]
+		if !exists {
+			return nil, fmt.Errorf("ip set '%s' does not exist", name)
+		}
+		expanded = append(expanded, cidrs...)
+	}
+	return expanded, nil
+}
+
+// ReferencesIPSet 规则的 locations 中是否引用了指定的 IP 集合
+func ReferencesIPSet(locations []Location, name string) bool {
+	ref := IPSetRefPrefix + name
+	for _, location := range locations {
+		for _, list := range [][]string{location.Allow, location.Deny} {
+			for _, value := range list {
+				if value == ref {
+					return true
+				}
+			}
+		}
+		for _, upstream := range location.Upstreams {
+			if upstream.ConditionIP == ref {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 灰度发布状态
+const (
+	RolloutStatusRunning   = "running"   // 按步长逐步提高新目标的流量比例
+	RolloutStatusPaused    = "paused"    // 暂停，保持当前比例
+	RolloutStatusCompleted = "completed" // 新目标已承担全部流量
+	RolloutStatusAborted   = "aborted"   // 已中止，权重已恢复为发布前的值
+	RolloutStatusAborting  = "aborting"  // 中止时恢复权重失败，新目标仍承担当前比例的流量，每次检查时重试
+)
+
+// ActiveRolloutStatuses 进行中的灰度发布状态，同一 location 同时只能有一个
+var ActiveRolloutStatuses = []string{RolloutStatusRunning, RolloutStatusPaused, RolloutStatusAborting}
+
+// Rollout 灰度发布，逐步把 location 的流量切到新目标，新目标错误率超过阈值时自动回滚
+type Rollout struct {
+	ID              string    `json:"id" gorm:"primaryKey"`
+	RuleID          string    `json:"rule_id" gorm:"not null;index"`
+	LocationIndex   int       `json:"location_index"`
+	LocationPath    string    `json:"location_path"`                              // 用于检查 location 在发布期间是否被修改
+	Target          string    `json:"target" gorm:"not null"`                     // 新目标，对应 location 中的一个上游
+	InitialPercent  int       `json:"initial_percent"`                            // 起始流量比例
+	StepPercent     int       `json:"step_percent"`                               // 每一步增加的流量比例
+	StepInterval    int       `json:"step_interval"`                              // 每一步的持续时间（秒）
+	MaxErrorRate    float64   `json:"max_error_rate"`                             // 新目标的错误率（5xx 及连接错误）超过该值时中止
+	MinRequests     int       `json:"min_requests"`                               // 一步内请求数达到该值后才判断错误率
+	Percent         int       `json:"percent"`                                    // 当前流量比例
+	Status          string    `json:"status" gorm:"not null;index"`               // running、paused、aborting、completed、aborted
+	Reason          string    `json:"reason,omitempty"`                           // 暂停或中止的原因
+	LastError       string    `json:"last_error,omitempty"`                       // 中止时最近一次恢复权重失败的错误
+	OriginalWeights string    `json:"-" gorm:"column:original_weights;type:text"` // 发布前各上游的权重（JSON 存储），中止时恢复
+	StepRequests    int64     `json:"step_requests"`                              // 当前步新目标的请求数
+	StepErrors      int64     `json:"step_errors"`                                // 当前步新目标的错误数
+	StepStartedAt   time.Time `json:"step_started_at"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// IsActive 是否仍在进行中（运行、暂停或等待恢复权重）
+func (r *Rollout) IsActive() bool {
+	return slices.Contains(ActiveRolloutStatuses, r.Status)
+}
+
+// GetOriginalWeights 解析发布前各上游的权重
+func (r *Rollout) GetOriginalWeights() ([]int, error) {
+	var weights []int
+	if r.OriginalWeights == "" {
+		return weights, nil
+	}
+	err := json.Unmarshal([]byte(r.OriginalWeights), &weights)
+	return weights, err
+}
+
+// SetOriginalWeights 设置发布前各上游的权重
+func (r *Rollout) SetOriginalWeights(weights []int) error {
+	data, err := json.Marshal(weights)
+	if err != nil {
+		return err
+	}
+	r.OriginalWeights = string(data)
+	return nil
+}
+
+// CredentialStore 基本认证的凭据库，location 的 basic_auth 按名称引用
+type CredentialStore struct {
+	ID          string         `json:"id" gorm:"primaryKey"`
+	Name        string         `json:"name" gorm:"not null"`
+	Description string         `json:"description"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// Credential 凭据库中的一个用户，只保存 bcrypt 哈希，不保存明文密码
+type Credential struct {
+	ID           uint      `json:"-" gorm:"primaryKey"`
+	StoreID      string    `json:"-" gorm:"not null;uniqueIndex:idx_credential_username"`
+	Username     string    `json:"username" gorm:"not null;uniqueIndex:idx_credential_username"`
+	PasswordHash string    `json:"-" gorm:"not null"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// ReferencesCredentialStore 规则的 locations 中是否引用了指定的凭据库
+func ReferencesCredentialStore(locations []Location, name string) bool {
+	for _, location := range locations {
+		if location.BasicAuth != nil && location.BasicAuth.Store == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+-- nginx-proxy 代理结果上报
+-- log 阶段记录每个请求的代理结果（规则、location、目标地址、上游状态码、连接错误），
+-- 由每个 worker 的定时器批量上报给管理服务，用于熔断持续失败的上游
+--
+-- nginx.conf 中需要：
+--   lua_package_path "/app/template/lua/?.lua;;";
+--   init_worker_by_lua_block { require("nginx_proxy.reporter").start() }
+
+local cjson = require "cjson.safe"
+local http = require "resty.http"
+
+local ngx = ngx
+
+local DEFAULT_URL = "http://127.0.0.1:8080/api/route/outcomes"
+local DEFAULT_INTERVAL = 1
+-- 管理服务不可用时每个 worker 最多缓存的结果数，超出后丢弃
+local MAX_BUFFERED = 5000
+
+local _M = {}
+
+-- 当前 worker 待上报的结果
+local buffer = {}
+local dropped = 0
+
+-- last_value 返回 $upstream_* 变量中最后一次尝试的值（多次尝试以 ", " 分隔，内部跳转以 " : " 分隔）
+local function last_value(value)
+    if not value or value == "" then
+        return nil
+    end
+    return value:match("([^,:%s]+)%s*$")
+end
+
+local function flush(premature, url)
+    if premature or #buffer == 0 then
+        return
+    end
+    local batch = buffer
+    buffer = {}
+    local httpc = http.new()
+    local res, err = httpc:request_uri(url, {
+        method = "POST",
+        body = cjson.encode({ outcomes = batch }),
+        headers = {
+            ["Content-Type"] = "application/json"
+        },
+        timeout = 2000
+    })
+    if not res then
+        ngx.log(ngx.WARN, "failed to report proxy outcomes: ", err)
+    elseif res.status ~= 200 then
+        ngx.log(ngx.WARN, "failed to report proxy outcomes: status ", res.status)
+    end
+    if dropped > 0 then
+        ngx.log(ngx.WARN, "dropped ", dropped, " proxy outcome(s), report buffer is full")
+        dropped = 0
+    end
+end
+
+-- start 在 init_worker 阶段启动定时上报
+function _M.start(opts)
+    opts = opts or {}
+    ngx.timer.every(opts.interval or DEFAULT_INTERVAL, flush, opts.url or DEFAULT_URL)
+end
+
+-- log 在 location 的 log 阶段记录代理结果，rule_id 和 location 为请求命中的规则和 location 下标
+function _M.log(rule_id, location)
+    local target = ngx.var.backend
+    if not target or target == "" then
+        return
+    end
+    if #buffer >= MAX_BUFFERED then
+        dropped = dropped + 1
+        return
+    end
+    local status_value = last_value(ngx.var.upstream_status)
+    local status = tonumber(status_value) or 0
+    local err
+    if not status_value then
+        -- 没有上游状态且返回 502/504，说明地址解析或连接阶段就已失败；其他情况未转发到上游，不上报
+        if ngx.status ~= 502 and ngx.status ~= 504 then
+            return
+        end
+        err = "connect"
+    elseif status == 504 then
+        err = "timeout"
+    elseif status == 502 then
+        local connect_time = last_value(ngx.var.upstream_connect_time)
+        if not connect_time or connect_time == "-" then
+            err = "connect"
+        end
+    end
+    buffer[#buffer + 1] = {
+        rule_id = rule_id,
+        location = location,
+        target = target,
+        status = status,
+        error = err
+    }
+end
+
+return _M
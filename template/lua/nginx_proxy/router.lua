@@ -0,0 +1,623 @@
+-- nginx-proxy 本地路由
+-- 定时从管理服务同步路由快照到 lua_shared_dict，请求到达时在 OpenResty 内完成路由判断，
+-- 管理服务不可用时继续使用最后一次同步的快照
+--
+-- nginx.conf 中需要：
+--   lua_package_path "/app/template/lua/?.lua;;";
+--   lua_shared_dict nginx_proxy_routes 64m;
+--   init_worker_by_lua_block { require("nginx_proxy.router").start() }
+
+local cjson = require "cjson.safe"
+local http = require "resty.http"
+local ffi = require "ffi"
+local bit = require "bit"
+
+local ngx = ngx
+local ngx_re = ngx.re
+
+pcall(ffi.cdef, [[
+int inet_pton(int af, const char *src, void *dst);
+]])
+
+local AF_INET = 2
+local AF_INET6 = 10
+
+local DICT_NAME = "nginx_proxy_routes"
+local DEFAULT_URL = "http://127.0.0.1:8080/api/route/snapshot"
+local DEFAULT_INTERVAL = 1
+
+local PLACEHOLDER = [[\{([A-Za-z_][A-Za-z0-9_]*|header\.[A-Za-z0-9_-]+)\}]]
+local SAFE_VALUE = [[^[A-Za-z0-9._~-]+$]]
+
+local _M = {}
+
+-- 当前 worker 已解码的快照
+local current = { version = nil, snapshot = nil }
+
+-- ======================
+-- 快照同步
+-- ======================
+
+local function sync(premature, url, interval)
+    if premature then
+        return
+    end
+    local dict = ngx.shared[DICT_NAME]
+    -- 同一时间只需要一个 worker 拉取
+    if not dict:add("sync_lock", true, interval) then
+        return
+    end
+    local version = dict:get("version") or 0
+    local httpc = http.new()
+    local res, err = httpc:request_uri(url .. "?since=" .. string.format("%d", version), {
+        method = "GET",
+        timeout = 5000
+    })
+    if not res then
+        ngx.log(ngx.WARN, "failed to sync routing snapshot: ", err)
+        return
+    end
+    if res.status == 304 then
+        return
+    end
+    if res.status ~= 200 then
+        ngx.log(ngx.WARN, "failed to sync routing snapshot: status ", res.status)
+        return
+    end
+    local snapshot = cjson.decode(res.body)
+    if not snapshot or not snapshot.version then
+        ngx.log(ngx.WARN, "failed to sync routing snapshot: invalid body")
+        return
+    end
+    -- 先写快照再写版本号，读取方看到新版本号时一定能读到新快照
+    local ok, set_err = dict:set("snapshot", res.body)
+    if not ok then
+        ngx.log(ngx.ERR, "failed to store routing snapshot: ", set_err)
+        return
+    end
+    dict:set("version", snapshot.version)
+    ngx.log(ngx.INFO, "routing snapshot updated to version ", string.format("%d", snapshot.version))
+end
+
+-- start 在 init_worker 阶段启动快照同步
+function _M.start(opts)
+    opts = opts or {}
+    local url = opts.url or DEFAULT_URL
+    local interval = opts.interval or DEFAULT_INTERVAL
+    math.randomseed(ngx.now() * 1000 + ngx.worker.pid())
+    ngx.timer.at(0, sync, url, interval)
+    ngx.timer.every(interval, sync, url, interval)
+end
+
+-- ======================
+-- 快照解码
+-- ======================
+
+local function hex_to_bytes(hex)
+    return (hex:gsub("..", function(pair)
+        return string.char(tonumber(pair, 16))
+    end))
+end
+
+local function compile(snapshot)
+    snapshot.unhealthy_set = {}
+    for _, target in ipairs(snapshot.unhealthy or {}) do
+        snapshot.unhealthy_set[target] = true
+    end
+    for _, rule in pairs(snapshot.rules or {}) do
+        for _, location in ipairs(rule.locations or {}) do
+            for _, upstream in ipairs(location.upstreams or {}) do
+                for _, network in ipairs(upstream.networks or {}) do
+                    network.bytes = hex_to_bytes(network.network)
+                end
+            end
+        end
+    end
+    return snapshot
+end
+
+local function current_snapshot()
+    local dict = ngx.shared[DICT_NAME]
+    local version = dict:get("version")
+    if not version then
+        return nil
+    end
+    if version ~= current.version then
+        local snapshot = cjson.decode(dict:get("snapshot") or "")
+        if not snapshot then
+            return current.snapshot
+        end
+        current.snapshot = compile(snapshot)
+        current.version = version
+    end
+    return current.snapshot
+end
+
+-- ======================
+-- 请求属性
+-- ======================
+
+local ip_buf = ffi.new("unsigned char[16]")
+
+-- parse_ip 将 IP 转为 16 字节字符串，IPv4 映射为 ::ffff:a.b.c.d
+local function parse_ip(addr)
+    if not addr then
+        return nil
+    end
+    if ffi.C.inet_pton(AF_INET, addr, ip_buf) == 1 then
+        return "\0\0\0\0\0\0\0\0\0\0\255\255" .. ffi.string(ip_buf, 4)
+    end
+    if ffi.C.inet_pton(AF_INET6, addr, ip_buf) == 1 then
+        return ffi.string(ip_buf, 16)
+    end
+    return nil
+end
+
+local function new_ctx()
+    local ctx = {}
+    local headers = {}
+    for k, v in pairs(ngx.req.get_headers()) do
+        if type(v) == "table" then
+            headers[k] = table.concat(v, ",")
+        else
+            headers[k] = v
+        end
+    end
+    ctx.headers = headers
+    ctx.uri = ngx.var.uri
+    ctx.host = ngx.var.host
+    ctx.method = ngx.req.get_method()
+    ctx.remote_addr = ngx.var.remote_addr
+    return ctx
+end
+
+local function get_cookies(ctx)
+    if ctx.cookies then
+        return ctx.cookies
+    end
+    -- 同名 Cookie 取第一个
+    local cookies = {}
+    local cookie_header = ngx.var.http_cookie
+    if cookie_header then
+        for pair in string.gmatch(cookie_header, "[^;]+") do
+            local name, value = string.match(pair, "^%s*([^=]-)%s*=%s*(.-)%s*$")
+            if name and name ~= "" and cookies[name] == nil then
+                cookies[name] = value
+            end
+        end
+    end
+    ctx.cookies = cookies
+    return cookies
+end
+
+local function get_query(ctx)
+    if ctx.query then
+        return ctx.query
+    end
+    -- 多值用逗号拼接，无值参数为空字符串
+    local query = {}
+    for k, v in pairs(ngx.req.get_uri_args()) do
+        if type(v) == "table" then
+            local values = {}
+            for _, item in ipairs(v) do
+                values[#values + 1] = item == true and "" or item
+            end
+            query[k] = table.concat(values, ",")
+        elseif v == true then
+            query[k] = ""
+        else
+            query[k] = v
+        end
+    end
+    ctx.query = query
+    return query
+end
+
+-- ======================
+-- 条件匹配
+-- ======================
+
+local function match_cidr(ip, network, bits)
+    local full = math.floor(bits / 8)
+    if full > 0 and ip:sub(1, full) ~= network:sub(1, full) then
+        return false
+    end
+    local rest = bits % 8
+    if rest == 0 then
+        return true
+    end
+    local mask = 256 - 2 ^ (8 - rest)
+    return bit.band(ip:byte(full + 1), mask) == bit.band(network:byte(full + 1), mask)
+end
+
+local function match_condition(condition, value)
+    local op = condition.operator or ""
+    local expected = condition.value or ""
+    local exists = value ~= nil
+    if op == "exists" then
+        return exists
+    elseif op == "not_exists" then
+        return not exists
+    elseif op == "" or op == "equals" then
+        return exists and value == expected
+    elseif op == "not_equals" then
+        return not exists or value ~= expected
+    elseif op == "prefix" then
+        return exists and value:sub(1, #expected) == expected
+    elseif op == "not_prefix" then
+        return not exists or value:sub(1, #expected) ~= expected
+    elseif op == "regex" or op == "not_regex" then
+        local matched = exists and ngx_re.find(value, expected, "jo") ~= nil
+        if op == "not_regex" then
+            return not matched
+        end
+        return matched
+    end
+    return false
+end
+
+local function match_conditions(conditions, values)
+    for _, condition in ipairs(conditions or {}) do
+        if not match_condition(condition, values[condition.name]) then
+            return false
+        end
+    end
+    return true
+end
+
+local function match_upstream(ctx, upstream)
+    if upstream.has_ip then
+        if ctx.ip == nil then
+            ctx.ip = parse_ip(ctx.remote_addr) or false
+        end
+        if not ctx.ip then
+            return false
+        end
+        -- 任一网段匹配即可（IP 集合展开后可能有多个网段）
+        local matched = false
+        for _, network in ipairs(upstream.networks or {}) do
+            if match_cidr(ctx.ip, network.bytes, network.bits or 0) then
+                matched = true
+                break
+            end
+        end
+        if not matched then
+            return false
+        end
+    end
+    if upstream.methods then
+        local allowed = false
+        for _, method in ipairs(upstream.methods) do
+            if method == ctx.method then
+                allowed = true
+                break
+            end
+        end
+        if not allowed then
+            return false
+        end
+    end
+    if upstream.headers and not match_conditions(upstream.headers, ctx.headers) then
+        return false
+    end
+    if upstream.cookies and not match_conditions(upstream.cookies, get_cookies(ctx)) then
+        return false
+    end
+    if upstream.query and not match_conditions(upstream.query, get_query(ctx)) then
+        return false
+    end
+    return true
+end
+
+-- ======================
+-- 上游选择
+-- ======================
+
+local function random_token()
+    return string.format("%08x-%08x-%08x", math.random(0, 0x7fffffff), math.random(0, 0x7fffffff),
+        math.random(0, 0x7fffffff))
+end
+
+-- sticky_key 计算会话保持的哈希键，与 Go 服务的 stickyKey 保持一致
+local function sticky_key(ctx, sticky)
+    local mode = sticky.mode
+    if mode == "header" then
+        local value = ctx.headers[string.lower(sticky.key or "")]
+        if value and value ~= "" then
+            return value
+        end
+    elseif mode == "cookie" then
+        local value = get_cookies(ctx)[sticky.key or ""]
+        if value and value ~= "" then
+            return value
+        end
+    elseif mode == "issued_cookie" then
+        local name = sticky.key or "nginx_proxy_sticky"
+        local value = get_cookies(ctx)[name]
+        if value and value ~= "" then
+            return value
+        end
+        value = random_token()
+        local cookie = name .. "=" .. value .. "; Path=/"
+        if sticky.max_age and sticky.max_age > 0 then
+            cookie = cookie .. "; Max-Age=" .. sticky.max_age
+        end
+        return value, cookie .. "; HttpOnly; SameSite=Lax"
+    end
+    return ctx.remote_addr
+end
+
+-- sticky_hash 与 Go 服务相同：取 MD5 前 4 字节映射到 (0, 1)
+local function sticky_hash(key, target)
+    local hex = ngx.md5(key .. "\0" .. target)
+    return (tonumber(hex:sub(1, 8), 16) + 0.5) / 4294967296
+end
+
+local function select_sticky(key, upstreams, candidates)
+    local best, best_score = candidates[1], -math.huge
+    for _, i in ipairs(candidates) do
+        local weight = upstreams[i].weight or 0
+        if weight <= 0 then
+            weight = 1
+        end
+        local score = weight / -math.log(sticky_hash(key, upstreams[i].target))
+        if score > best_score then
+            best, best_score = i, score
+        end
+    end
+    return best
+end
+
+-- available 检查上游是否可用：健康检查未判定为不健康，未熔断或已到半开时间，且本次请求未因探测名额被占用而排除
+-- 只做检查，不占用探测名额
+local function available(snapshot, target, denied)
+    if snapshot.unhealthy_set[target] or denied[target] then
+        return false
+    end
+    local retry_at = snapshot.open_circuits and snapshot.open_circuits[target]
+    return not retry_at or ngx.now() * 1000 >= retry_at
+end
+
+-- claim_probe 半开状态的上游每个探测间隔只放行一个探测请求，通过 shared dict 的 add 在所有 worker 间占用名额
+-- 探测结果上报后管理服务会关闭熔断或以新的半开时间重新熔断，结果丢失时名额过期后再次探测
+local function claim_probe(snapshot, target)
+    local retry_at = snapshot.open_circuits and snapshot.open_circuits[target]
+    if not retry_at then
+        return true
+    end
+    local window = snapshot.probe_window or 30
+    local dict = ngx.shared[DICT_NAME]
+    local key = "probe:" .. target .. ":" .. string.format("%d", retry_at)
+    local ok, err = dict:add(key, true, window)
+    if not ok and err ~= "exists" then
+        ngx.log(ngx.WARN, "failed to claim circuit probe for ", target, ": ", err)
+    end
+    return ok
+end
+
+-- match_upstreams 找到第一个有可用上游的匹配条件组，返回组内的上游
+-- 组内上游的条件相同，不需要再次匹配
+local function match_upstreams(ctx, upstreams, snapshot, denied)
+    local matched, weighted, total, skipped = {}, {}, 0, false
+    local group
+    for i, upstream in ipairs(upstreams) do
+        if match_upstream(ctx, upstream) then
+            if snapshot and not available(snapshot, upstream.target, denied) then
+                skipped = true
+            else
+                group = upstream.group or i
+                break
+            end
+        end
+    end
+    if not group then
+        return matched, weighted, total, skipped
+    end
+    for i = group, #upstreams do
+        local upstream = upstreams[i]
+        if (upstream.group or i) == group then
+            if snapshot and not available(snapshot, upstream.target, denied) then
+                skipped = true
+            else
+                matched[#matched + 1] = i
+                local weight = upstream.weight or 0
+                if weight > 0 then
+                    weighted[#weighted + 1] = i
+                    total = total + weight
+                end
+            end
+        end
+    end
+    return matched, weighted, total, skipped
+end
+
+-- pick_upstream 按权重或会话保持在 match_upstreams 返回的候选上游中选择一个
+local function pick_upstream(ctx, location, matched, weighted, total)
+    local upstreams = location.upstreams or {}
+    if #matched == 0 then
+        return nil
+    end
+    if location.sticky then
+        local candidates = #weighted > 0 and weighted or matched
+        local key, cookie = sticky_key(ctx, location.sticky)
+        return select_sticky(key, upstreams, candidates), cookie
+    end
+    if total == 0 then
+        return matched[1]
+    end
+    local n = math.random(total)
+    for _, i in ipairs(weighted) do
+        n = n - upstreams[i].weight
+        if n <= 0 then
+            return i
+        end
+    end
+    return weighted[#weighted]
+end
+
+-- select_upstream 与 Go 服务的 selectUpstream 规则一致，只在第一个匹配的条件组内选择
+-- 跳过不可用的上游，匹配的上游全部不可用时忽略可用性；
+-- 选中半开状态的上游时需要占用其探测名额，名额已被占用时在本次请求中排除该上游，重新选择
+local function select_upstream(ctx, snapshot, location)
+    local upstreams = location.upstreams or {}
+    local denied = {}
+    while true do
+        local matched, weighted, total, skipped = match_upstreams(ctx, upstreams, snapshot, denied)
+        if #matched == 0 and skipped then
+            matched, weighted, total = match_upstreams(ctx, upstreams, nil)
+            return pick_upstream(ctx, location, matched, weighted, total)
+        end
+        local index, cookie = pick_upstream(ctx, location, matched, weighted, total)
+        if not index or claim_probe(snapshot, upstreams[index].target) then
+            return index, cookie
+        end
+        denied[upstreams[index].target] = true
+    end
+end
+
+-- ======================
+-- 目标地址与重写
+-- ======================
+
+local function expand_target(target, captures, headers)
+    local err
+    local expanded = ngx_re.gsub(target, PLACEHOLDER, function(m)
+        local name = m[1]
+        local value
+        if name:sub(1, 7) == "header." then
+            value = headers[string.lower(name:sub(8))]
+        else
+            value = captures[name]
+        end
+        if not value or value == "" or not ngx_re.find(value, SAFE_VALUE, "jo") then
+            err = err or ("no safe value for placeholder " .. m[0])
+            return ""
+        end
+        return value
+    end, "jo")
+    if err then
+        return nil, err
+    end
+    return expanded
+end
+
+local function rewrite_uri(uri, rewrite)
+    local result
+    if rewrite.type == "strip_prefix" or rewrite.type == "replace_prefix" then
+        local prefix = rewrite.prefix or ""
+        if prefix == "" or uri:sub(1, #prefix) ~= prefix then
+            return nil
+        end
+        result = uri:sub(#prefix + 1)
+        if rewrite.type == "replace_prefix" then
+            result = (rewrite.replacement or "") .. result
+        end
+    elseif rewrite.type == "regex" then
+        if not ngx_re.find(uri, rewrite.pattern, "jo") then
+            return nil
+        end
+        result = ngx_re.gsub(uri, rewrite.pattern, rewrite.replacement or "", "jo")
+        if not result then
+            return nil
+        end
+    else
+        return nil
+    end
+    if result:sub(1, 1) ~= "/" then
+        result = "/" .. result
+    end
+    return result
+end
+
+local function merge_captures(captures, m)
+    if m then
+        for k, v in pairs(m) do
+            if type(k) == "string" then
+                captures[k] = v
+            end
+        end
+    end
+end
+
+-- route 在指定 location 中选择目标地址，返回 target、重写后的 uri 和需要下发的 Cookie
+local function route(ctx, snapshot, rule, location)
+    -- 路由表命中时直接使用表中的目标地址
+    local lookup = location.lookup
+    if lookup then
+        local value
+        if lookup.source == "header" then
+            value = ctx.headers[string.lower(lookup.key)]
+        elseif lookup.source == "cookie" then
+            value = get_cookies(ctx)[lookup.key]
+        elseif lookup.source == "query" then
+            value = get_query(ctx)[lookup.key]
+        end
+        local tables = snapshot.route_tables or {}
+        local target = value and value ~= "" and tables[lookup.table] and tables[lookup.table][value]
+        if target then
+            return target
+        end
+    end
+
+    local index, cookie = select_upstream(ctx, snapshot, location)
+    if not index then
+        return nil
+    end
+    local upstream = location.upstreams[index]
+    local target = upstream.target
+    if upstream.templated then
+        -- location 的捕获优先于 server_name 的捕获
+        local captures = {}
+        if rule.server_regex then
+            merge_captures(captures, ngx_re.match(ctx.host, rule.server_regex, "ijo"))
+        end
+        if location.modifier == "~" or location.modifier == "~*" then
+            merge_captures(captures, ngx_re.match(ctx.uri, location.path, location.caseless and "ijo" or "jo"))
+        end
+        local err
+        target, err = expand_target(target, captures, ctx.headers)
+        if not target then
+            ngx.log(ngx.WARN, "route target rejected: ", err)
+            return nil
+        end
+    end
+    local uri
+    if upstream.rewrite then
+        uri = rewrite_uri(ctx.uri, upstream.rewrite)
+    end
+    return target, uri, cookie
+end
+
+-- access 在 location 的 access 阶段执行路由判断，rule_id 和 location_index（从 0 开始）由配置模板生成
+function _M.access(rule_id, location_index)
+    local snapshot = current_snapshot()
+    if not snapshot then
+        ngx.status = 503
+        ngx.say("503 Service Unavailable - Routing snapshot not loaded")
+        return ngx.exit(503)
+    end
+    local rule = snapshot.rules and snapshot.rules[rule_id]
+    local location = rule and rule.locations and rule.locations[location_index + 1]
+    local target, uri, cookie
+    if location then
+        target, uri, cookie = route(new_ctx(), snapshot, rule, location)
+    end
+    if not target then
+        ngx.status = 404
+        ngx.say("404 Not Found")
+        return ngx.exit(404)
+    end
+    ngx.var.backend = target
+    if cookie then
+        ngx.header["Set-Cookie"] = cookie
+    end
+    if uri then
+        ngx.req.set_uri(uri)
+    end
+end
+
+-- 供 testdata/replay_routing_cases.lua 回放路由用例
+_M._compile = compile
+_M._route = route
+
+return _M
@@ -1,13 +1,44 @@
+{{- range .Locations }}
+{{- range .Upstreams }}
+{{- with .Pool -}}
+# 服务器池 {{ .Name }}
+upstream {{ .UpstreamName }} {
+    {{- if eq .Balance "least_conn" }}
+    least_conn;
+    {{- else if eq .Balance "random_two" }}
+    random two least_conn;
+    {{- else if eq .Balance "ip_hash" }}
+    ip_hash;
+    {{- end }}
+    zone {{ .UpstreamName }} 64k;
+    {{- range .Servers }}
+    server {{ .Address }}{{ if gt .Weight 1 }} weight={{ .Weight }}{{ end }};
+    {{- end }}
+    keepalive {{ .GetKeepalive }};
+}
+
+{{ end }}
+{{- end }}
+{{- end }}
+{{- range $index, $location := .Locations }}
+{{- with .Mirror -}}
+# 流量镜像采样 location {{ $index }}
+split_clients "${request_id}" ${{ $.MirrorVar $index }} {
+    {{ printf "%g" .Percent }}% 1;
+    * "";
+}
+
+{{ end }}
+{{- end -}}
 server {
     {{- range .ListenPorts }}
-    {{- if and $.SSLCert $.SSLKey }}
-    listen {{.}} ssl;
-    {{- else }}
-    listen {{.}};
+    listen {{ .Port }}{{ if ne .Protocol "plain" }} ssl{{ end }};
     {{- end }}
+    {{- if .HTTP2 }}
+    http2 on;
     {{- end }}
 
-    server_name {{ .ServerName }};
+    server_name {{ if hasPrefix .ServerName "~" }}{{ nginxQuote .ServerName }}{{ else }}{{ .ServerName }}{{ end }};
 
     {{- if and .SSLCert .SSLKey }}
     ssl_certificate     {{ .SSLCert }};
@@ -21,8 +52,51 @@ server {
     ssl_session_timeout 10m;
     {{- end }}
 
-    {{- range .Locations }}
-    location {{ .Path }} {
+    {{- range $index, $location := .Locations }}
+    location {{ if .Modifier }}{{ .Modifier }} {{ end }}{{ if .IsRegex }}{{ nginxQuote .Path }}{{ else }}{{ .Path }}{{ end }} {
+        {{- if or .Allow .Deny }}
+
+        # 访问控制：按顺序匹配，deny 优先；设置了 allow 时其余地址返回 403
+        {{- range .Deny }}
+        deny {{ . }};
+        {{- end }}
+        {{- range .Allow }}
+        allow {{ . }};
+        {{- end }}
+        {{- if .Allow }}
+        deny all;
+        {{- end }}
+        {{- end }}
+        {{- with .BasicAuth }}
+
+        # 基本认证：用户由凭据库 {{ .Store }} 管理，与访问控制同时设置时两者都需满足
+        auth_basic {{ nginxQuote .GetRealm }};
+        auth_basic_user_file {{ nginxQuote (index $.HtpasswdFiles .Store) }};
+        {{- end }}
+        {{- if eq .GetType "redirect" }}
+        {{- with .Redirect }}
+
+        # 重定向
+        return {{ .GetCode }} {{ nginxQuote .URL }};
+        {{- end }}
+        {{- else if eq .GetType "return" }}
+        {{- with .Return }}
+
+        # 固定响应
+        default_type {{ nginxQuote .GetContentType }};
+        return {{ .GetStatus }}{{ if .Body }} {{ nginxQuote .Body }}{{ end }};
+        {{- end }}
+        {{- else if eq .GetType "static" }}
+        {{- with .Static }}
+
+        # 静态文件
+        root {{ nginxQuote .Root }};
+        index{{ range .GetIndex }} {{ . }}{{ end }};
+        {{- if .TryFiles }}
+        try_files{{ range .TryFiles }} {{ . }}{{ end }};
+        {{- end }}
+        {{- end }}
+        {{- else }}
 
         # ======================
         # 公网页面→内网资源 这种访问判为 跨地址空间
@@ -33,6 +107,14 @@ server {
         # 先定义变量
         set $backend "";
         
+        {{- if eq $.RoutingMode "local" }}
+
+        # 使用本地路由快照进行路由判断
+        access_by_lua_block {
+            require("nginx_proxy.router").access("{{ $.RuleID }}", {{ $index }})
+        }
+        {{- else }}
+
         # 使用 access_by_lua_block 进行路由判断和错误处理
         access_by_lua_block {
             local http = require "resty.http"
@@ -46,11 +128,42 @@ server {
                     headers[k] = v
                 end
             end
+            -- 解析 Cookie，同名 Cookie 取第一个
+            local cookies = {}
+            local cookie_header = ngx.var.http_cookie
+            if cookie_header then
+                for pair in string.gmatch(cookie_header, "[^;]+") do
+                    local name, value = string.match(pair, "^%s*([^=]-)%s*=%s*(.-)%s*$")
+                    if name and name ~= "" and cookies[name] == nil then
+                        cookies[name] = value
+                    end
+                end
+            end
+            -- 解析查询参数，多值用逗号拼接，无值参数为空字符串
+            local query = {}
+            local raw_args = ngx.req.get_uri_args()
+            for k, v in pairs(raw_args) do
+                if type(v) == "table" then
+                    local values = {}
+                    for _, item in ipairs(v) do
+                        values[#values + 1] = item == true and "" or item
+                    end
+                    query[k] = table.concat(values, ",")
+                elseif v == true then
+                    query[k] = ""
+                else
+                    query[k] = v
+                end
+            end
             -- 只传递必要的请求信息，配置由 Go 服务查询
             local request_data = {
                 path = ngx.var.uri,
+                method = ngx.req.get_method(),
                 remote_addr = ngx.var.remote_addr,
+                host = ngx.var.host,
                 headers = headers,
+                cookies = cookies,
+                query = query,
                 server_name = ngx.var.server_name
             }
             
@@ -67,23 +180,78 @@ server {
                 timeout = 2000  -- 2秒超时
             })
             
+            {{- if eq $.FailMode "stale" }}
+            -- 降级缓存：按 host 和 location（或路径）缓存最近一次成功的路由结果
+            local stale = ngx.shared.nginx_proxy_stale
+            local stale_key = "{{ $.RuleID }}:{{ $index }}:" .. ngx.var.host
+            {{- end }}
+
             if res and res.status == 200 then
                 local ok, result = pcall(cjson.decode, res.body)
                 if ok and result and result.match then
                     ngx.var.backend = result.target
+                    if result.set_cookie then
+                        ngx.header["Set-Cookie"] = result.set_cookie
+                    end
+                    -- 转发前重写 URI（查询参数保持不变）
+                    if result.uri then
+                        ngx.req.set_uri(result.uri)
+                    end
+                    {{- if eq $.FailMode "stale" }}
+                    if stale and result.stale_scope then
+                        local key = stale_key
+                        if result.stale_scope == "path" then
+                            key = key .. ":" .. request_data.path
+                        end
+                        stale:set(key, cjson.encode({target = result.target, uri = result.uri}), {{ $.StaleTTL }})
+                    end
+                    {{- end }}
                 else
                     ngx.status = 404
                     ngx.say("404 Not Found")
                     ngx.exit(404)
                 end
             else
+                {{- if eq $.FailMode "stale" }}
+                -- 路由服务不可用，使用缓存的路由结果（不下发会话保持 Cookie）
+                local cached = stale and (stale:get(stale_key .. ":" .. request_data.path) or stale:get(stale_key))
+                if cached then
+                    local result = cjson.decode(cached)
+                    ngx.log(ngx.WARN, "route service unavailable (", err or res.status, "), serving stale target: ", result.target)
+                    local stats = ngx.shared.nginx_proxy_stats
+                    if stats then
+                        stats:incr("stale_served", 1, 0)
+                        stats:incr("stale_served:{{ $.RuleID }}", 1, 0)
+                    end
+                    ngx.var.backend = result.target
+                    if result.uri then
+                        ngx.req.set_uri(result.uri)
+                    end
+                    return
+                end
+                {{- end }}
                 ngx.status = 502
                 ngx.say("502 Bad Gateway - Route service unavailable")
                 ngx.exit(502)
             end
         }
 
+        {{- end }}
+
+        {{- if $.ReportOutcomes }}
+
+        # 上报代理结果，供管理服务熔断持续失败的上游及统计灰度发布的错误率
+        log_by_lua_block {
+            require("nginx_proxy.reporter").log("{{ $.RuleID }}", {{ $index }})
+        }
+        {{- end }}
+
         proxy_pass $backend;
+        {{- with .Mirror }}
+
+        # 流量镜像：按比例将请求复制到 {{ .Target }}，镜像响应被丢弃
+        mirror /_nginx_proxy_mirror_{{ $index }};
+        {{- end }}
 
         # 代理头设置
         proxy_set_header Host $host;
@@ -91,8 +259,13 @@ server {
         proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
         proxy_set_header X-Forwarded-Proto $scheme;
         proxy_set_header X-Forwarded-Host $server_name;
+        {{- if .BasicAuth }}
+        # 基本认证的凭据只用于代理，不转发给后端
+        proxy_set_header Authorization "";
+        {{- end }}
         {{- if and $.SSLCert $.SSLKey }}
-        proxy_set_header X-Forwarded-Ssl on;
+        # 同一规则可能同时监听明文和 HTTPS 端口，按实际连接设置（明文时为空，不发送）
+        proxy_set_header X-Forwarded-Ssl $https;
         {{- end }}
 
         proxy_pass_request_headers on;
@@ -111,7 +284,35 @@ server {
         proxy_next_upstream error timeout invalid_header http_500 http_502 http_503 http_504;
         proxy_next_upstream_tries 3;
         proxy_next_upstream_timeout 30s;
+        {{- end }}
     }
+    {{- with .Mirror }}
+
+    location = /_nginx_proxy_mirror_{{ $index }} {
+        internal;
+        # 未被采样的请求不发送镜像
+        if (${{ $.MirrorVar $index }} = "") {
+            return 204;
+        }
+        proxy_pass {{ .Origin }}$request_uri;
+        proxy_set_header Host {{ .Host }};
+        proxy_ssl_server_name on;
+        proxy_set_header X-Real-IP $remote_addr;
+        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+        proxy_set_header X-Forwarded-Proto $scheme;
+        proxy_set_header X-Mirrored-By nginx-proxy;
+        {{- if $location.BasicAuth }}
+        proxy_set_header Authorization "";
+        {{- end }}
+        proxy_http_version 1.1;
+        proxy_set_header Connection "";
+
+        # 镜像目标较慢时不能拖住原请求
+        proxy_connect_timeout 2s;
+        proxy_send_timeout 10s;
+        proxy_read_timeout 10s;
+    }
+    {{- end }}
     {{- end }}
 
     # 错误页面
@@ -127,4 +328,25 @@ server {
     {{- if and .SSLCert .SSLKey }}
     # add_header Strict-Transport-Security "max-age=31536000; includeSubDomains" always;
     {{- end }}
-}
\ No newline at end of file
+}
+{{- if .RedirectPorts }}
+
+# 强制 HTTPS：明文端口的请求重定向到 HTTPS，ACME 验证请求除外
+server {
+    {{- range .RedirectPorts }}
+    listen {{ . }};
+    {{- end }}
+
+    server_name {{ if hasPrefix .ServerName "~" }}{{ nginxQuote .ServerName }}{{ else }}{{ .ServerName }}{{ end }};
+
+    location ^~ /.well-known/acme-challenge/ {
+        root {{ nginxQuote .ACMEChallengeDir }};
+        default_type "text/plain";
+        try_files $uri =404;
+    }
+
+    location / {
+        return 301 https://$host{{ if ne .HTTPSPort 443 }}:{{ .HTTPSPort }}{{ end }}$request_uri;
+    }
+}
+{{- end }}
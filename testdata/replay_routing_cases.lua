@@ -0,0 +1,90 @@
+-- 在 OpenResty 中回放路由用例，验证本地路由与 Go 路由接口的结果一致
+-- 规则使用 routing_snapshots.json 中由 Go 快照编译器生成的结果（go test ./internal/core -update 重新生成）
+--
+-- 在仓库根目录执行：
+--   resty -I template/lua testdata/replay_routing_cases.lua
+
+local cjson = require "cjson.safe"
+local router = require "nginx_proxy.router"
+
+local function read_json(path)
+    local file = assert(io.open(path, "r"))
+    local data = file:read("*a")
+    file:close()
+    return assert(cjson.decode(data))
+end
+
+local function contains(list, value)
+    for _, item in ipairs(list) do
+        if item == value then
+            return true
+        end
+    end
+    return false
+end
+
+local cases = read_json("testdata/routing_cases.json")
+local snapshots = read_json("testdata/routing_snapshots.json")
+
+local failed = 0
+for _, case in ipairs(cases) do
+    local rule = snapshots[case.name]
+    local snapshot = router._compile({ rules = { rule = rule } })
+    local request = case.request
+    local ctx = {
+        headers = request.headers or {},
+        cookies = request.cookies or {},
+        query = request.query or {},
+        uri = request.path,
+        host = request.host,
+        method = request.method,
+        remote_addr = request.remote_addr,
+    }
+    local err
+    -- location 由 nginx 选择，这里直接使用用例期望的 location
+    local location = case.location >= 0 and snapshot.rules.rule.locations[case.location + 1]
+    if not location then
+        if #case.targets > 0 then
+            err = "no location"
+        end
+    else
+        -- 按权重随机选择时多次路由，结果必须都在候选中且每个候选都出现过
+        local runs = #case.targets > 1 and 200 or 1
+        local seen, count = {}, 0
+        for _ = 1, runs do
+            local target, uri = router._route(ctx, snapshot, snapshot.rules.rule, location)
+            if #case.targets == 0 then
+                if target then
+                    err = "matched " .. target .. ", want no match"
+                end
+                break
+            end
+            if not target or not contains(case.targets, target) then
+                err = "target = " .. tostring(target)
+                break
+            end
+            if (uri or "") ~= (case.uri or "") then
+                err = "uri = " .. tostring(uri) .. ", want " .. tostring(case.uri)
+                break
+            end
+            if not seen[target] then
+                seen[target] = true
+                count = count + 1
+            end
+        end
+        if not err and #case.targets > 0 and count ~= #case.targets then
+            err = "not all targets selected"
+        end
+    end
+    if err then
+        failed = failed + 1
+        print("FAIL " .. case.name .. ": " .. err)
+    else
+        print("ok   " .. case.name)
+    end
+end
+
+if failed > 0 then
+    print(failed .. " case(s) failed")
+    os.exit(1)
+end
@@ -66,6 +66,7 @@ class Toast {
 
 // 全局变量
 let currentCertificates = [];
+let editingRule = null; // 正在编辑的规则，保存时表单无法表示的字段从这里原样带回
 
 // 页面加载完成后初始化
 document.addEventListener('DOMContentLoaded', function () {
@@ -821,6 +822,7 @@ function createProxy() {
         if (selectedCert) {
             requestData.ssl_cert = selectedCert.cert_path;
             requestData.ssl_key = selectedCert.key_path;
+            requestData.force_https = httpRedirect;
         }
     }
 
@@ -1098,6 +1100,8 @@ window.editProxy = function (ruleId) {
 // 填充编辑表单
 function populateEditForm(rule) {
     try {
+        editingRule = rule;
+
         // 填充基本信息
         document.getElementById('edit-proxy-id').value = rule.id || '';
         document.getElementById('edit-proxy-domain').value = rule.server_name || '';
@@ -1112,9 +1116,8 @@ function populateEditForm(rule) {
 
         if (hasSSL) {
             document.getElementById('edit-ssl-config').classList.remove('hidden');
-            // 检查是否同时监听80端口（HTTP重定向）
-            const hasHttpPort = rule.listen_ports && rule.listen_ports.includes(80);
-            document.getElementById('edit-proxy-http-redirect').checked = hasHttpPort;
+            // 检查是否强制 HTTPS（HTTP重定向）
+            document.getElementById('edit-proxy-http-redirect').checked = !!rule.force_https;
 
             // 加载证书选项并选中当前证书
             loadCertificatesData().then(() => {
@@ -1141,11 +1144,70 @@ function populateEditForm(rule) {
     }
 }
 
+// 将头部条件转换为表单使用的键值对（表单只支持等值匹配）
+function normalizeHeaderConditions(headers) {
+    if (!headers) {
+        return {};
+    }
+    if (!Array.isArray(headers)) {
+        return headers;
+    }
+    const result = {};
+    headers.forEach(condition => {
+        if (isEqualsCondition(condition)) {
+            result[condition.name] = condition.value;
+        }
+    });
+    return result;
+}
+
+function isEqualsCondition(condition) {
+    return !condition.operator || condition.operator === 'equals';
+}
+
+// 返回头部条件中表单无法编辑的部分（非等值匹配），保存时原样保留
+function preservedHeaderConditions(headers) {
+    if (!Array.isArray(headers)) {
+        return [];
+    }
+    return headers.filter(condition => !isEqualsCondition(condition));
+}
+
+// 列出上游中表单无法编辑、保存时原样保留的设置
+function describePreservedUpstreamFields(upstream) {
+    const fields = [];
+    const headers = preservedHeaderConditions(upstream.headers);
+    if (headers.length > 0) {
+        fields.push('头部条件 ' + headers.map(condition => `${condition.name} ${condition.operator}`).join('、'));
+    }
+    if (upstream.cookies && Object.keys(upstream.cookies).length > 0) {
+        fields.push('Cookie 条件');
+    }
+    if (upstream.query && Object.keys(upstream.query).length > 0) {
+        fields.push('查询参数条件');
+    }
+    if (upstream.methods && upstream.methods.length > 0) {
+        fields.push('请求方法 ' + upstream.methods.join('/'));
+    }
+    if (upstream.weight) {
+        fields.push('权重 ' + upstream.weight);
+    }
+    if (upstream.rewrite) {
+        fields.push('路径重写');
+    }
+    if (upstream.pool) {
+        fields.push('服务器池 ' + (upstream.pool.name || ''));
+    }
+    return fields;
+}
+
 // 填充编辑模式的分流配置
 function populateEditUpstreamConfigs(upstreams) {
     const container = document.getElementById('edit-upstream-configs');
     container.innerHTML = '';
 
+    // 已有的上游在保存时以原始配置为基础合并
+    const existing = !!upstreams && upstreams.length > 0;
     if (!upstreams || upstreams.length === 0) {
         // 如果没有分流配置，添加一个默认的
         upstreams = [{
@@ -1158,10 +1220,14 @@ function populateEditUpstreamConfigs(upstreams) {
     upstreams.forEach((upstream, index) => {
         const upstreamDiv = document.createElement('div');
         upstreamDiv.className = 'upstream-config border border-gray-200 rounded-md p-3';
+        if (existing) {
+            upstreamDiv.dataset.index = index;
+        }
+        const preserved = describePreservedUpstreamFields(upstream);
 
         // 构建头部配置HTML
         let headersHtml = '';
-        const headers = upstream.headers || {};
+        const headers = normalizeHeaderConditions(upstream.headers);
         const headerKeys = Object.keys(headers);
 
         if (headerKeys.length === 0) {
@@ -1203,6 +1269,7 @@ function populateEditUpstreamConfigs(upstreams) {
                     ${headersHtml}
                 </div>
             </div>
+            ${preserved.length > 0 ? `<div class="mt-2 text-xs text-yellow-700 bg-yellow-50 rounded px-2 py-1"><i class="fas fa-info-circle"></i> 表单无法编辑的设置将保持不变：${preserved.join('；')}</div>` : ''}
             ${index > 0 ? '<div class="mt-2"><button type="button" class="remove-upstream text-red-600 hover:text-red-800 text-xs">- 删除此规则</button></div>' : ''}
         `;
 
@@ -1339,32 +1406,36 @@ function updateProxy() {
     // 收集分流配置
     const upstreamConfigs = [];
     const upstreamElements = document.querySelectorAll('#edit-upstream-configs .upstream-config');
+    const firstLocation = editingRule && editingRule.locations && editingRule.locations.length > 0 ? editingRule.locations[0] : {};
+    const originalUpstreams = firstLocation.upstreams || [];
 
     upstreamElements.forEach(element => {
         const condition = element.querySelector('.upstream-condition').value.trim();
         const target = element.querySelector('.upstream-target').value.trim();
+        // 已有的上游以原始配置为基础，只覆盖表单中的字段，表单无法表示的条件和设置原样保留
+        const original = element.dataset.index !== undefined ? originalUpstreams[Number(element.dataset.index)] || {} : {};
 
-        if (!target) {
+        if (!target && !original.pool) {
             Toast.warning('请填写目标地址');
             return;
         }
 
         // 收集头部条件
-        const headers = {};
+        const headers = preservedHeaderConditions(original.headers);
         const headerPairs = element.querySelectorAll('.header-pair');
         headerPairs.forEach(pair => {
             const key = pair.querySelector('.header-key').value.trim();
             const value = pair.querySelector('.header-value').value.trim();
             if (key && value) {
-                headers[key] = value;
+                headers.push({ name: key, operator: 'equals', value: value });
             }
         });
 
-        upstreamConfigs.push({
+        upstreamConfigs.push(Object.assign({}, original, {
             target: target,
             condition_ip: condition || '0.0.0.0/0',
             headers: headers
-        });
+        }));
     });
 
     if (upstreamConfigs.length === 0) {
@@ -1376,21 +1447,26 @@ function updateProxy() {
     let listenPorts = [80]; // 默认启用HTTP 80
 
     if (sslEnabled) {
-        listenPorts.push(443); // 启用HTTPS 443
-        if (!httpRedirect) {
-            // 如果不启用HTTP重定向，则只使用HTTPS端口
-            listenPorts = [443];
-        }
+        // 只监听 HTTPS 443，HTTP重定向由 force_https 生成的 80 端口服务器完成
+        listenPorts = [443];
     }
 
+    // 表单只编辑第一个 location 的路径和上游，其余 location 及 location 的其他设置原样保留
+    const locations = editingRule && editingRule.locations ? editingRule.locations.slice() : [];
+    locations[0] = Object.assign({}, firstLocation, {
+        path: path,
+        upstreams: upstreamConfigs
+    });
+
     const requestData = {
         server_name: domain,
         listen_ports: listenPorts,
-        locations: [{
-            path: path,
-            upstreams: upstreamConfigs
-        }]
+        locations: locations
     };
+    if (editingRule) {
+        requestData.fail_mode = editingRule.fail_mode;
+        requestData.stale_ttl = editingRule.stale_ttl;
+    }
 
     // 如果启用SSL且选择了证书，添加证书配置
     if (sslEnabled && certificateId) {
@@ -1402,6 +1478,7 @@ function updateProxy() {
         if (selectedCert) {
             requestData.ssl_cert = selectedCert.cert_path;
             requestData.ssl_key = selectedCert.key_path;
+            requestData.force_https = httpRedirect;
         }
     }
 